@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -12,6 +13,7 @@ import (
 	"github.com/evergreen-ci/aviation"
 	"github.com/evergreen-ci/aviation/services"
 	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/evergreen-ci/utility"
 	"github.com/mongodb/grip"
 	"github.com/mongodb/grip/level"
 	"github.com/mongodb/grip/message"
@@ -22,11 +24,14 @@ import (
 )
 
 const (
-	defaultMaxBufferSize int = 1e7
-	defaultFlushInterval     = time.Minute
+	defaultMaxBufferSize   int = 1e7
+	defaultQueueSizeFactor     = 4
+	defaultMaxRPCSize          = 4 * 1024 * 1024
+	defaultFlushInterval       = time.Minute
 )
 
-// LogFormat describes the format of the log.
+// LogFormat describes the format of the log. Logs in the JSON and BSON
+// formats store each message sent as a single StructuredLine document.
 type LogFormat int32
 
 // Valid LogFormat values.
@@ -66,17 +71,44 @@ func (s LogStorage) validate() error {
 }
 
 type buildlogger struct {
-	mu         sync.Mutex
-	ctx        context.Context
-	cancel     context.CancelFunc
-	opts       *LoggerOptions
-	conn       *grpc.ClientConn
-	client     gopb.BuildloggerClient
-	buffer     []*gopb.LogLine
-	bufferSize int
-	lastFlush  time.Time
-	timer      *time.Timer
-	closed     bool
+	mu            sync.Mutex
+	flushMu       sync.Mutex
+	flusher       *flusher
+	budget        *memoryBudget
+	ctx           context.Context
+	cancel        context.CancelFunc
+	opts          *LoggerOptions
+	conn          *grpc.ClientConn
+	client        gopb.BuildloggerClient
+	stream        gopb.Buildlogger_StreamLogLinesClient
+	streamCancel  context.CancelFunc
+	streamed      []*streamedLines
+	streamedSize  int
+	streamWriter  string
+	streamNext    uint64
+	buffer        []*gopb.LogLine
+	bufferSize    int
+	queue         []*batch
+	queueSize     int
+	seq           uint64
+	writer        string
+	lineSeq       uint64
+	dropped       droppedLines
+	lastFlush     time.Time
+	lastTimestamp time.Time
+	spool         *spool
+	closed        bool
+	drained       bool
+	degraded      bool
+	creating      chan struct{}
+	stopCreating  context.CancelFunc
+	chunk         int
+	logCreatedAt  time.Time
+	logLines      int
+	logBytes      int
+	logClosed     bool
+	suppression   suppression
+	stats         senderStats
 	*send.Base
 }
 
@@ -108,19 +140,103 @@ type LoggerOptions struct {
 	Local send.Sender `bson:"-" json:"-" yaml:"-"`
 
 	// The number max number of bytes to buffer before sending log data
-	// over rpc to cedar. Defaults to 10MB.
+	// over rpc to cedar. This only controls when a flush is triggered,
+	// the flushed log lines are split into requests of at most
+	// MaxRPCSize bytes. Defaults to 10MB.
 	MaxBufferSize int `bson:"max_buffer_size" json:"max_buffer_size" yaml:"max_buffer_size"`
+	// The maximum number of bytes of a single serialized request of log
+	// lines, including protobuf overhead. This should not exceed the max
+	// message size of the gRPC server. A log line too large to fit in a
+	// request is sent on its own. Defaults to 4MB, the gRPC default.
+	MaxRPCSize int `bson:"max_rpc_size" json:"max_rpc_size" yaml:"max_rpc_size"`
+	// The maximum number of bytes of log lines held in memory waiting to
+	// be sent, including the buffer. Setting MaxQueueSize to a value less
+	// than 0 removes the limit. Defaults to four times MaxBufferSize.
+	MaxQueueSize int `bson:"max_queue_size" json:"max_queue_size" yaml:"max_queue_size"`
+	// What to do with new log lines when the queue is full. The spill
+	// policy requires a spool directory. Defaults to blocking Send until
+	// there is room in the queue.
+	OverflowPolicy OverflowPolicy `bson:"overflow_policy" json:"overflow_policy" yaml:"overflow_policy"`
 	// The interval at which to flush log lines, regardless of whether the
 	// max buffer size has been reached or not. Setting FlushInterval to a
 	// duration less than 0 will disable timed flushes. Defaults to 1
 	// minute.
 	FlushInterval time.Duration `bson:"flush_interval" json:"flush_interval" yaml:"flush_interval"`
 
+	// Ensure that the timestamps of the log's lines never decrease. A
+	// line whose timestamp is earlier than that of the previous line is
+	// given the previous line's timestamp instead.
+	MonotonicTimestamps bool `bson:"monotonic_timestamps" json:"monotonic_timestamps" yaml:"monotonic_timestamps"`
+
 	// Disable checking for new lines in messages. If this is set to true,
 	// make sure log messages do not contain new lines, otherwise the logs
 	// will be stored incorrectly.
 	DisableNewLineCheck bool `bson:"disable_new_line_check" json:"disable_new_line_check" yaml:"disable_new_line_check"`
 
+	// The directory used as a write-ahead spool of log lines. Lines are
+	// written to the spool as soon as they are batched, which happens
+	// while Send holds the sender's lock, and removed once cedar
+	// acknowledges them. Lines that could not be sent are replayed from
+	// the spool, in order, before any new lines on subsequent flushes,
+	// including flushes by a sender created after a process restart with
+	// the same spool directory. If empty, lines are kept in memory only.
+	// A spool directory must not be shared by concurrently open senders.
+	SpoolDir string `bson:"spool_dir" json:"spool_dir" yaml:"spool_dir"`
+
+	// Send log lines over one long-lived StreamLogLines RPC per log
+	// instead of one AppendLogLines RPC per flush. This reduces overhead
+	// for chatty processes. The server only acknowledges the lines of a
+	// stream when the stream is closed, so they are held in memory, in
+	// addition to the queue, until then: the stream is closed and a new
+	// one opened once they reach MaxQueueSize, when rolling over, and
+	// when the sender is closed. A broken stream is reopened
+	// transparently and the lines not yet acknowledged are resent.
+	Stream bool `bson:"stream" json:"stream" yaml:"stream"`
+
+	// The retry policy for RPCs to cedar. By default, RPCs are not
+	// retried.
+	Retry RetryOptions `bson:"retry" json:"retry" yaml:"retry"`
+
+	// Start the sender even if the log cannot be created. Until the log
+	// is created, which is retried in the background with the retry
+	// policy's backoff, log lines are written to the local sender and
+	// held, in the spool directory if one is configured or in memory
+	// otherwise, and flushes return an error. Log lines held in memory
+	// are limited by the max queue size; once it is reached, the oldest
+	// are dropped and counted in the sender's statistics, even if the
+	// overflow policy is to block. Once the log is created, the held log
+	// lines are sent to it. If the log still cannot be created when the
+	// sender is closed, the log lines held in the spool remain there for
+	// replay by a future sender.
+	DegradedStart bool `bson:"degraded_start" json:"degraded_start" yaml:"degraded_start"`
+
+	// Thresholds at which to close the log and continue in a new one.
+	// Use GetLogIDs to get the IDs of all the logs. By default, logs are
+	// never rolled over.
+	Rollover RolloverOptions `bson:"rollover" json:"rollover" yaml:"rollover"`
+
+	// The suppression of repeated log lines and of log lines over a rate
+	// limit. By default, nothing is suppressed.
+	Suppress SuppressOptions `bson:"suppress" json:"suppress" yaml:"suppress"`
+
+	// The sender to which the sender's statistics are sent, as a grip
+	// message of fields, when the sender is closed. By default, the
+	// statistics are only available through Stats.
+	StatsSender send.Sender `bson:"-" json:"-" yaml:"-"`
+
+	// Secrets to scrub from log lines before they are buffered, and from
+	// error messages sent to the local sender. By default, nothing is
+	// redacted.
+	Redact RedactOptions `bson:"redact" json:"redact" yaml:"redact"`
+
+	// The directory in which to store logs instead of sending them to
+	// cedar, for running offline without credentials. The local backend
+	// is used when LocalDir is set and either Storage is LogStorageLocal
+	// or neither a client connection nor a base address is provided. See
+	// local.go for the on-disk format, which Get can read by setting its
+	// LocalDir option.
+	LocalDir string `bson:"local_dir" json:"local_dir" yaml:"local_dir"`
+
 	// The gRPC client connection. If nil, a new connection will be
 	// established with the gRPC connection configuration.
 	ClientConn *grpc.ClientConn `bson:"-" json:"-" yaml:"-"`
@@ -133,7 +249,7 @@ type LoggerOptions struct {
 	Username    string       `bson:"username" json:"username" yaml:"username"`
 	APIKey      string       `bson:"api_key" json:"api_key" yaml:"api_key"`
 
-	logID    string
+	logIDs   *logIDList
 	exitCode int32
 }
 
@@ -144,8 +260,26 @@ func (opts *LoggerOptions) validate() error {
 	if err := opts.Storage.validate(); err != nil {
 		return err
 	}
+	if err := opts.Retry.validate(); err != nil {
+		return errors.Wrap(err, "invalid retry options")
+	}
+	if err := opts.Rollover.validate(); err != nil {
+		return errors.Wrap(err, "invalid rollover options")
+	}
+	if err := opts.Suppress.validate(opts.Format); err != nil {
+		return errors.Wrap(err, "invalid suppress options")
+	}
+	if err := opts.Redact.validate(); err != nil {
+		return errors.Wrap(err, "invalid redact options")
+	}
+	if err := opts.OverflowPolicy.validate(); err != nil {
+		return err
+	}
+	if opts.OverflowPolicy == OverflowSpill && opts.SpoolDir == "" {
+		return errors.New("must specify a spool directory to spill log lines")
+	}
 
-	if opts.ClientConn == nil {
+	if opts.ClientConn == nil && !opts.useLocal() {
 		if opts.BaseAddress == "" || opts.RPCPort == "" {
 			return errors.New("must specify a base address and rpc port when a client connection is not provided")
 		}
@@ -167,6 +301,17 @@ func (opts *LoggerOptions) validate() error {
 		opts.MaxBufferSize = defaultMaxBufferSize
 	}
 
+	if opts.MaxRPCSize < 0 {
+		return errors.New("max RPC size cannot be negative")
+	}
+	if opts.MaxRPCSize == 0 {
+		opts.MaxRPCSize = defaultMaxRPCSize
+	}
+
+	if opts.MaxQueueSize == 0 {
+		opts.MaxQueueSize = defaultQueueSizeFactor * opts.MaxBufferSize
+	}
+
 	if opts.FlushInterval == 0 {
 		opts.FlushInterval = defaultFlushInterval
 	}
@@ -174,12 +319,72 @@ func (opts *LoggerOptions) validate() error {
 	return nil
 }
 
+// useLocal returns whether logs are stored in the local directory instead of
+// being sent to cedar.
+func (opts *LoggerOptions) useLocal() bool {
+	return opts.LocalDir != "" && (opts.Storage == LogStorageLocal || (opts.ClientConn == nil && opts.BaseAddress == ""))
+}
+
 // SetExitCode sets the exit code variable.
 func (opts *LoggerOptions) SetExitCode(i int32) { opts.exitCode = i }
 
 // GetLogID returns the unique buildlogger log ID set after NewLogger is
-// called.
-func (opts *LoggerOptions) GetLogID() string { return opts.logID }
+// called. When rolling over, this is the ID of the current log.
+//
+// Deprecated: Use GetLogIDs, which returns the IDs of all the logs.
+func (opts *LoggerOptions) GetLogID() string { return opts.logIDs.current() }
+
+// GetLogIDs returns the IDs of all the buildlogger logs created by the sender,
+// in order, the last being its current log.
+func (opts *LoggerOptions) GetLogIDs() []string { return opts.logIDs.all() }
+
+// logIDList is the list of the logs created by a sender, in order, the last
+// being its current log. The sender adds to it from its background
+// goroutines, such as when rolling over, while the users of its options may
+// read it at any time, so it has its own lock.
+type logIDList struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (l *logIDList) current() string {
+	if l == nil {
+		return ""
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.ids) == 0 {
+		return ""
+	}
+	return l.ids[len(l.ids)-1]
+}
+
+func (l *logIDList) all() []string {
+	if l == nil {
+		return []string{}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string{}, l.ids...)
+}
+
+func (l *logIDList) contains(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return slices.Contains(l.ids, id)
+}
+
+func (l *logIDList) add(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.ids = append(l.ids, id)
+}
 
 // NewLogger returns a grip Sender backed by cedar Buildlogger with level
 // information set.
@@ -210,126 +415,256 @@ func MakeLogger(name string, opts *LoggerOptions) (send.Sender, error) {
 // MakeLoggerWithContext returns a grip Sender backed by cedar Buildlogger
 // using the passed in context.
 func MakeLoggerWithContext(ctx context.Context, name string, opts *LoggerOptions) (send.Sender, error) {
+	return makeLogger(ctx, name, opts, (*buildlogger).startLog)
+}
+
+// makeLogger returns a new sender whose log is started by the given function,
+// either by creating a new log or by attaching to an existing one.
+func makeLogger(ctx context.Context, name string, opts *LoggerOptions, start func(*buildlogger) error) (send.Sender, error) {
 	if err := opts.validate(); err != nil {
 		return nil, errors.Wrap(err, "invalid cedar buildlogger options")
 	}
 
-	var conn *grpc.ClientConn
-	var err error
-	if opts.ClientConn == nil {
-		if opts.Insecure {
-			rpcOpts := []grpc.DialOption{
-				grpc.WithUnaryInterceptor(aviation.MakeRetryUnaryClientInterceptor(10)),
-				grpc.WithStreamInterceptor(aviation.MakeRetryStreamClientInterceptor(10)),
-				grpc.WithInsecure(),
-			}
-			opts.ClientConn, err = grpc.DialContext(ctx, opts.BaseAddress+":"+opts.RPCPort, rpcOpts...)
-		} else {
-			dialOpts := &services.DialCedarOptions{
-				BaseAddress: opts.BaseAddress,
-				RPCPort:     opts.RPCPort,
-				Username:    opts.Username,
-				APIKey:      opts.APIKey,
-				Retries:     10,
-			}
-			opts.ClientConn, err = services.DialCedar(ctx, opts.HTTPClient, dialOpts)
-		}
-		if err != nil {
-			return nil, errors.Wrap(err, "dialing RPC server")
-		}
+	client, conn, err := newClient(ctx, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	b := &buildlogger{
-		ctx:    ctx,
-		opts:   opts,
-		conn:   conn,
-		client: gopb.NewBuildloggerClient(opts.ClientConn),
-		buffer: []*gopb.LogLine{},
-		Base:   send.NewBase(name),
+	b := newBuildlogger(ctx, name, opts, client, newFlusher(opts), newMemoryBudget(opts.MaxQueueSize))
+	b.flusher.add(b)
+	b.conn = conn
+
+	if opts.SpoolDir != "" {
+		if err = b.openSpool(opts.SpoolDir); err != nil {
+			b.cancel()
+			return nil, err
+		}
 	}
 
-	if err := b.SetErrorHandler(send.ErrorHandlerFromSender(b.opts.Local)); err != nil {
+	if err := b.SetErrorHandler(b.handleError); err != nil {
+		b.cancel()
 		return nil, errors.Wrap(err, "setting default error handler")
 	}
 
-	if err := b.createNewLog(); err != nil {
+	if err := start(b); err != nil {
+		b.cancel()
 		return nil, err
 	}
 
+	go b.flushLoop()
+
+	return b, nil
+}
+
+// newClient returns the buildlogger client for the options: either a client
+// of the local backend or a gRPC client, dialing a new connection if needed.
+// The new connection, if any, is returned so that it can be closed by its
+// owner.
+func newClient(ctx context.Context, opts *LoggerOptions) (gopb.BuildloggerClient, *grpc.ClientConn, error) {
+	if opts.useLocal() {
+		client, err := newLocalClient(opts.LocalDir)
+		return client, nil, err
+	}
+
+	conn, err := dial(ctx, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return gopb.NewBuildloggerClient(opts.ClientConn), conn, nil
+}
+
+// dial establishes a new gRPC client connection, stored in the options, if
+// the options do not already have one. The new connection is returned so that
+// it can be closed by its owner.
+func dial(ctx context.Context, opts *LoggerOptions) (*grpc.ClientConn, error) {
+	if opts.ClientConn != nil {
+		return nil, nil
+	}
+
+	var err error
+	if opts.Insecure {
+		rpcOpts := []grpc.DialOption{
+			grpc.WithUnaryInterceptor(aviation.MakeRetryUnaryClientInterceptor(10)),
+			grpc.WithStreamInterceptor(aviation.MakeRetryStreamClientInterceptor(10)),
+			grpc.WithInsecure(),
+		}
+		opts.ClientConn, err = grpc.DialContext(ctx, opts.BaseAddress+":"+opts.RPCPort, rpcOpts...)
+	} else {
+		dialOpts := &services.DialCedarOptions{
+			BaseAddress: opts.BaseAddress,
+			RPCPort:     opts.RPCPort,
+			Username:    opts.Username,
+			APIKey:      opts.APIKey,
+			Retries:     10,
+		}
+		opts.ClientConn, err = services.DialCedar(ctx, opts.HTTPClient, dialOpts)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "dialing RPC server")
+	}
+
+	return opts.ClientConn, nil
+}
+
+func newBuildlogger(ctx context.Context, name string, opts *LoggerOptions, client gopb.BuildloggerClient, f *flusher, budget *memoryBudget) *buildlogger {
 	ctx, cancel := context.WithCancel(ctx)
-	b.ctx = ctx
-	b.cancel = cancel
+	b := &buildlogger{
+		ctx:     ctx,
+		cancel:  cancel,
+		opts:    opts,
+		client:  client,
+		flusher: f,
+		budget:  budget,
+		buffer:  []*gopb.LogLine{},
+		writer:  utility.RandomString(),
+		Base:    send.NewBase(name),
+	}
+	opts.logIDs = &logIDList{}
+
+	return b
+}
 
-	if opts.FlushInterval > 0 {
-		go b.timedFlush()
+func (b *buildlogger) openSpool(dir string) error {
+	s, err := openSpool(dir)
+	if err != nil {
+		return errors.Wrap(err, "opening spool")
 	}
 
-	return b, nil
+	b.spool = s
+	// Batches left behind by a previous sender must be replayed before
+	// any batch created by this one.
+	if last := s.last(); last > b.seq {
+		b.seq = last
+	}
+
+	return nil
 }
 
-// Send sends the given message with a timestamp created when the function is
-// called to the cedar Buildlogger backend. This function buffers the messages
-// until the maximum allowed buffer size is reached, at which point the
-// messages in the buffer are sent to the Buildlogger server via RPC. Send is
+// Send sends the given message to the cedar Buildlogger backend, timestamped
+// with the time carried by the message, if any, or else the time at which the
+// function is called. This function buffers the messages until the maximum
+// allowed buffer size is reached, at which point the messages in the buffer
+// are queued to be sent to the Buildlogger server via RPC by a background
+// flusher. Send never waits on the network; it only
+// blocks when the queue is full and the overflow policy is to block. Send is
 // thread safe.
 func (b *buildlogger) Send(m message.Composer) {
 	if !b.Level().ShouldLog(m) {
 		return
 	}
 
+	// The time is taken before waiting on the lock, so that it reflects
+	// when the message was sent.
+	sent := time.Now()
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	ts := time.Now()
 	if b.closed {
-		b.opts.Local.Send(message.NewErrorMessage(level.Error, errors.New("cannot call Send on a closed Buildlogger Sender")))
+		b.logLocal(level.Error, errors.New("cannot call Send on a closed Buildlogger Sender"))
 		return
 	}
 
-	_, ok := m.(*message.GroupComposer)
-	var lines []string
-	if b.opts.DisableNewLineCheck && !ok {
-		lines = []string{m.String()}
+	var lines []*gopb.LogLine
+	if b.opts.Format.structured() {
+		lines = b.structuredLines(m, sent)
 	} else {
-		lines = strings.Split(m.String(), "\n")
+		lines = b.textLines(m, sent)
+	}
+
+	if b.opts.Suppress.enabled() {
+		lines = b.suppress(lines, sent)
 	}
 
-	for _, line := range lines {
-		if line == "" {
+	b.bufferLines(lines)
+}
+
+// bufferLines adds the log lines to the buffer, sealing it whenever it is
+// full. It must be called with the lock held.
+func (b *buildlogger) bufferLines(lines []*gopb.LogLine) {
+	for _, logLine := range lines {
+		if b.degraded {
+			b.sendDegraded(logLine)
+		}
+		if !b.reserve(len(logLine.Data)) {
+			if b.closed {
+				return
+			}
 			continue
 		}
-		data := strings.TrimRightFunc(line, unicode.IsSpace)
-		if b.opts.Prefix != "" {
-			data = fmt.Sprintf("[%s] %s", b.opts.Prefix, data)
+		b.appendLine(logLine)
+	}
+}
+
+// appendLine adds the line to the buffer, sealing the buffer once it is full.
+// It must be called with the lock held.
+func (b *buildlogger) appendLine(logLine *gopb.LogLine) {
+	b.buffer = append(b.buffer, logLine)
+	b.bufferSize += len(logLine.Data)
+	b.budget.acquire(len(logLine.Data))
+	if b.bufferSize > b.opts.MaxBufferSize {
+		b.seal()
+		b.signal()
+	}
+}
+
+// textLines returns one log line per line of the message's string form. Each
+// message of a group is timestamped separately.
+func (b *buildlogger) textLines(m message.Composer, sent time.Time) []*gopb.LogLine {
+	group, isGroup := m.(*message.GroupComposer)
+	msgs := []message.Composer{m}
+	if isGroup {
+		msgs = group.Messages()
+	}
+
+	var logLines []*gopb.LogLine
+	for _, msg := range msgs {
+		if msg == nil || !msg.Loggable() {
+			continue
 		}
-		logLine := &gopb.LogLine{
-			Priority:  int32(m.Priority()),
-			Timestamp: timestamppb.New(ts),
-			Data:      []byte(data),
+
+		var lines []string
+		if b.opts.DisableNewLineCheck && !isGroup {
+			lines = []string{b.opts.Redact.redact(msg.String())}
+		} else {
+			lines = strings.Split(b.opts.Redact.redact(msg.String()), "\n")
 		}
 
-		b.buffer = append(b.buffer, logLine)
-		b.bufferSize += len(logLine.Data)
-		if b.bufferSize > b.opts.MaxBufferSize {
-			if err := b.flush(b.ctx); err != nil {
-				b.opts.Local.Send(message.NewErrorMessage(level.Error, err))
-				return
+		ts := timestamppb.New(b.lineTime(msg, sent))
+		for _, line := range lines {
+			if line == "" {
+				continue
+			}
+			data := strings.TrimRightFunc(line, unicode.IsSpace)
+			if b.opts.Prefix != "" {
+				data = fmt.Sprintf("[%s] %s", b.opts.Prefix, data)
 			}
+			logLines = append(logLines, &gopb.LogLine{
+				Priority:  int32(m.Priority()),
+				Timestamp: ts,
+				Data:      []byte(data),
+			})
 		}
 	}
+
+	return logLines
 }
 
 // Flush flushes anything messages that may be in the buffer to cedar
-// Buildlogger backend via RPC.
+// Buildlogger backend via RPC, returning once everything sent before the call
+// has been attempted.
 func (b *buildlogger) Flush(ctx context.Context) error {
 	b.mu.Lock()
-	defer b.mu.Unlock()
-
 	if b.closed {
+		b.mu.Unlock()
 		return nil
 	}
+	b.bufferLines(b.suppressionNotices())
+	b.seal()
+	b.mu.Unlock()
 
-	return b.flush(ctx)
+	return b.drain(ctx)
 }
 
 // Close flushes anything that may be left in the underlying buffer and closes
@@ -338,44 +673,175 @@ func (b *buildlogger) Flush(ctx context.Context) error {
 // also closed. Close is thread safe but should only be called once no more
 // calls to Send are needed; after Close has been called any subsequent calls
 // to Send will error. After the first call to Close subsequent calls will
-// no-op.
+// no-op. If any lines cannot be delivered, the log is not closed; when a
+// spool directory is configured, the undelivered lines remain spooled for
+// replay by a future sender. Close waits as long as it takes to deliver the
+// lines and close the log; use CloseWithContext to bound the wait.
 func (b *buildlogger) Close() error {
+	return b.close(b.ctx)
+}
+
+// CloseWithContext is Close with the given exit code, which replaces any exit
+// code set in the options, and bounded by the given context. If the context
+// is done before the sender is closed, the remaining steps are abandoned and
+// a *CloseTimeoutError reporting which steps did not complete is returned.
+func (b *buildlogger) CloseWithContext(ctx context.Context, exitCode int32) error {
 	b.mu.Lock()
-	defer b.mu.Unlock()
+	if !b.closed {
+		b.opts.exitCode = exitCode
+	}
+	b.mu.Unlock()
+
+	// Canceling the sender's context interrupts anything in progress
+	// that does not use the given context, such as a background flush or
+	// the log lines stream.
+	stop := context.AfterFunc(ctx, b.cancel)
+	defer stop()
+
+	return b.close(ctx)
+}
+
+// CloseStage is a step of closing the Buildlogger Sender.
+type CloseStage string
+
+// The CloseStage values reported by CloseTimeoutError.
+const (
+	// CloseStageCreateLog is the last attempt to create the log of a
+	// sender that started in degraded mode.
+	CloseStageCreateLog CloseStage = "create log"
+	// CloseStageFlush is the delivery of the remaining log lines.
+	CloseStageFlush CloseStage = "flush"
+	// CloseStageCloseStream is the closing of the log lines stream.
+	CloseStageCloseStream CloseStage = "close stream"
+	// CloseStageCloseLog is the closing of the log.
+	CloseStageCloseLog CloseStage = "close log"
+)
+
+// CloseTimeoutError is returned by CloseWithContext when the context is done
+// before the sender is closed.
+type CloseTimeoutError struct {
+	// The steps of closing that did not complete before the context was
+	// done, in order.
+	Stages []CloseStage
+	// The errors of the steps of closing.
+	Err error
+}
+
+func (e *CloseTimeoutError) Error() string {
+	stages := make([]string, 0, len(e.Stages))
+	for _, stage := range e.Stages {
+		stages = append(stages, string(stage))
+	}
+
+	return fmt.Sprintf("timed out closing buildlogger sender during %s: %s", strings.Join(stages, ", "), e.Err)
+}
+
+// Unwrap returns the errors of the steps of closing.
+func (e *CloseTimeoutError) Unwrap() error { return e.Err }
+
+func (b *buildlogger) close(ctx context.Context) error {
 	defer b.cancel()
 
+	b.mu.Lock()
 	if b.closed {
+		b.mu.Unlock()
 		return nil
 	}
-	catcher := grip.NewBasicCatcher()
+	b.bufferLines(b.suppressionNotices())
+	b.closed = true
+	b.seal()
+	b.budget.wake()
+	b.mu.Unlock()
 
-	if len(b.buffer) > 0 {
-		if err := b.flush(b.ctx); err != nil {
-			b.opts.Local.Send(message.NewErrorMessage(level.Error, err))
-			catcher.Add(errors.Wrap(err, "flushing buffer"))
+	var timedOut []CloseStage
+	timeout := func(stage CloseStage, err error) {
+		if err != nil && ctx.Err() != nil {
+			timedOut = append(timedOut, stage)
 		}
 	}
 
-	if !catcher.HasErrors() {
+	catcher := grip.NewBasicCatcher()
+
+	if !b.finishCreatingLog(ctx) {
+		timeout(CloseStageCreateLog, errLogNotCreated)
+	}
+
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	if err := b.drainLocked(ctx); err != nil {
+		b.logLocal(level.Error, err)
+		catcher.Add(errors.Wrap(err, "flushing buffer"))
+		timeout(CloseStageFlush, err)
+	}
+	if err := b.ackStream(ctx); err != nil {
+		err = b.handleFailedStream(ctx, err)
+		b.logLocal(level.Error, err)
+		catcher.Add(err)
+		timeout(CloseStageCloseStream, err)
+	}
+	b.flusher.remove(b)
+	b.drained = true
+
+	// Log lines that could not be sent are never sent after the sender is
+	// closed, so they no longer count against the memory budget.
+	b.mu.Lock()
+	b.budget.release(b.queueSize + b.bufferSize)
+	b.mu.Unlock()
+
+	// A log closed by a rollover that could not create the next log must
+	// not be closed again.
+	if !catcher.HasErrors() && !b.logClosed {
 		endInfo := &gopb.LogEndInfo{
-			LogId:    b.opts.logID,
+			LogId:    b.opts.GetLogID(),
 			ExitCode: b.opts.exitCode,
 		}
-		_, err := b.client.CloseLog(b.ctx, endInfo)
-		b.opts.Local.Send(message.NewErrorMessage(level.Error, err))
+		err := b.opts.Retry.do(ctx, func(ctx context.Context) error {
+			_, err := b.client.CloseLog(ctx, endInfo)
+			return b.stats.recordRPC(err)
+		})
+		b.logLocal(level.Error, err)
 		catcher.Add(errors.Wrap(err, "closing log"))
+		timeout(CloseStageCloseLog, err)
 	}
 
 	if b.conn != nil {
 		catcher.Add(b.conn.Close())
 	}
 
-	b.closed = true
+	b.sendStats()
+
+	if len(timedOut) > 0 {
+		return &CloseTimeoutError{Stages: timedOut, Err: catcher.Resolve()}
+	}
 
 	return catcher.Resolve()
 }
 
-func (b *buildlogger) createNewLog() error {
+// logLocal sends the error, with any secrets redacted, to the local sender.
+func (b *buildlogger) logLocal(l level.Priority, err error) {
+	if err == nil {
+		return
+	}
+
+	b.opts.Local.Send(message.NewErrorMessage(l, b.opts.Redact.redactError(err)))
+}
+
+// handleError is the sender's error handler, which forwards errors to the
+// local sender with any secrets redacted.
+func (b *buildlogger) handleError(err error, m message.Composer) {
+	if err == nil {
+		return
+	}
+
+	if b.opts.Redact.enabled() && m != nil {
+		m = message.NewDefaultMessage(m.Priority(), b.opts.Redact.redact(m.String()))
+	}
+	b.opts.Local.Send(message.WrapError(b.opts.Redact.redactError(err), m))
+}
+
+// createLog creates the log with the given chunk number, returning its ID.
+func (b *buildlogger) createLog(ctx context.Context, chunk int) (string, error) {
 	data := &gopb.LogData{
 		Info: &gopb.LogInfo{
 			Project:   b.opts.Project,
@@ -388,57 +854,29 @@ func (b *buildlogger) createNewLog() error {
 			Trial:     b.opts.Trial,
 			ProcName:  b.opts.ProcessName,
 			Format:    gopb.LogFormat(b.opts.Format),
-			Tags:      b.opts.Tags,
+			Tags:      b.logTags(chunk),
 			Arguments: b.opts.Arguments,
 			Mainline:  b.opts.Mainline,
 		},
 		Storage: gopb.LogStorage(b.opts.Storage),
 	}
-	resp, err := b.client.CreateLog(b.ctx, data)
+	var resp *gopb.BuildloggerResponse
+	err := b.opts.Retry.do(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = b.client.CreateLog(ctx, data)
+		return b.stats.recordRPC(err)
+	})
 	if err != nil {
-		b.opts.Local.Send(message.NewErrorMessage(level.Error, err))
-		return errors.Wrap(err, "creating log")
+		b.logLocal(level.Error, err)
+		return "", errors.Wrap(err, "creating log")
 	}
-	b.opts.logID = resp.LogId
 
-	return nil
+	return resp.LogId, nil
 }
 
-func (b *buildlogger) timedFlush() {
-	b.mu.Lock()
-	b.timer = time.NewTimer(b.opts.FlushInterval)
-	b.mu.Unlock()
-	defer b.timer.Stop()
-
-	for {
-		select {
-		case <-b.ctx.Done():
-			return
-		case <-b.timer.C:
-			b.mu.Lock()
-			if len(b.buffer) > 0 && time.Since(b.lastFlush) >= b.opts.FlushInterval {
-				if err := b.flush(b.ctx); err != nil {
-					b.opts.Local.Send(message.NewErrorMessage(level.Error, err))
-				}
-			}
-			_ = b.timer.Reset(b.opts.FlushInterval)
-			b.mu.Unlock()
-		}
-	}
-}
-
-func (b *buildlogger) flush(ctx context.Context) error {
-	_, err := b.client.AppendLogLines(ctx, &gopb.LogLines{
-		LogId: b.opts.logID,
-		Lines: b.buffer,
+func (b *buildlogger) appendLines(ctx context.Context, lines *gopb.LogLines) error {
+	return b.opts.Retry.do(ctx, func(ctx context.Context) error {
+		_, err := b.client.AppendLogLines(ctx, lines)
+		return b.stats.recordRPC(err)
 	})
-	if err != nil {
-		return err
-	}
-
-	b.buffer = []*gopb.LogLine{}
-	b.bufferSize = 0
-	b.lastFlush = time.Now()
-
-	return nil
 }
@@ -3,6 +3,7 @@ package buildlogger
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"strings"
 	"testing"
@@ -18,21 +19,29 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type mockClient struct {
-	createErr  bool
-	appendErr  bool
-	closeErr   bool
-	logData    *gopb.LogData
-	logLines   *gopb.LogLines
-	logEndInfo *gopb.LogEndInfo
+	createErr   bool
+	appendErr   bool
+	streamErr   bool
+	closeErr    bool
+	errCode     codes.Code
+	attempts    int
+	logData     *gopb.LogData
+	logLines    *gopb.LogLines
+	allLogLines []*gopb.LogLines
+	logEndInfo  *gopb.LogEndInfo
+	streams     []*mockStream
 }
 
 func (mc *mockClient) CreateLog(_ context.Context, in *gopb.LogData, _ ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	mc.attempts++
 	if mc.createErr {
-		return nil, errors.New("create error")
+		return nil, mc.err("create error")
 	}
 
 	mc.logData = in
@@ -41,22 +50,32 @@ func (mc *mockClient) CreateLog(_ context.Context, in *gopb.LogData, _ ...grpc.C
 }
 
 func (mc *mockClient) AppendLogLines(_ context.Context, in *gopb.LogLines, _ ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	mc.attempts++
 	if mc.appendErr {
-		return nil, errors.New("append error")
+		return nil, mc.err("append error")
 	}
 
 	mc.logLines = in
+	mc.allLogLines = append(mc.allLogLines, in)
 
 	return &gopb.BuildloggerResponse{LogId: in.LogId}, nil
 }
 
-func (*mockClient) StreamLogLines(_ context.Context, _ ...grpc.CallOption) (gopb.Buildlogger_StreamLogLinesClient, error) {
-	return nil, nil
+func (mc *mockClient) StreamLogLines(_ context.Context, _ ...grpc.CallOption) (gopb.Buildlogger_StreamLogLinesClient, error) {
+	if mc.streamErr {
+		return nil, mc.err("stream error")
+	}
+
+	stream := &mockStream{}
+	mc.streams = append(mc.streams, stream)
+
+	return stream, nil
 }
 
 func (mc *mockClient) CloseLog(_ context.Context, in *gopb.LogEndInfo, _ ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	mc.attempts++
 	if mc.closeErr {
-		return nil, errors.New("close error")
+		return nil, mc.err("close error")
 	}
 
 	mc.logEndInfo = in
@@ -64,6 +83,101 @@ func (mc *mockClient) CloseLog(_ context.Context, in *gopb.LogEndInfo, _ ...grpc
 	return &gopb.BuildloggerResponse{LogId: in.LogId}, nil
 }
 
+func (mc *mockClient) err(msg string) error {
+	if mc.errCode != codes.OK {
+		return status.Error(mc.errCode, msg)
+	}
+
+	return errors.New(msg)
+}
+
+// hangingClient is a mockClient whose RPCs can be made to block until their
+// context is done.
+type hangingClient struct {
+	mockClient
+	hangAppend bool
+	hangClose  bool
+}
+
+func (hc *hangingClient) AppendLogLines(ctx context.Context, in *gopb.LogLines, opts ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	if hc.hangAppend {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	return hc.mockClient.AppendLogLines(ctx, in, opts...)
+}
+
+func (hc *hangingClient) CloseLog(ctx context.Context, in *gopb.LogEndInfo, opts ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	if hc.hangClose {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	return hc.mockClient.CloseLog(ctx, in, opts...)
+}
+
+// slowClient is a thread safe BuildloggerClient whose RPCs succeed after the
+// given latency without recording anything.
+type slowClient struct {
+	mockClient
+	latency time.Duration
+}
+
+func (sc *slowClient) AppendLogLines(ctx context.Context, in *gopb.LogLines, _ ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	if err := sc.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return &gopb.BuildloggerResponse{LogId: in.LogId}, nil
+}
+
+func (sc *slowClient) CloseLog(ctx context.Context, in *gopb.LogEndInfo, _ ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	if err := sc.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return &gopb.BuildloggerResponse{LogId: in.LogId}, nil
+}
+
+func (sc *slowClient) wait(ctx context.Context) error {
+	timer := time.NewTimer(sc.latency)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type mockStream struct {
+	grpc.ClientStream
+	broken   bool
+	closed   bool
+	logLines []*gopb.LogLines
+}
+
+func (ms *mockStream) Send(in *gopb.LogLines) error {
+	if ms.broken {
+		return io.EOF
+	}
+
+	ms.logLines = append(ms.logLines, in)
+
+	return nil
+}
+
+func (ms *mockStream) CloseAndRecv() (*gopb.BuildloggerResponse, error) {
+	ms.closed = true
+	if ms.broken {
+		return nil, status.Error(codes.Unavailable, "stream broken")
+	}
+
+	return &gopb.BuildloggerResponse{}, nil
+}
+
 type mockSender struct {
 	*send.Base
 	lastMessage string
@@ -85,6 +199,8 @@ func TestLoggerOptionsValidate(t *testing.T) {
 		assert.Equal(t, gopb.LogStorage(opts.Storage), gopb.LogStorage_LOG_STORAGE_S3)
 		assert.NotNil(t, opts.Local)
 		assert.Equal(t, defaultMaxBufferSize, opts.MaxBufferSize)
+		assert.Equal(t, defaultQueueSizeFactor*defaultMaxBufferSize, opts.MaxQueueSize)
+		assert.Equal(t, defaultMaxRPCSize, opts.MaxRPCSize)
 		assert.Equal(t, defaultFlushInterval, opts.FlushInterval)
 
 		size := 100
@@ -135,6 +251,29 @@ func TestLoggerOptionsValidate(t *testing.T) {
 		}
 		assert.Error(t, opts.validate())
 	})
+	t.Run("NegativeMaxRPCSize", func(t *testing.T) {
+		opts := &LoggerOptions{
+			ClientConn: &grpc.ClientConn{},
+			MaxRPCSize: -1,
+		}
+		assert.Error(t, opts.validate())
+	})
+	t.Run("InvalidOverflowPolicy", func(t *testing.T) {
+		opts := &LoggerOptions{
+			ClientConn:     &grpc.ClientConn{},
+			OverflowPolicy: "drop_everything",
+		}
+		assert.Error(t, opts.validate())
+	})
+	t.Run("SpillWithoutSpoolDir", func(t *testing.T) {
+		opts := &LoggerOptions{
+			ClientConn:     &grpc.ClientConn{},
+			OverflowPolicy: OverflowSpill,
+		}
+		assert.Error(t, opts.validate())
+		opts.SpoolDir = t.TempDir()
+		assert.NoError(t, opts.validate())
+	})
 	t.Run("ClientConnNilAndNoAddressOrPort", func(t *testing.T) {
 		opts := &LoggerOptions{
 			Insecure: true,
@@ -213,9 +352,9 @@ func TestNewLogger(t *testing.T) {
 		assert.Equal(t, defaultMaxBufferSize, b.opts.MaxBufferSize)
 		assert.Equal(t, defaultFlushInterval, b.opts.FlushInterval)
 		time.Sleep(time.Second)
-		b.mu.Lock()
-		assert.NotNil(t, b.timer)
-		b.mu.Unlock()
+		b.flusher.mu.Lock()
+		assert.NotNil(t, b.flusher.timer)
+		b.flusher.mu.Unlock()
 		srv.Mu.Lock()
 		srv.Create = nil
 		srv.Mu.Unlock()
@@ -278,9 +417,9 @@ func TestNewLogger(t *testing.T) {
 		assert.Equal(t, defaultMaxBufferSize, b.opts.MaxBufferSize)
 		assert.Equal(t, defaultFlushInterval, b.opts.FlushInterval)
 		time.Sleep(time.Second)
-		b.mu.Lock()
-		assert.NotNil(t, b.timer)
-		b.mu.Unlock()
+		b.flusher.mu.Lock()
+		assert.NotNil(t, b.flusher.timer)
+		b.flusher.mu.Unlock()
 		srv.Mu.Lock()
 		srv.Create = nil
 		srv.Mu.Unlock()
@@ -337,9 +476,9 @@ func TestNewLogger(t *testing.T) {
 		assert.Equal(t, defaultMaxBufferSize, b.opts.MaxBufferSize)
 		assert.Equal(t, defaultFlushInterval, b.opts.FlushInterval)
 		time.Sleep(time.Second)
-		b.mu.Lock()
-		assert.NotNil(t, b.timer)
-		b.mu.Unlock()
+		b.flusher.mu.Lock()
+		assert.NotNil(t, b.flusher.timer)
+		b.flusher.mu.Unlock()
 		srv.Mu.Lock()
 		srv.Create = nil
 		srv.Mu.Unlock()
@@ -359,7 +498,9 @@ func TestNewLogger(t *testing.T) {
 		b, ok := s.(*buildlogger)
 		require.True(t, ok)
 		time.Sleep(time.Second)
-		assert.Nil(t, b.timer)
+		b.flusher.mu.Lock()
+		assert.Nil(t, b.flusher.timer)
+		b.flusher.mu.Unlock()
 	})
 	t.Run("InvalidOptions", func(t *testing.T) {
 		s, err := NewLoggerWithContext(ctx, "test3", send.LevelInfo{}, &LoggerOptions{})
@@ -414,7 +555,7 @@ func TestSend(t *testing.T) {
 		mc := &mockClient{}
 		ms := &mockSender{Base: send.NewBase("test")}
 		b := createSender(ctx, mc, ms)
-		b.opts.logID = "id"
+		b.opts.logIDs.add("id")
 		b.opts.MaxBufferSize = 4096
 		size := 256
 		messages := []string{}
@@ -446,8 +587,14 @@ func TestSend(t *testing.T) {
 		b.Send(m)
 		require.Empty(t, b.buffer)
 		assert.Equal(t, 0, b.bufferSize)
+		require.Len(t, b.queue, 1)
+		assert.Len(t, b.queue[0].lines, len(messages))
+		assert.Nil(t, mc.logLines)
+		require.NoError(t, b.Flush(ctx))
+		assert.Empty(t, b.queue)
+		assert.Zero(t, b.queueSize)
 		require.NotNil(t, mc.logLines)
-		assert.Equal(t, b.opts.logID, mc.logLines.LogId)
+		assert.Equal(t, b.opts.GetLogID(), mc.logLines.LogId)
 		assert.Len(t, mc.logLines.Lines, len(messages))
 		for i := range mc.logLines.Lines {
 			assert.EqualValues(t, messages[i], mc.logLines.Lines[i].Data)
@@ -458,7 +605,7 @@ func TestSend(t *testing.T) {
 		mc := &mockClient{}
 		ms := &mockSender{Base: send.NewBase("test")}
 		b := createSender(ctx, mc, ms)
-		b.opts.logID = "id"
+		b.opts.logIDs.add("id")
 		b.opts.MaxBufferSize = 4096
 		b.opts.DisableNewLineCheck = true
 		size := 256
@@ -485,8 +632,11 @@ func TestSend(t *testing.T) {
 		b.Send(m)
 		require.Empty(t, b.buffer)
 		assert.Equal(t, 0, b.bufferSize)
+		require.Len(t, b.queue, 1)
+		assert.Nil(t, mc.logLines)
+		require.NoError(t, b.Flush(ctx))
 		require.NotEmpty(t, mc.logLines)
-		assert.Equal(t, b.opts.logID, mc.logLines.LogId)
+		assert.Equal(t, b.opts.GetLogID(), mc.logLines.LogId)
 		assert.Len(t, mc.logLines.Lines, len(messages))
 		for i := range mc.logLines.Lines {
 			assert.EqualValues(t, messages[i].String(), mc.logLines.Lines[i].Data)
@@ -497,7 +647,7 @@ func TestSend(t *testing.T) {
 		mc := &mockClient{}
 		ms := &mockSender{Base: send.NewBase("test")}
 		b := createSender(ctx, mc, ms)
-		b.opts.logID = "id"
+		b.opts.logIDs.add("id")
 		b.opts.MaxBufferSize = 4096
 		b.opts.FlushInterval = time.Second
 		b.opts.DisableNewLineCheck = true
@@ -507,7 +657,7 @@ func TestSend(t *testing.T) {
 		m := message.ConvertToComposer(level.Debug, utility.MakeRandomString(size/2))
 		b.Send(m)
 		require.NotEmpty(t, b.buffer)
-		go b.timedFlush()
+		go b.flushLoop()
 		time.Sleep(2 * time.Second)
 		b.mu.Lock()
 		require.Empty(t, b.buffer)
@@ -582,15 +732,18 @@ func TestSend(t *testing.T) {
 
 		m := message.ConvertToComposer(level.Debug, str)
 		b.Send(m)
-		assert.Len(t, b.buffer, 1)
-		assert.Equal(t, len(m.String()), b.bufferSize)
-		assert.Equal(t, "append error", ms.lastMessage)
+		assert.Empty(t, b.buffer)
+		require.Len(t, b.queue, 1)
+		assert.EqualError(t, b.Flush(ctx), "append error")
+		require.Len(t, b.queue, 1)
+		assert.Len(t, b.queue[0].lines, 1)
+		assert.Equal(t, len(m.String()), b.queueSize)
 	})
 	t.Run("ClosedSender", func(t *testing.T) {
 		mc := &mockClient{}
 		ms := &mockSender{Base: send.NewBase("test")}
 		b := createSender(ctx, mc, ms)
-		b.opts.logID = "id"
+		b.opts.logIDs.add("id")
 		b.opts.MaxBufferSize = 4096
 		b.closed = true
 
@@ -602,6 +755,266 @@ func TestSend(t *testing.T) {
 	})
 }
 
+func TestStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("SendsOverOneStream", func(t *testing.T) {
+		mc := &mockClient{}
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, mc, ms)
+		b.opts.logIDs.add("id")
+		b.opts.MaxBufferSize = 4096
+		b.opts.Stream = true
+
+		b.Send(message.ConvertToComposer(level.Info, "first"))
+		require.NoError(t, b.Flush(ctx))
+		b.Send(message.ConvertToComposer(level.Info, "second"))
+		require.NoError(t, b.Flush(ctx))
+		assert.Nil(t, mc.logLines)
+		require.Len(t, mc.streams, 1)
+		require.Len(t, mc.streams[0].logLines, 2)
+		assert.Equal(t, "id", mc.streams[0].logLines[0].LogId)
+		assert.EqualValues(t, "first", mc.streams[0].logLines[0].Lines[0].Data)
+		assert.EqualValues(t, "second", mc.streams[0].logLines[1].Lines[0].Data)
+		// Nothing is acknowledged until the stream is closed.
+		assert.Zero(t, b.Stats().LinesSent)
+
+		require.NoError(t, b.Close())
+		assert.True(t, mc.streams[0].closed)
+		assert.Equal(t, 2, b.Stats().LinesSent)
+		assert.Nil(t, b.stream)
+		require.NotNil(t, mc.logEndInfo)
+	})
+	t.Run("ReopensBrokenStream", func(t *testing.T) {
+		mc := &mockClient{}
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, mc, ms)
+		b.opts.logIDs.add("id")
+		b.opts.MaxBufferSize = 4096
+		b.opts.Stream = true
+
+		b.Send(message.ConvertToComposer(level.Info, "first"))
+		require.NoError(t, b.Flush(ctx))
+		require.Len(t, mc.streams, 1)
+		mc.streams[0].broken = true
+
+		b.Send(message.ConvertToComposer(level.Info, "second"))
+		require.NoError(t, b.Flush(ctx))
+		require.Len(t, mc.streams, 2)
+		assert.True(t, mc.streams[0].closed)
+		// The line sent over the broken stream was never acknowledged,
+		// so it is resent.
+		require.Len(t, mc.streams[1].logLines, 2)
+		assert.EqualValues(t, "first", mc.streams[1].logLines[0].Lines[0].Data)
+		assert.EqualValues(t, "second", mc.streams[1].logLines[1].Lines[0].Data)
+
+		require.NoError(t, b.Close())
+		assert.Equal(t, 2, b.Stats().LinesSent)
+	})
+	t.Run("ResendsWhenBrokenBeforeClose", func(t *testing.T) {
+		mc := &mockClient{}
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, mc, ms)
+		b.opts.logIDs.add("id")
+		b.opts.MaxBufferSize = 4096
+		b.opts.Stream = true
+		b.opts.Retry = RetryOptions{MaxAttempts: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		require.NoError(t, b.opts.Retry.validate())
+
+		b.Send(message.ConvertToComposer(level.Info, "first"))
+		require.NoError(t, b.Flush(ctx))
+		b.Send(message.ConvertToComposer(level.Info, "second"))
+		require.NoError(t, b.Flush(ctx))
+		// Both lines were sent successfully, but the stream breaks
+		// before the server acknowledges them.
+		mc.streams[0].broken = true
+
+		require.NoError(t, b.Close())
+		require.Len(t, mc.streams, 2)
+		require.Len(t, mc.streams[1].logLines, 2)
+		assert.EqualValues(t, "first", mc.streams[1].logLines[0].Lines[0].Data)
+		assert.EqualValues(t, "second", mc.streams[1].logLines[1].Lines[0].Data)
+		assert.True(t, mc.streams[1].closed)
+		require.NotNil(t, mc.logEndInfo)
+		stats := b.Stats()
+		assert.Equal(t, 2, stats.LinesSent)
+		assert.Zero(t, stats.LinesDropped)
+	})
+	t.Run("SpoolsUnacknowledgedLines", func(t *testing.T) {
+		dir := t.TempDir()
+		mc := &mockClient{}
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, mc, ms)
+		b.opts.logIDs.add("id")
+		b.opts.MaxBufferSize = 4096
+		b.opts.Stream = true
+		require.NoError(t, b.openSpool(dir))
+
+		b.Send(message.ConvertToComposer(level.Info, "first"))
+		require.NoError(t, b.Flush(ctx))
+		b.Send(message.ConvertToComposer(level.Info, "second"))
+		require.NoError(t, b.Flush(ctx))
+		mc.streams[0].broken = true
+		mc.streamErr = true
+
+		assert.Error(t, b.Close())
+		assert.Nil(t, mc.logEndInfo)
+		assert.Equal(t, 2, b.spool.len())
+		assert.Zero(t, b.Stats().LinesSent)
+
+		mc = &mockClient{}
+		b = createSender(ctx, mc, ms)
+		b.opts.logIDs.add("id")
+		b.opts.Stream = true
+		require.NoError(t, b.openSpool(dir))
+		require.NoError(t, b.Close())
+		var lines []string
+		for _, stream := range mc.streams {
+			assert.True(t, stream.closed)
+			for _, logLines := range stream.logLines {
+				for _, line := range logLines.Lines {
+					lines = append(lines, string(line.Data))
+				}
+			}
+		}
+		assert.Equal(t, []string{"first", "second"}, lines)
+		assert.Zero(t, b.spool.len())
+	})
+	t.Run("RemovesSpooledLinesOnceAcknowledged", func(t *testing.T) {
+		mc := &mockClient{}
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, mc, ms)
+		b.opts.logIDs.add("id")
+		b.opts.MaxBufferSize = 4096
+		b.opts.Stream = true
+		require.NoError(t, b.openSpool(t.TempDir()))
+
+		b.Send(message.ConvertToComposer(level.Info, "first"))
+		require.NoError(t, b.Flush(ctx))
+		assert.Equal(t, 1, b.spool.len())
+		b.Send(message.ConvertToComposer(level.Info, "second"))
+		require.NoError(t, b.Flush(ctx))
+		assert.Equal(t, 2, b.spool.len())
+		// Spooled lines that were streamed are not resent.
+		require.Len(t, mc.streams, 1)
+		assert.Len(t, mc.streams[0].logLines, 2)
+
+		require.NoError(t, b.Close())
+		assert.Zero(t, b.spool.len())
+		assert.Len(t, mc.streams[0].logLines, 2)
+		assert.Equal(t, 2, b.Stats().LinesSent)
+	})
+	t.Run("RequeuesUnacknowledgedLinesWhenDropping", func(t *testing.T) {
+		mc := &mockClient{}
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, mc, ms)
+		b.opts.logIDs.add("id")
+		b.opts.MaxBufferSize = 4096
+		b.opts.Stream = true
+		b.opts.Retry = RetryOptions{MaxAttempts: 1}
+		require.NoError(t, b.opts.Retry.validate())
+
+		b.Send(message.ConvertToComposer(level.Info, "first"))
+		require.NoError(t, b.Flush(ctx))
+		mc.streams[0].broken = true
+		mc.streamErr = true
+		b.Send(message.ConvertToComposer(level.Info, "second"))
+
+		// The batch that could not be sent is dropped, while the
+		// unacknowledged line sent before it is put back in the queue.
+		assert.Error(t, b.Flush(ctx))
+		stats := b.Stats()
+		assert.Zero(t, stats.LinesSent)
+		assert.Equal(t, 1, stats.LinesDropped)
+		require.Len(t, b.queue, 1)
+		assert.EqualValues(t, "first", b.queue[0].lines[0].Data)
+	})
+	t.Run("AcknowledgesOnceMaxQueueSizeIsReached", func(t *testing.T) {
+		mc := &mockClient{}
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, mc, ms)
+		b.opts.logIDs.add("id")
+		b.opts.MaxBufferSize = 4096
+		b.opts.MaxQueueSize = 10
+		b.opts.Stream = true
+
+		b.Send(message.ConvertToComposer(level.Info, "first"))
+		require.NoError(t, b.Flush(ctx))
+		require.Len(t, mc.streams, 1)
+		assert.False(t, mc.streams[0].closed)
+		b.Send(message.ConvertToComposer(level.Info, "second"))
+		require.NoError(t, b.Flush(ctx))
+		assert.True(t, mc.streams[0].closed)
+		assert.Equal(t, 2, b.Stats().LinesSent)
+
+		b.Send(message.ConvertToComposer(level.Info, "third"))
+		require.NoError(t, b.Flush(ctx))
+		require.Len(t, mc.streams, 2)
+		require.NoError(t, b.Close())
+		assert.Equal(t, 3, b.Stats().LinesSent)
+	})
+	t.Run("OpenError", func(t *testing.T) {
+		mc := &mockClient{streamErr: true}
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, mc, ms)
+		b.opts.logIDs.add("id")
+		b.opts.MaxBufferSize = 4096
+		b.opts.Stream = true
+
+		b.Send(message.ConvertToComposer(level.Info, "first"))
+		assert.Error(t, b.Flush(ctx))
+		assert.Len(t, b.queue, 1)
+		assert.Nil(t, b.stream)
+	})
+	t.Run("CloseStreamError", func(t *testing.T) {
+		mc := &mockClient{}
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, mc, ms)
+		b.opts.logIDs.add("id")
+		b.opts.MaxBufferSize = 4096
+		b.opts.Stream = true
+
+		b.Send(message.ConvertToComposer(level.Info, "first"))
+		require.NoError(t, b.Flush(ctx))
+		mc.streams[0].broken = true
+		assert.Error(t, b.Close())
+		assert.Nil(t, mc.logEndInfo)
+	})
+	t.Run("MockServer", func(t *testing.T) {
+		srv, err := testutil.NewMockBuildloggerServer(ctx, 4500)
+		require.NoError(t, err)
+		conn, err := grpc.DialContext(ctx, srv.Address(), grpc.WithInsecure())
+		require.NoError(t, err)
+
+		opts := &LoggerOptions{
+			ClientConn:    conn,
+			Local:         &mockSender{Base: send.NewBase("test")},
+			Stream:        true,
+			FlushInterval: -1,
+		}
+		s, err := MakeLoggerWithContext(ctx, "test", opts)
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			s.Send(message.ConvertToComposer(level.Info, fmt.Sprintf("line %d", i)))
+			require.NoError(t, s.Flush(ctx))
+		}
+		require.NoError(t, s.Close())
+
+		srv.Mu.Lock()
+		defer srv.Mu.Unlock()
+		assert.Empty(t, srv.Data)
+		assert.Empty(t, srv.Duplicates)
+		assert.Empty(t, srv.Gaps)
+		require.Len(t, srv.StreamData[opts.GetLogID()], 3)
+		for i, lines := range srv.StreamData[opts.GetLogID()] {
+			require.Len(t, lines.Lines, 1)
+			assert.EqualValues(t, fmt.Sprintf("line %d", i), lines.Lines[0].Data)
+		}
+		assert.NotNil(t, srv.Close)
+	})
+}
+
 func TestFlush(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -610,7 +1023,7 @@ func TestFlush(t *testing.T) {
 		mc := &mockClient{}
 		ms := &mockSender{Base: send.NewBase("test")}
 		b := createSender(ctx, mc, ms)
-		b.opts.logID = "id"
+		b.opts.logIDs.add("id")
 		b.opts.MaxBufferSize = 4096
 
 		m := message.ConvertToComposer(level.Info, "overflow")
@@ -627,7 +1040,7 @@ func TestFlush(t *testing.T) {
 		mc := &mockClient{}
 		ms := &mockSender{Base: send.NewBase("test")}
 		b := createSender(ctx, mc, ms)
-		b.opts.logID = "id"
+		b.opts.logIDs.add("id")
 		b.opts.MaxBufferSize = 4096
 
 		m := message.ConvertToComposer(level.Info, "overflow")
@@ -639,6 +1052,161 @@ func TestFlush(t *testing.T) {
 		assert.NotZero(t, b.bufferSize)
 		assert.Nil(t, mc.logLines)
 	})
+	t.Run("SpoolsOnRPCError", func(t *testing.T) {
+		mc := &mockClient{appendErr: true}
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, mc, ms)
+		b.opts.logIDs.add("id")
+		b.opts.MaxBufferSize = 4096
+		require.NoError(t, b.openSpool(t.TempDir()))
+
+		b.Send(message.ConvertToComposer(level.Info, "first"))
+		assert.Error(t, b.Flush(ctx))
+		assert.Empty(t, b.buffer)
+		assert.Zero(t, b.bufferSize)
+		assert.Equal(t, 1, b.spool.len())
+
+		b.Send(message.ConvertToComposer(level.Info, "second"))
+		assert.Error(t, b.Flush(ctx))
+		assert.Empty(t, b.buffer)
+		assert.Equal(t, 2, b.spool.len())
+
+		mc.appendErr = false
+		b.Send(message.ConvertToComposer(level.Info, "third"))
+		require.NoError(t, b.Flush(ctx))
+		assert.Empty(t, b.buffer)
+		assert.Zero(t, b.spool.len())
+		require.Len(t, mc.allLogLines, 3)
+		for i, data := range []string{"first", "second", "third"} {
+			assert.Equal(t, b.opts.GetLogID(), mc.allLogLines[i].LogId)
+			require.Len(t, mc.allLogLines[i].Lines, 1)
+			assert.EqualValues(t, data, mc.allLogLines[i].Lines[0].Data)
+		}
+	})
+	t.Run("WritesAheadToSpool", func(t *testing.T) {
+		dir := t.TempDir()
+		mc := &mockClient{}
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, mc, ms)
+		b.opts.logIDs.add("id")
+		b.opts.MaxBufferSize = 4096
+		require.NoError(t, b.openSpool(dir))
+
+		b.Send(message.ConvertToComposer(level.Info, "first"))
+		b.mu.Lock()
+		b.seal()
+		b.mu.Unlock()
+		assert.Equal(t, 1, b.spool.len())
+		require.NoError(t, b.Flush(ctx))
+		assert.Zero(t, b.spool.len())
+
+		// The lines of a sender that exits without flushing are
+		// replayed by the next sender.
+		b.Send(message.ConvertToComposer(level.Info, "second"))
+		b.mu.Lock()
+		b.seal()
+		b.mu.Unlock()
+		b.cancel()
+
+		replayed := &mockClient{}
+		b = createSender(ctx, replayed, ms)
+		b.opts.logIDs.add("id")
+		require.NoError(t, b.openSpool(dir))
+		require.NoError(t, b.Flush(ctx))
+		assert.Zero(t, b.spool.len())
+		require.Len(t, replayed.allLogLines, 1)
+		assert.EqualValues(t, "second", replayed.allLogLines[0].Lines[0].Data)
+	})
+	t.Run("ReplaysSpoolFromPreviousSender", func(t *testing.T) {
+		dir := t.TempDir()
+		mc := &mockClient{appendErr: true}
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, mc, ms)
+		b.opts.logIDs.add("old")
+		b.opts.MaxBufferSize = 4096
+		require.NoError(t, b.openSpool(dir))
+		b.Send(message.ConvertToComposer(level.Info, "old line"))
+		assert.Error(t, b.Close())
+		assert.Nil(t, mc.logEndInfo)
+
+		mc = &mockClient{}
+		b = createSender(ctx, mc, ms)
+		b.opts.logIDs.add("new")
+		require.NoError(t, b.openSpool(dir))
+		require.NoError(t, b.Close())
+		require.Len(t, mc.allLogLines, 1)
+		assert.Equal(t, "old", mc.allLogLines[0].LogId)
+		assert.EqualValues(t, "old line", mc.allLogLines[0].Lines[0].Data)
+		require.NotNil(t, mc.logEndInfo)
+		assert.Equal(t, "new", mc.logEndInfo.LogId)
+	})
+	t.Run("RetriesThenDrops", func(t *testing.T) {
+		mc := &mockClient{appendErr: true, errCode: codes.Unavailable}
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, mc, ms)
+		b.opts.logIDs.add("id")
+		b.opts.MaxBufferSize = 4096
+		b.opts.Retry = RetryOptions{MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		require.NoError(t, b.opts.Retry.validate())
+
+		b.Send(message.ConvertToComposer(level.Info, "dropped"))
+		err := b.Flush(ctx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "dropped 1 log lines")
+		assert.Equal(t, 3, mc.attempts)
+		assert.Empty(t, b.buffer)
+		assert.Zero(t, b.bufferSize)
+		assert.Equal(t, droppedLines{lines: 1, bytes: len("dropped"), batches: 1}, b.dropped)
+
+		mc.appendErr = false
+		mc.attempts = 0
+		b.Send(message.ConvertToComposer(level.Info, "sent"))
+		require.NoError(t, b.Flush(ctx))
+		assert.Equal(t, 1, mc.attempts)
+		require.Len(t, mc.logLines.Lines, 1)
+		assert.EqualValues(t, "sent", mc.logLines.Lines[0].Data)
+		assert.Equal(t, 1, b.dropped.lines)
+	})
+	t.Run("KeepsBatchWhenFlushTimesOut", func(t *testing.T) {
+		sc := &slowClient{latency: 200 * time.Millisecond}
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, sc, ms)
+		b.opts.logIDs.add("id")
+		b.opts.MaxBufferSize = 4096
+		b.opts.Retry = RetryOptions{MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		require.NoError(t, b.opts.Retry.validate())
+
+		b.Send(message.ConvertToComposer(level.Info, "kept"))
+		tctx, tcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer tcancel()
+		err := b.Flush(tctx)
+		require.Error(t, err)
+		assert.NotContains(t, err.Error(), "dropped")
+		assert.Zero(t, b.Stats().LinesDropped)
+		require.Len(t, b.queue, 1)
+
+		// The next flush resends the line.
+		sc.latency = 0
+		require.NoError(t, b.Flush(ctx))
+		assert.Empty(t, b.queue)
+		assert.Equal(t, 1, b.Stats().LinesSent)
+	})
+	t.Run("RetriesThenSpools", func(t *testing.T) {
+		mc := &mockClient{appendErr: true, errCode: codes.Unavailable}
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, mc, ms)
+		b.opts.logIDs.add("id")
+		b.opts.MaxBufferSize = 4096
+		b.opts.Retry = RetryOptions{MaxAttempts: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		require.NoError(t, b.opts.Retry.validate())
+		require.NoError(t, b.openSpool(t.TempDir()))
+
+		b.Send(message.ConvertToComposer(level.Info, "spooled"))
+		require.Error(t, b.Flush(ctx))
+		assert.Equal(t, 2, mc.attempts)
+		assert.Equal(t, 1, b.spool.len())
+		assert.Zero(t, b.dropped.lines)
+	})
 }
 
 func TestClose(t *testing.T) {
@@ -663,11 +1231,11 @@ func TestClose(t *testing.T) {
 		mc := &mockClient{}
 		ms := &mockSender{Base: send.NewBase("test")}
 		b := createSender(subCtx, mc, ms)
-		b.opts.logID = "id"
+		b.opts.logIDs.add("id")
 		b.opts.SetExitCode(10)
 
 		require.NoError(t, b.Close())
-		assert.Equal(t, b.opts.logID, mc.logEndInfo.LogId)
+		assert.Equal(t, b.opts.GetLogID(), mc.logEndInfo.LogId)
 		assert.Equal(t, b.opts.exitCode, mc.logEndInfo.ExitCode)
 		assert.True(t, b.closed)
 		assert.Equal(t, context.Canceled, b.ctx.Err())
@@ -678,17 +1246,17 @@ func TestClose(t *testing.T) {
 		mc := &mockClient{}
 		ms := &mockSender{Base: send.NewBase("test")}
 		b := createSender(subCtx, mc, ms)
-		b.opts.logID = "id"
+		b.opts.logIDs.add("id")
 		b.opts.SetExitCode(2)
 		logLine := &gopb.LogLine{Timestamp: &timestamppb.Timestamp{}, Data: []byte("some data")}
 		b.buffer = append(b.buffer, logLine)
 
 		require.NoError(t, b.Close())
 		assert.NotNil(t, mc.logEndInfo)
-		assert.Equal(t, b.opts.logID, mc.logEndInfo.LogId)
+		assert.Equal(t, b.opts.GetLogID(), mc.logEndInfo.LogId)
 		assert.Equal(t, b.opts.exitCode, mc.logEndInfo.ExitCode)
 		assert.NotNil(t, mc.logLines)
-		assert.Equal(t, b.opts.logID, mc.logLines.LogId)
+		assert.Equal(t, b.opts.GetLogID(), mc.logLines.LogId)
 		assert.Equal(t, logLine, mc.logLines.Lines[0])
 		assert.True(t, b.closed)
 		assert.Equal(t, context.Canceled, b.ctx.Err())
@@ -726,33 +1294,204 @@ func TestClose(t *testing.T) {
 		assert.True(t, b.closed)
 		assert.Equal(t, context.Canceled, b.ctx.Err())
 	})
+	t.Run("RetriesCloseLog", func(t *testing.T) {
+		subCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		mc := &mockClient{closeErr: true, errCode: codes.Unavailable}
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(subCtx, mc, ms)
+		b.opts.Retry = RetryOptions{MaxAttempts: 4, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		require.NoError(t, b.opts.Retry.validate())
+
+		assert.Error(t, b.Close())
+		assert.Equal(t, 4, mc.attempts)
+	})
+}
+
+func TestCloseWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newLine := func() *gopb.LogLine {
+		return &gopb.LogLine{Timestamp: &timestamppb.Timestamp{}, Data: []byte("some data")}
+	}
+
+	t.Run("ExitCode", func(t *testing.T) {
+		mc := &mockClient{}
+		b := createSender(ctx, mc, &mockSender{Base: send.NewBase("test")})
+		b.opts.logIDs.add("id")
+		b.opts.SetExitCode(1)
+		b.buffer = append(b.buffer, newLine())
+
+		require.NoError(t, b.CloseWithContext(ctx, 3))
+		require.NotNil(t, mc.logEndInfo)
+		assert.Equal(t, "id", mc.logEndInfo.LogId)
+		assert.EqualValues(t, 3, mc.logEndInfo.ExitCode)
+		assert.Len(t, mc.allLogLines, 1)
+		assert.True(t, b.closed)
+	})
+	t.Run("FlushTimesOut", func(t *testing.T) {
+		mc := &hangingClient{hangAppend: true}
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, mc, ms)
+		b.opts.logIDs.add("id")
+		b.buffer = append(b.buffer, newLine())
+
+		closeCtx, closeCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer closeCancel()
+		err := b.CloseWithContext(closeCtx, 0)
+		require.Error(t, err)
+		var timeoutErr *CloseTimeoutError
+		require.True(t, errors.As(err, &timeoutErr))
+		assert.Equal(t, []CloseStage{CloseStageFlush}, timeoutErr.Stages)
+		assert.Contains(t, err.Error(), "flush")
+		assert.Nil(t, mc.logEndInfo)
+		assert.True(t, b.closed)
+	})
+	t.Run("CloseLogTimesOut", func(t *testing.T) {
+		mc := &hangingClient{hangClose: true}
+		b := createSender(ctx, mc, &mockSender{Base: send.NewBase("test")})
+		b.opts.logIDs.add("id")
+		b.buffer = append(b.buffer, newLine())
+
+		closeCtx, closeCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer closeCancel()
+		err := b.CloseWithContext(closeCtx, 0)
+		var timeoutErr *CloseTimeoutError
+		require.True(t, errors.As(err, &timeoutErr))
+		assert.Equal(t, []CloseStage{CloseStageCloseLog}, timeoutErr.Stages)
+		assert.Len(t, mc.allLogLines, 1)
+	})
+	t.Run("InterruptsBackgroundFlush", func(t *testing.T) {
+		mc := &hangingClient{hangAppend: true}
+		b := createSender(ctx, mc, &mockSender{Base: send.NewBase("test")})
+		b.opts.logIDs.add("id")
+		b.buffer = append(b.buffer, newLine())
+		flushed := make(chan error, 1)
+		// Background flushes use the context of the sender.
+		b.seal()
+		go func() { flushed <- b.drain(b.ctx) }()
+		time.Sleep(10 * time.Millisecond)
+
+		closeCtx, closeCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer closeCancel()
+		start := time.Now()
+		assert.Error(t, b.CloseWithContext(closeCtx, 0))
+		assert.Less(t, time.Since(start), time.Second)
+		assert.Error(t, <-flushed)
+	})
+	t.Run("NoopWhenClosed", func(t *testing.T) {
+		mc := &mockClient{}
+		b := createSender(ctx, mc, &mockSender{Base: send.NewBase("test")})
+		require.NoError(t, b.Close())
+		mc.logEndInfo = nil
+
+		assert.NoError(t, b.CloseWithContext(ctx, 3))
+		assert.Nil(t, mc.logEndInfo)
+		assert.Zero(t, b.opts.exitCode)
+	})
+	t.Run("Sender", func(t *testing.T) {
+		dir := t.TempDir()
+		opts := &LoggerOptions{TaskID: "task", LocalDir: dir}
+		s, err := MakeLoggerWithContext(ctx, "test", opts)
+		require.NoError(t, err)
+		sender, ok := s.(Sender)
+		require.True(t, ok)
+		require.NoError(t, sender.CloseWithContext(ctx, 5))
+
+		meta, err := GetMeta(ctx, GetOptions{LocalDir: dir, ID: opts.GetLogID()})
+		require.NoError(t, err)
+		require.Len(t, meta, 1)
+		assert.True(t, meta[0].Completed())
+		assert.EqualValues(t, 5, meta[0].ExitCode)
+	})
+}
+
+func TestCloseTimeoutError(t *testing.T) {
+	err := &CloseTimeoutError{
+		Stages: []CloseStage{CloseStageFlush, CloseStageCloseLog},
+		Err:    context.DeadlineExceeded,
+	}
+	assert.Equal(t, "timed out closing buildlogger sender during flush, close log: context deadline exceeded", err.Error())
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+// BenchmarkSend measures the latency of Send while the sender's background
+// flusher delivers log lines over RPCs of increasing latency. Since RPCs are
+// never made with the send lock held, Send latency should not grow with the
+// RPC latency, with one or many goroutines sending. The queue drops the oldest
+// log lines when full so that Send never waits for the network to make room.
+func BenchmarkSend(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, latency := range []time.Duration{0, time.Millisecond, 10 * time.Millisecond} {
+		msg := message.ConvertToComposer(level.Info, strings.Repeat("a", 100))
+		// The queue holds every line of the run, so that Send never
+		// blocks on, or drops lines because of, a slow client and the
+		// benchmark measures the default overflow policy.
+		newBenchSender := func(b *testing.B) *buildlogger {
+			sender := createSender(ctx, &slowClient{latency: latency}, &mockSender{Base: send.NewBase("test")})
+			sender.opts.MaxBufferSize = 4096
+			sender.opts.MaxQueueSize = sender.opts.MaxBufferSize + b.N*len(msg.String())
+			sender.budget = newMemoryBudget(sender.opts.MaxQueueSize)
+			require.NoError(b, sender.SetLevel(send.LevelInfo{Default: level.Info, Threshold: level.Debug}))
+			go sender.flushLoop()
+			return sender
+		}
+		closeBenchSender := func(b *testing.B, sender *buildlogger) {
+			require.NoError(b, sender.Close())
+			require.Zero(b, sender.Stats().LinesDropped)
+		}
+
+		b.Run(fmt.Sprintf("RPCLatency=%s", latency), func(b *testing.B) {
+			b.Run("Serial", func(b *testing.B) {
+				sender := newBenchSender(b)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					sender.Send(msg)
+				}
+				b.StopTimer()
+				closeBenchSender(b, sender)
+			})
+			b.Run("Parallel", func(b *testing.B) {
+				sender := newBenchSender(b)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						sender.Send(msg)
+					}
+				})
+				b.StopTimer()
+				closeBenchSender(b, sender)
+			})
+		})
+	}
 }
 
 func createSender(ctx context.Context, mc gopb.BuildloggerClient, ms send.Sender) *buildlogger {
-	ctx, cancel := context.WithCancel(ctx)
-	return &buildlogger{
-		ctx:    ctx,
-		cancel: cancel,
-		opts: &LoggerOptions{
-			Project:     "project",
-			Version:     "version",
-			Variant:     "variant",
-			TaskName:    "task_name",
-			TaskID:      "task_id",
-			Execution:   1,
-			TestName:    "test_name",
-			Trial:       2,
-			ProcessName: "proc_name",
-			Tags:        []string{"tag1", "tag2", "tag3"},
-			Arguments:   map[string]string{"tag1": "val", "tag2": "val2"},
-			Mainline:    true,
-			Local:       ms,
-			Format:      LogFormat(gopb.LogFormat_LOG_FORMAT_TEXT),
-		},
-		client: mc,
-		buffer: []*gopb.LogLine{},
-		Base:   send.NewBase("test"),
+	opts := &LoggerOptions{
+		Project:      "project",
+		Version:      "version",
+		Variant:      "variant",
+		TaskName:     "task_name",
+		TaskID:       "task_id",
+		Execution:    1,
+		TestName:     "test_name",
+		Trial:        2,
+		ProcessName:  "proc_name",
+		Tags:         []string{"tag1", "tag2", "tag3"},
+		Arguments:    map[string]string{"tag1": "val", "tag2": "val2"},
+		Mainline:     true,
+		Local:        ms,
+		Format:       LogFormat(gopb.LogFormat_LOG_FORMAT_TEXT),
+		MaxQueueSize: 1 << 20,
 	}
+
+	b := newBuildlogger(ctx, "test", opts, mc, newFlusher(opts), newMemoryBudget(opts.MaxQueueSize))
+	b.flusher.add(b)
+
+	return b
 }
 
 func startRPCService(ctx context.Context, service gopb.BuildloggerServer, port int) error {
@@ -0,0 +1,155 @@
+package buildlogger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// errLogNotCreated is returned when flushing a sender whose log has not been
+// created yet because it started in degraded mode.
+var errLogNotCreated = errors.New("log has not been created yet, log lines are held until it is")
+
+// startLog creates the log. If the log cannot be created and the options allow
+// a degraded start, the sender starts without a log instead: log lines are
+// written to the local sender and held, in the spool if there is one, while
+// the log is created in the background, after which they are backfilled.
+func (b *buildlogger) startLog() error {
+	id, err := b.createLog(b.ctx, 0)
+	if err == nil {
+		b.mu.Lock()
+		b.setLog(id)
+		b.mu.Unlock()
+		return nil
+	}
+	if !b.opts.DegradedStart {
+		return err
+	}
+
+	b.logLocal(level.Warning, errors.Wrap(err, "starting in degraded mode, log lines are written locally until the log can be created"))
+	b.degraded = true
+	b.creating = make(chan struct{})
+	ctx, cancel := context.WithCancel(b.ctx)
+	b.stopCreating = cancel
+	go b.createLogLoop(ctx)
+
+	return nil
+}
+
+// createLogLoop keeps trying to create the log, with backoff, until it
+// succeeds or the context is done.
+func (b *buildlogger) createLogLoop(ctx context.Context) {
+	defer close(b.creating)
+
+	for failures := 1; ; failures++ {
+		timer := time.NewTimer(b.opts.Retry.backoff(failures))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if b.tryCreateLog(ctx) {
+			b.signal()
+			return
+		}
+	}
+}
+
+// tryCreateLog attempts to create the log of a degraded sender, returning
+// whether it succeeded. Once the log is created, the batches held so far are
+// addressed to it so that the flusher backfills them.
+func (b *buildlogger) tryCreateLog(ctx context.Context) bool {
+	id, err := b.createLog(ctx, 0)
+	if err != nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.setLog(id)
+	for _, queued := range b.queue {
+		if queued.logID == "" {
+			queued.logID = id
+		}
+	}
+	b.degraded = false
+	b.opts.Local.Send(message.NewDefaultMessage(level.Info, "created log '"+id+"' after degraded start, backfilling log lines"))
+
+	return true
+}
+
+// finishCreatingLog stops creating the log in the background and, if the log
+// still has not been created, makes one last attempt, returning whether the
+// log exists.
+func (b *buildlogger) finishCreatingLog(ctx context.Context) bool {
+	if b.creating == nil {
+		return true
+	}
+
+	b.stopCreating()
+	<-b.creating
+
+	b.mu.Lock()
+	degraded := b.degraded
+	b.mu.Unlock()
+
+	if degraded {
+		return b.tryCreateLog(ctx)
+	}
+
+	return true
+}
+
+// holdDegraded keeps the sender's batches while its log has not been
+// created, moving them to the spool if there is one, and returns
+// errLogNotCreated if the sender is degraded.
+func (b *buildlogger) holdDegraded() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.degraded {
+		return nil
+	}
+	if b.spool != nil {
+		if err := b.spillQueue(); err != nil {
+			return errors.Wrap(err, "spooling log lines of degraded sender")
+		}
+	}
+
+	return errLogNotCreated
+}
+
+// sendDegraded writes a log line to the local sender while the log has not
+// been created. A structured line is decoded, and its prefix and payload are
+// written as the payload's message would be. It must be called with the lock
+// held.
+func (b *buildlogger) sendDegraded(line *gopb.LogLine) {
+	priority := level.Priority(line.Priority)
+	if !b.opts.Format.structured() {
+		b.opts.Local.Send(message.NewDefaultMessage(priority, string(line.Data)))
+		return
+	}
+
+	var decoded StructuredLine
+	if err := b.opts.Format.unmarshal(line.Data, &decoded); err != nil {
+		b.logLocal(level.Error, errors.Wrap(err, "decoding structured log line"))
+		return
+	}
+	if doc, ok := decoded.Data.(bson.M); ok {
+		decoded.Data = map[string]interface{}(doc)
+	}
+	text := message.ConvertToComposer(priority, decoded.Data).String()
+	if decoded.Prefix != "" {
+		text = fmt.Sprintf("[%s] %s", decoded.Prefix, text)
+	}
+	b.opts.Local.Send(message.NewDefaultMessage(priority, text))
+}
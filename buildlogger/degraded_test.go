@@ -0,0 +1,234 @@
+package buildlogger
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/mongodb/grip/send"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// degradedClient is a thread safe mock client whose log creation can be made
+// to fail.
+type degradedClient struct {
+	mu sync.Mutex
+	mockClient
+}
+
+func (c *degradedClient) setCreateErr(createErr bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.createErr = createErr
+}
+
+func (c *degradedClient) lines() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var lines []string
+	for _, logLines := range c.allLogLines {
+		for _, line := range logLines.Lines {
+			lines = append(lines, logLines.LogId+":"+string(line.Data))
+		}
+	}
+
+	return lines
+}
+
+func (c *degradedClient) closed() *gopb.LogEndInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.logEndInfo
+}
+
+func (c *degradedClient) CreateLog(ctx context.Context, in *gopb.LogData, opts ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.mockClient.CreateLog(ctx, in, opts...)
+}
+
+func (c *degradedClient) AppendLogLines(ctx context.Context, in *gopb.LogLines, opts ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.mockClient.AppendLogLines(ctx, in, opts...)
+}
+
+func (c *degradedClient) CloseLog(ctx context.Context, in *gopb.LogEndInfo, opts ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.mockClient.CloseLog(ctx, in, opts...)
+}
+
+func TestDegradedStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	createDegradedSender := func(t *testing.T, backoff time.Duration, spoolDir string) (*buildlogger, *degradedClient, *send.InternalSender) {
+		client := &degradedClient{}
+		client.createErr = true
+		local, err := send.NewInternalLogger("local", send.LevelInfo{Default: level.Info, Threshold: level.Debug})
+		require.NoError(t, err)
+
+		b := createSender(ctx, client, local)
+		b.opts.DegradedStart = true
+		b.opts.Retry = RetryOptions{BaseBackoff: backoff, MaxBackoff: backoff}
+		require.NoError(t, b.opts.Retry.validate())
+		require.NoError(t, b.SetLevel(send.LevelInfo{Default: level.Info, Threshold: level.Debug}))
+		if spoolDir != "" {
+			require.NoError(t, b.openSpool(spoolDir))
+		}
+		require.NoError(t, b.startLog())
+		go b.flushLoop()
+
+		return b, client, local
+	}
+	localMessages := func(local *send.InternalSender) []string {
+		var out []string
+		for local.HasMessage() {
+			out = append(out, local.GetMessage().Message.String())
+		}
+		return out
+	}
+
+	t.Run("BackfillsOnceCreated", func(t *testing.T) {
+		b, client, local := createDegradedSender(t, 10*time.Millisecond, t.TempDir())
+		assert.Empty(t, b.opts.GetLogID())
+
+		b.Send(message.ConvertToComposer(level.Info, "first"))
+		b.Send(message.ConvertToComposer(level.Error, "second"))
+		assert.Equal(t, errLogNotCreated, errors.Cause(b.Flush(ctx)))
+		assert.Equal(t, 2, b.spool.len())
+		assert.Empty(t, client.lines())
+		assert.Subset(t, localMessages(local), []string{"first", "second"})
+
+		client.setCreateErr(false)
+		require.Eventually(t, func() bool {
+			return len(client.lines()) == 2
+		}, time.Second, 10*time.Millisecond)
+		assert.Equal(t, []string{"test_name:first", "test_name:second"}, client.lines())
+
+		b.Send(message.ConvertToComposer(level.Info, "third"))
+		require.NoError(t, b.Flush(ctx))
+		assert.Equal(t, []string{"test_name:first", "test_name:second", "test_name:third"}, client.lines())
+		assert.NotContains(t, localMessages(local), "third")
+		assert.Zero(t, b.spool.len())
+
+		require.NoError(t, b.Close())
+		require.NotNil(t, client.closed())
+		assert.Equal(t, "test_name", client.closed().LogId)
+	})
+	t.Run("BackfillsFromMemory", func(t *testing.T) {
+		b, client, _ := createDegradedSender(t, 10*time.Millisecond, "")
+
+		b.Send(message.ConvertToComposer(level.Info, "first"))
+		assert.Error(t, b.Flush(ctx))
+
+		client.setCreateErr(false)
+		require.Eventually(t, func() bool {
+			return len(client.lines()) == 1
+		}, time.Second, 10*time.Millisecond)
+		assert.Equal(t, []string{"test_name:first"}, client.lines())
+		require.NoError(t, b.Close())
+	})
+	t.Run("DropsOldestFromMemory", func(t *testing.T) {
+		b, client, _ := createDegradedSender(t, time.Minute, "")
+		b.mu.Lock()
+		b.opts.MaxBufferSize = 1
+		b.budget = newMemoryBudget(10)
+		b.mu.Unlock()
+
+		sent := make(chan struct{})
+		go func() {
+			defer close(sent)
+			for i := 0; i < 10; i++ {
+				b.Send(message.ConvertToComposer(level.Info, fmt.Sprintf("line %d", i)))
+			}
+		}()
+		select {
+		case <-sent:
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "Send blocked while the log has not been created")
+		}
+		stats := b.Stats()
+		assert.Equal(t, 9, stats.LinesDropped)
+		assert.Equal(t, 54, stats.BytesDropped)
+
+		client.setCreateErr(false)
+		require.NoError(t, b.Close())
+		assert.Equal(t, []string{"test_name:line 9"}, client.lines())
+	})
+	t.Run("CreatedOnClose", func(t *testing.T) {
+		b, client, _ := createDegradedSender(t, time.Minute, t.TempDir())
+
+		b.Send(message.ConvertToComposer(level.Info, "first"))
+		client.setCreateErr(false)
+
+		require.NoError(t, b.Close())
+		assert.Equal(t, []string{"test_name:first"}, client.lines())
+		require.NotNil(t, client.closed())
+		assert.Equal(t, "test_name", b.opts.GetLogID())
+	})
+	t.Run("NeverCreated", func(t *testing.T) {
+		b, client, _ := createDegradedSender(t, time.Minute, t.TempDir())
+
+		b.Send(message.ConvertToComposer(level.Info, "first"))
+
+		assert.Error(t, b.Close())
+		assert.Empty(t, client.lines())
+		assert.Nil(t, client.closed())
+		assert.Equal(t, 1, b.spool.len())
+	})
+	t.Run("LogIDReadDuringCreate", func(t *testing.T) {
+		b, client, _ := createDegradedSender(t, time.Millisecond, "")
+
+		// The log is created in the background while its ID is read.
+		client.setCreateErr(false)
+		require.Eventually(t, func() bool {
+			return b.opts.GetLogID() != "" && len(b.opts.GetLogIDs()) == 1
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, "test_name", b.opts.GetLogID())
+		require.NoError(t, b.Close())
+	})
+	t.Run("StructuredLocalLines", func(t *testing.T) {
+		for name, format := range map[string]LogFormat{"JSON": LogFormatJSON, "BSON": LogFormatBSON} {
+			t.Run(name, func(t *testing.T) {
+				b, client, local := createDegradedSender(t, time.Minute, "")
+				b.mu.Lock()
+				b.opts.Format = format
+				b.opts.Prefix = "proc"
+				b.mu.Unlock()
+				localMessages(local)
+
+				b.Send(message.NewFields(level.Info, message.Fields{"msg": "started", "port": 8080}))
+				b.Send(message.ConvertToComposer(level.Info, "text"))
+				assert.Equal(t, []string{"[proc] [msg='started' port='8080']", "[proc] [message='text']"}, localMessages(local))
+
+				client.setCreateErr(false)
+				require.NoError(t, b.Close())
+			})
+		}
+	})
+	t.Run("DisabledByDefault", func(t *testing.T) {
+		client := &degradedClient{}
+		client.createErr = true
+		b := createSender(ctx, client, &mockSender{Base: send.NewBase("test")})
+		defer b.cancel()
+
+		assert.Error(t, b.startLog())
+		assert.False(t, b.degraded)
+	})
+}
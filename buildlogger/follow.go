@@ -0,0 +1,205 @@
+package buildlogger
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultPollInterval = 5 * time.Second
+
+	// printTimeLayout is the layout of the timestamp Cedar prefixes to
+	// each log line, in brackets, when printing the time.
+	printTimeLayout = "2006/01/02 15:04:05.000"
+)
+
+// splitTime splits the log line into the timestamp of its print time prefix
+// and the rest of the line. It returns false if the line has no print time
+// prefix.
+func splitTime(line []byte) (time.Time, []byte, bool) {
+	end := len(printTimeLayout) + 1
+	if len(line) < end+2 || line[0] != '[' || line[end] != ']' || line[end+1] != ' ' {
+		return time.Time{}, line, false
+	}
+
+	ts, err := time.Parse(printTimeLayout, string(line[1:end]))
+	if err != nil {
+		return time.Time{}, line, false
+	}
+
+	return ts, line[end+2:], true
+}
+
+// follower polls Cedar for the lines of logs as they are appended, writing
+// each line once.
+type follower struct {
+	opts GetOptions
+	w    *io.PipeWriter
+	// The timestamp of the last line written and the number of lines
+	// written with that timestamp, which are skipped when they are
+	// returned again by the next poll.
+	last   time.Time
+	atLast int
+}
+
+type followReadCloser struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (r *followReadCloser) Close() error {
+	r.cancel()
+	return r.PipeReader.Close()
+}
+
+func follow(ctx context.Context, opts GetOptions) (io.ReadCloser, error) {
+	if opts.PollInterval == 0 {
+		opts.PollInterval = defaultPollInterval
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r, w := io.Pipe()
+	f := &follower{opts: opts, w: w}
+
+	first, err := f.fetch(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go func() {
+		defer cancel()
+		err := f.run(ctx, first)
+		if err != nil && ctx.Err() != nil {
+			// The request in progress, if any, failed because
+			// the context is done.
+			err = ctx.Err()
+		}
+		_ = w.CloseWithError(err)
+	}()
+
+	return &followReadCloser{PipeReader: r, cancel: cancel}, nil
+}
+
+// run writes the lines of each poll until the logs are completed. The logs
+// are polled one last time after they are completed, since lines may have
+// been appended after the previous poll.
+func (f *follower) run(ctx context.Context, lines io.ReadCloser) error {
+	completed := false
+	for {
+		err := f.copy(lines)
+		closeErr := lines.Close()
+		if err != nil {
+			return err
+		}
+		if closeErr != nil {
+			return errors.Wrap(closeErr, "closing log lines")
+		}
+		if completed {
+			return nil
+		}
+
+		completed, err = f.completed(ctx)
+		if err != nil {
+			return err
+		}
+		if !completed {
+			timer := time.NewTimer(f.opts.PollInterval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		lines, err = f.fetch(ctx)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// fetch requests the log lines starting at the last line written. The time is
+// always printed, so that the lines already written can be skipped.
+func (f *follower) fetch(ctx context.Context) (io.ReadCloser, error) {
+	opts := f.opts
+	opts.PrintTime = true
+	if !f.last.IsZero() {
+		opts.Tail = 0
+		if f.last.After(opts.Start) {
+			opts.Start = f.last
+		}
+	}
+
+	return get(ctx, opts)
+}
+
+func (f *follower) copy(lines io.Reader) error {
+	skip := f.atLast
+	r := bufio.NewReader(lines)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if ts, data, ok := splitTime(line); ok {
+				switch {
+				case ts.Before(f.last):
+					continue
+				case ts.Equal(f.last) && skip > 0:
+					skip--
+					continue
+				case ts.Equal(f.last):
+					f.atLast++
+				default:
+					f.last = ts
+					f.atLast = 1
+					skip = 0
+				}
+				if !f.opts.PrintTime {
+					line = data
+				}
+			}
+			if _, writeErr := f.w.Write(line); writeErr != nil {
+				return writeErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "reading log lines")
+		}
+	}
+}
+
+// completed returns whether every log requested has been completed, according
+// to its metadata.
+func (f *follower) completed(ctx context.Context) (bool, error) {
+	opts := f.opts
+	opts.Meta = true
+	opts.GroupID = ""
+	opts.Start = time.Time{}
+	opts.End = time.Time{}
+	r, err := get(ctx, opts)
+	if err != nil {
+		return false, errors.Wrap(err, "fetching log metadata")
+	}
+	defer r.Close()
+
+	logs, err := decodeLogMetadata(r)
+	if err != nil {
+		return false, err
+	}
+
+	for _, log := range logs {
+		if !log.Completed() {
+			return false, nil
+		}
+	}
+
+	return len(logs) > 0, nil
+}
@@ -0,0 +1,282 @@
+package buildlogger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/timber"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// followServer is a fake Cedar service for a single log, which serves the
+// lines appended so far with their print time prefix.
+type followServer struct {
+	mu        sync.Mutex
+	lines     []string
+	times     []time.Time
+	completed bool
+	requests  []string
+	polls     int
+	// If set, poll requests are signaled on hang and then block until
+	// the client gives up on them.
+	hang chan struct{}
+}
+
+func (s *followServer) append(ts time.Time, lines ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, line := range lines {
+		s.lines = append(s.lines, line)
+		s.times = append(s.times, ts)
+	}
+}
+
+func (s *followServer) complete() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.completed = true
+}
+
+func (s *followServer) hangPolls() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hang = make(chan struct{}, 1)
+	return s.hang
+}
+
+func (s *followServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	hang := s.hang
+	s.mu.Unlock()
+	if hang != nil && !strings.HasSuffix(r.URL.Path, "/meta") {
+		select {
+		case hang <- struct{}{}:
+		default:
+		}
+		<-r.Context().Done()
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if strings.HasSuffix(r.URL.Path, "/meta") {
+		if s.completed {
+			_, _ = fmt.Fprintf(w, `{"id": "id", "completed_at": "%s", "artifact": {"type": "s3"}}`, time.Now().UTC().Format(time.RFC3339))
+		} else {
+			_, _ = w.Write([]byte(`{"id": "id", "completed_at": null, "artifact": {"type": "s3"}}`))
+		}
+		return
+	}
+
+	s.polls++
+	s.requests = append(s.requests, r.URL.RawQuery)
+	query := r.URL.Query()
+	var start time.Time
+	if query.Get("start") != "" {
+		var err error
+		start, err = time.Parse(time.RFC3339, query.Get("start"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	first := 0
+	if n, err := strconv.Atoi(query.Get("n")); err == nil && n < len(s.lines) {
+		first = len(s.lines) - n
+	}
+	for i := first; i < len(s.lines); i++ {
+		if s.times[i].Before(start) {
+			continue
+		}
+		if query.Get("print_time") == "true" {
+			_, _ = fmt.Fprintf(w, "[%s] ", s.times[i].Format(printTimeLayout))
+		}
+		_, _ = fmt.Fprintln(w, s.lines[i])
+	}
+}
+
+func TestFollow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := time.Date(2020, time.January, 2, 3, 4, 5, 0, time.UTC)
+	newServer := func(t *testing.T) (*followServer, GetOptions) {
+		fs := &followServer{}
+		server := httptest.NewServer(fs)
+		t.Cleanup(server.Close)
+		return fs, GetOptions{
+			Cedar:        timber.GetOptions{BaseURL: server.URL},
+			ID:           "id",
+			Follow:       true,
+			PollInterval: 10 * time.Millisecond,
+		}
+	}
+
+	t.Run("StreamsUntilCompleted", func(t *testing.T) {
+		fs, opts := newServer(t)
+		fs.append(ts, "first", "second")
+
+		r, err := Get(ctx, opts)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, r.Close()) }()
+
+		go func() {
+			// Lines in the same second as the last line read must not
+			// be repeated, and lines appended just before the log is
+			// completed must not be missed.
+			time.Sleep(50 * time.Millisecond)
+			fs.append(ts.Add(time.Millisecond), "third")
+			fs.append(ts.Add(2*time.Second), "fourth")
+			time.Sleep(50 * time.Millisecond)
+			fs.append(ts.Add(3*time.Second), "fifth")
+			fs.complete()
+		}()
+
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, "first\nsecond\nthird\nfourth\nfifth\n", string(data))
+
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		assert.Greater(t, fs.polls, 2)
+		for _, query := range fs.requests[1:] {
+			assert.Contains(t, query, "start=")
+		}
+	})
+	t.Run("DuplicateTimestamps", func(t *testing.T) {
+		fs, opts := newServer(t)
+		fs.append(ts, "first", "first")
+
+		r, err := Get(ctx, opts)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, r.Close()) }()
+
+		fs.append(ts, "first")
+		fs.append(ts.Add(time.Second), "second")
+		fs.complete()
+
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, "first\nfirst\nfirst\nsecond\n", string(data))
+	})
+	t.Run("PrintTime", func(t *testing.T) {
+		fs, opts := newServer(t)
+		opts.PrintTime = true
+		fs.append(ts, "first")
+		fs.complete()
+
+		r, err := Get(ctx, opts)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, r.Close()) }()
+
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("[%s] first\n", ts.Format(printTimeLayout)), string(data))
+	})
+	t.Run("Tail", func(t *testing.T) {
+		fs, opts := newServer(t)
+		opts.Tail = 1
+		fs.append(ts, "first")
+		fs.append(ts.Add(time.Second), "second")
+
+		r, err := Get(ctx, opts)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, r.Close()) }()
+
+		fs.append(ts.Add(2*time.Second), "third")
+		fs.complete()
+
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, "second\nthird\n", string(data))
+	})
+	t.Run("ContextCanceled", func(t *testing.T) {
+		_, opts := newServer(t)
+		tctx, tcancel := context.WithCancel(ctx)
+
+		r, err := Get(tctx, opts)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, r.Close()) }()
+
+		time.AfterFunc(50*time.Millisecond, tcancel)
+		_, err = io.ReadAll(r)
+		assert.Equal(t, context.Canceled, err)
+	})
+	t.Run("ContextCanceledDuringPoll", func(t *testing.T) {
+		fs, opts := newServer(t)
+		tctx, tcancel := context.WithCancel(ctx)
+
+		r, err := Get(tctx, opts)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, r.Close()) }()
+
+		hang := fs.hangPolls()
+		go func() {
+			<-hang
+			tcancel()
+		}()
+		_, err = io.ReadAll(r)
+		assert.Equal(t, context.Canceled, err)
+	})
+	t.Run("Close", func(t *testing.T) {
+		_, opts := newServer(t)
+
+		r, err := Get(ctx, opts)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		_, err = r.Read(make([]byte, 1))
+		assert.Error(t, err)
+	})
+	t.Run("InitialRequestError", func(t *testing.T) {
+		opts := GetOptions{
+			Cedar:  timber.GetOptions{BaseURL: "http://localhost:1"},
+			ID:     "id",
+			Follow: true,
+		}
+		_, err := Get(ctx, opts)
+		assert.Error(t, err)
+	})
+	t.Run("InvalidOptions", func(t *testing.T) {
+		_, opts := newServer(t)
+		for name, modify := range map[string]func(*GetOptions){
+			"Meta":                 func(opts *GetOptions) { opts.Meta = true },
+			"Limit":                func(opts *GetOptions) { opts.Limit = 10 },
+			"NegativePollInterval": func(opts *GetOptions) { opts.PollInterval = -1 },
+		} {
+			t.Run(name, func(t *testing.T) {
+				invalid := opts
+				modify(&invalid)
+				_, err := Get(ctx, invalid)
+				assert.Error(t, err)
+			})
+		}
+	})
+}
+
+func TestSplitTime(t *testing.T) {
+	ts := time.Date(2020, time.January, 2, 3, 4, 5, 6e6, time.UTC)
+
+	actual, data, ok := splitTime([]byte("[2020/01/02 03:04:05.006] line\n"))
+	require.True(t, ok)
+	assert.True(t, ts.Equal(actual))
+	assert.Equal(t, "line\n", string(data))
+
+	for _, line := range []string{"line\n", "[2020/01/02 03:04:05.006]line", "[not a timestamp at all!] line", ""} {
+		_, data, ok = splitTime([]byte(line))
+		assert.False(t, ok)
+		assert.Equal(t, line, string(data))
+	}
+}
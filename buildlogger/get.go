@@ -19,6 +19,12 @@ import (
 type GetOptions struct {
 	Cedar timber.GetOptions
 
+	// The directory of logs stored by the local backend, set via the
+	// LocalDir logger option. If set, logs are read from the directory
+	// instead of requested from Cedar, and the Cedar options are
+	// ignored.
+	LocalDir string
+
 	// Request information. See Cedar's REST documentation for more
 	// information:
 	// `https://github.com/evergreen-ci/cedar/wiki/Rest-V1-Usage`.
@@ -38,18 +44,32 @@ type GetOptions struct {
 	PrintPriority bool
 	Tail          int
 	Limit         int
+
+	// Follow keeps the returned reader open, like `tail -f`, polling for
+	// new lines every PollInterval until the requested logs are
+	// completed or the context is done. Follow cannot be used with Meta
+	// or Limit.
+	Follow bool
+	// The interval at which to poll for new lines when following logs.
+	// Defaults to 5 seconds.
+	PollInterval time.Duration
 }
 
 // Validate ensures BuildloggerGetOptions is configured correctly.
 func (opts GetOptions) Validate() error {
 	catcher := grip.NewBasicCatcher()
 
-	catcher.Add(opts.Cedar.Validate())
+	if opts.LocalDir == "" {
+		catcher.Add(opts.Cedar.Validate())
+	}
 	catcher.AddWhen(opts.ID == "" && opts.TaskID == "", errors.New("must provide an id or task id"))
 	catcher.AddWhen(opts.ID != "" && opts.TaskID != "", errors.New("cannot provide both id and task id"))
 	catcher.AddWhen(opts.TestName != "" && opts.TaskID == "", errors.New("must provide a task id when a test name is specified"))
 	catcher.AddWhen(opts.GroupID != "" && opts.TaskID == "", errors.New("must provide a task id when a group id is specified"))
 	catcher.AddWhen(opts.GroupID != "" && opts.Meta, errors.New("cannot specify a group id and set meta to true"))
+	catcher.AddWhen(opts.Follow && opts.Meta, errors.New("cannot follow log metadata"))
+	catcher.AddWhen(opts.Follow && opts.Limit > 0, errors.New("cannot follow logs with a limit"))
+	catcher.AddWhen(opts.PollInterval < 0, errors.New("poll interval cannot be negative"))
 
 	return catcher.Resolve()
 }
@@ -108,12 +128,26 @@ func (opts GetOptions) parse() string {
 }
 
 // Get returns a paginated read closer with the logs or log metadata requested
-// via HTTP to a Cedar service.
+// via HTTP to a Cedar service, or from a local directory of logs. When
+// following logs, the reader also returns the lines added to the logs after
+// the call, and must be closed to stop polling for them.
 func Get(ctx context.Context, opts GetOptions) (io.ReadCloser, error) {
 	if err := opts.Validate(); err != nil {
 		return nil, errors.WithStack(err)
 	}
 
+	if opts.Follow {
+		return follow(ctx, opts)
+	}
+
+	return get(ctx, opts)
+}
+
+func get(ctx context.Context, opts GetOptions) (io.ReadCloser, error) {
+	if opts.LocalDir != "" {
+		return getLocal(opts)
+	}
+
 	resp, err := opts.Cedar.DoReq(ctx, opts.parse(), nil)
 	if err != nil {
 		return nil, errors.Wrapf(err, "fetching logs request")
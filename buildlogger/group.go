@@ -0,0 +1,272 @@
+package buildlogger
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sync"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/mongodb/grip"
+	"github.com/mongodb/grip/send"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+)
+
+// GroupKey identifies a log within a Group.
+type GroupKey struct {
+	ProcessName string
+	TestName    string
+	Trial       int32
+}
+
+func (k GroupKey) String() string {
+	return fmt.Sprintf("%s/%s/%d", k.ProcessName, k.TestName, k.Trial)
+}
+
+// spoolDir returns the subdirectory of the group's spool directory used by the
+// log with this key.
+func (k GroupKey) spoolDir(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s,%s,%d", url.PathEscape(k.ProcessName), url.PathEscape(k.TestName), k.Trial))
+}
+
+// Group manages many buildlogger logs, such as one per process or test of a
+// task, over a single gRPC client connection. The logs of a group share one
+// background flusher and one memory budget of MaxQueueSize bytes, but each is
+// created and closed as its own log in cedar.
+type Group struct {
+	mu       sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	opts     LoggerOptions
+	conn     *grpc.ClientConn
+	client   gopb.BuildloggerClient
+	flusher  *flusher
+	budget   *memoryBudget
+	loggers  map[GroupKey]*buildlogger
+	creating map[GroupKey]chan struct{}
+	closed   bool
+}
+
+// NewGroup returns a new Group whose logs are created with the given options.
+// The ProcessName, TestName, and Trial options are set per log by its key, and
+// the spool directory, if any, is split into one subdirectory per log. If the
+// options have no ClientConn, the group dials its own connection and closes
+// it when the group is closed.
+func NewGroup(ctx context.Context, opts *LoggerOptions) (*Group, error) {
+	if err := opts.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid cedar buildlogger options")
+	}
+
+	client, conn, err := newClient(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	g := &Group{
+		ctx:      ctx,
+		cancel:   cancel,
+		opts:     *opts,
+		conn:     conn,
+		client:   client,
+		budget:   newMemoryBudget(opts.MaxQueueSize),
+		loggers:  map[GroupKey]*buildlogger{},
+		creating: map[GroupKey]chan struct{}{},
+	}
+	g.flusher = newFlusher(&g.opts)
+
+	go g.flusher.run(g.ctx)
+
+	return g, nil
+}
+
+// Sender returns the sender for the log with the given key, creating the log
+// the first time the key is used. The log is created without holding up the
+// other logs of the group; concurrent calls with the same key wait for it.
+func (g *Group) Sender(key GroupKey) (send.Sender, error) {
+	g.mu.Lock()
+	for {
+		if g.closed {
+			g.mu.Unlock()
+			return nil, errors.New("group is closed")
+		}
+		if b, ok := g.loggers[key]; ok {
+			g.mu.Unlock()
+			return b, nil
+		}
+
+		creating, ok := g.creating[key]
+		if !ok {
+			break
+		}
+		g.mu.Unlock()
+		<-creating
+		g.mu.Lock()
+	}
+	creating := make(chan struct{})
+	g.creating[key] = creating
+	g.mu.Unlock()
+
+	b, err := g.newSender(key)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.creating, key)
+	close(creating)
+	if err != nil {
+		return nil, err
+	}
+
+	// A group closed in the meantime waits for the log to be published, so
+	// that it is closed along with the others.
+	g.flusher.add(b)
+	g.loggers[key] = b
+
+	return b, nil
+}
+
+// newSender creates the log with the given key and returns its sender.
+func (g *Group) newSender(key GroupKey) (*buildlogger, error) {
+	opts := g.opts
+	opts.ProcessName = key.ProcessName
+	opts.TestName = key.TestName
+	opts.Trial = key.Trial
+	opts.exitCode = 0
+
+	b := newBuildlogger(g.ctx, key.String(), &opts, g.client, g.flusher, g.budget)
+
+	if opts.SpoolDir != "" {
+		if err := b.openSpool(key.spoolDir(opts.SpoolDir)); err != nil {
+			b.cancel()
+			return nil, errors.Wrapf(err, "log '%s'", key)
+		}
+	}
+
+	if err := b.SetErrorHandler(b.handleError); err != nil {
+		b.cancel()
+		return nil, errors.Wrap(err, "setting default error handler")
+	}
+
+	if err := b.startLog(); err != nil {
+		b.cancel()
+		return nil, errors.Wrapf(err, "log '%s'", key)
+	}
+
+	return b, nil
+}
+
+// SetExitCode sets the exit code reported when the log with the given key is
+// closed.
+func (g *Group) SetExitCode(key GroupKey, exitCode int32) error {
+	b, err := g.get(key)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.opts.SetExitCode(exitCode)
+
+	return nil
+}
+
+// GetLogID returns the cedar log ID of the log with the given key, which is
+// empty while a log that started in degraded mode has not been created.
+func (g *Group) GetLogID(key GroupKey) (string, error) {
+	b, err := g.get(key)
+	if err != nil {
+		return "", err
+	}
+
+	return b.opts.GetLogID(), nil
+}
+
+// GetLogIDs returns the cedar log IDs of all the logs created for the given
+// key, in order, which differ from the single ID returned by GetLogID when
+// rolling over.
+func (g *Group) GetLogIDs(key GroupKey) ([]string, error) {
+	b, err := g.get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.opts.GetLogIDs(), nil
+}
+
+func (g *Group) get(key GroupKey) (*buildlogger, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	b, ok := g.loggers[key]
+	if !ok {
+		return nil, errors.Errorf("no log '%s' in group", key)
+	}
+
+	return b, nil
+}
+
+func (g *Group) list() []*buildlogger {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	loggers := make([]*buildlogger, 0, len(g.loggers))
+	for _, b := range g.loggers {
+		loggers = append(loggers, b)
+	}
+
+	return loggers
+}
+
+// Flush flushes the log lines of every log in the group.
+func (g *Group) Flush(ctx context.Context) error {
+	catcher := grip.NewBasicCatcher()
+	for _, b := range g.list() {
+		catcher.Wrapf(b.Flush(ctx), "flushing log '%s'", b.Name())
+	}
+
+	return catcher.Resolve()
+}
+
+// Close closes every log in the group, concurrently, and then the group's
+// connection, if the group dialed it. Logs already closed through their
+// sender are not closed again.
+func (g *Group) Close() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil
+	}
+	g.closed = true
+	creating := make([]chan struct{}, 0, len(g.creating))
+	for _, c := range g.creating {
+		creating = append(creating, c)
+	}
+	g.mu.Unlock()
+
+	// Logs still being created are closed too, once they are published.
+	for _, c := range creating {
+		<-c
+	}
+
+	catcher := grip.NewBasicCatcher()
+	wg := sync.WaitGroup{}
+	for _, b := range g.list() {
+		wg.Add(1)
+		go func(b *buildlogger) {
+			defer wg.Done()
+			catcher.Wrapf(b.Close(), "closing log '%s'", b.Name())
+		}(b)
+	}
+	wg.Wait()
+
+	g.cancel()
+	if g.conn != nil {
+		catcher.Wrap(g.conn.Close(), "closing connection")
+	}
+
+	return catcher.Resolve()
+}
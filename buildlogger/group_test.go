@@ -0,0 +1,402 @@
+package buildlogger
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/evergreen-ci/timber/testutil"
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/mongodb/grip/send"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// groupClient is a concurrency safe mock client that records the RPCs of
+// every log, using the log's test and process names as its ID. Creating the
+// log of the held test signals started and waits until hold is closed.
+type groupClient struct {
+	gopb.BuildloggerClient
+	mu        sync.Mutex
+	createErr bool
+	held      string
+	started   chan struct{}
+	hold      chan struct{}
+	created   []*gopb.LogData
+	lines     map[string][]string
+	closed    map[string]*gopb.LogEndInfo
+}
+
+func (gc *groupClient) CreateLog(_ context.Context, in *gopb.LogData, _ ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	if gc.hold != nil && in.Info.TestName == gc.held {
+		gc.started <- struct{}{}
+		<-gc.hold
+	}
+
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	if gc.createErr {
+		return nil, errors.New("create error")
+	}
+	gc.created = append(gc.created, in)
+
+	return &gopb.BuildloggerResponse{LogId: in.Info.ProcName + "-" + in.Info.TestName}, nil
+}
+
+func (gc *groupClient) AppendLogLines(_ context.Context, in *gopb.LogLines, _ ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	if gc.lines == nil {
+		gc.lines = map[string][]string{}
+	}
+	for _, line := range in.Lines {
+		gc.lines[in.LogId] = append(gc.lines[in.LogId], string(line.Data))
+	}
+
+	return &gopb.BuildloggerResponse{LogId: in.LogId}, nil
+}
+
+func (gc *groupClient) CloseLog(_ context.Context, in *gopb.LogEndInfo, _ ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	if gc.closed == nil {
+		gc.closed = map[string]*gopb.LogEndInfo{}
+	}
+	gc.closed[in.LogId] = in
+
+	return &gopb.BuildloggerResponse{LogId: in.LogId}, nil
+}
+
+func createGroup(ctx context.Context, gc *groupClient, opts LoggerOptions) *Group {
+	ctx, cancel := context.WithCancel(ctx)
+	g := &Group{
+		ctx:      ctx,
+		cancel:   cancel,
+		opts:     opts,
+		client:   gc,
+		budget:   newMemoryBudget(opts.MaxQueueSize),
+		loggers:  map[GroupKey]*buildlogger{},
+		creating: map[GroupKey]chan struct{}{},
+	}
+	g.flusher = newFlusher(&g.opts)
+
+	go g.flusher.run(g.ctx)
+
+	return g
+}
+
+func TestGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := LoggerOptions{
+		Project:       "project",
+		TaskID:        "task",
+		Local:         &mockSender{Base: send.NewBase("test")},
+		MaxBufferSize: 1 << 10,
+		MaxQueueSize:  1 << 20,
+		FlushInterval: -1,
+	}
+
+	t.Run("SenderPerKey", func(t *testing.T) {
+		gc := &groupClient{}
+		g := createGroup(ctx, gc, opts)
+		defer func() { assert.NoError(t, g.Close()) }()
+
+		key := GroupKey{ProcessName: "proc", TestName: "test", Trial: 1}
+		s1, err := g.Sender(key)
+		require.NoError(t, err)
+		assert.Equal(t, key.String(), s1.Name())
+		s2, err := g.Sender(key)
+		require.NoError(t, err)
+		assert.Equal(t, s1, s2)
+		s3, err := g.Sender(GroupKey{ProcessName: "proc", TestName: "other"})
+		require.NoError(t, err)
+		assert.NotEqual(t, s1, s3)
+
+		gc.mu.Lock()
+		require.Len(t, gc.created, 2)
+		assert.Equal(t, "project", gc.created[0].Info.Project)
+		assert.Equal(t, "task", gc.created[0].Info.TaskId)
+		assert.Equal(t, "proc", gc.created[0].Info.ProcName)
+		assert.Equal(t, "test", gc.created[0].Info.TestName)
+		assert.EqualValues(t, 1, gc.created[0].Info.Trial)
+		assert.Equal(t, "other", gc.created[1].Info.TestName)
+		gc.mu.Unlock()
+
+		logID, err := g.GetLogID(key)
+		require.NoError(t, err)
+		assert.Equal(t, "proc-test", logID)
+		assert.Empty(t, g.opts.GetLogID(), "the group's options should not be modified")
+	})
+	t.Run("CreatesLogOutsideLock", func(t *testing.T) {
+		gc := &groupClient{held: "slow", started: make(chan struct{}, 2), hold: make(chan struct{})}
+		g := createGroup(ctx, gc, opts)
+		defer func() { assert.NoError(t, g.Close()) }()
+
+		slow := GroupKey{TestName: "slow"}
+		senders := make(chan send.Sender, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				s, err := g.Sender(slow)
+				assert.NoError(t, err)
+				senders <- s
+			}()
+		}
+		<-gc.started
+
+		created := make(chan struct{})
+		go func() {
+			defer close(created)
+			_, err := g.Sender(GroupKey{TestName: "fast"})
+			assert.NoError(t, err)
+			_, err = g.GetLogID(GroupKey{TestName: "fast"})
+			assert.NoError(t, err)
+		}()
+		select {
+		case <-created:
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "creating a log held up the other logs of the group")
+		}
+
+		close(gc.hold)
+		s1, s2 := <-senders, <-senders
+		assert.True(t, s1 == s2)
+		gc.mu.Lock()
+		assert.Len(t, gc.created, 2)
+		gc.mu.Unlock()
+		assert.Len(t, g.flusher.list(), 2)
+	})
+	t.Run("CloseWaitsForLogsBeingCreated", func(t *testing.T) {
+		gc := &groupClient{held: "slow", started: make(chan struct{}, 1), hold: make(chan struct{})}
+		g := createGroup(ctx, gc, opts)
+
+		created := make(chan error, 1)
+		go func() {
+			_, err := g.Sender(GroupKey{TestName: "slow"})
+			created <- err
+		}()
+		<-gc.started
+
+		closed := make(chan error, 1)
+		go func() { closed <- g.Close() }()
+		close(gc.hold)
+		require.NoError(t, <-created)
+		require.NoError(t, <-closed)
+
+		gc.mu.Lock()
+		defer gc.mu.Unlock()
+		assert.Contains(t, gc.closed, "-slow")
+	})
+	t.Run("SharesFlusherAndBudget", func(t *testing.T) {
+		g := createGroup(ctx, &groupClient{}, opts)
+		defer func() { assert.NoError(t, g.Close()) }()
+
+		s1, err := g.Sender(GroupKey{TestName: "one"})
+		require.NoError(t, err)
+		s2, err := g.Sender(GroupKey{TestName: "two"})
+		require.NoError(t, err)
+		b1, b2 := s1.(*buildlogger), s2.(*buildlogger)
+		assert.True(t, b1.flusher == g.flusher)
+		assert.True(t, b2.flusher == g.flusher)
+		assert.True(t, b1.budget == g.budget)
+		assert.True(t, b2.budget == g.budget)
+		assert.Len(t, g.flusher.list(), 2)
+
+		s1.Send(message.ConvertToComposer(level.Info, "12345"))
+		s2.Send(message.ConvertToComposer(level.Info, "1234567"))
+		assert.Equal(t, 12, g.budget.inUse())
+	})
+	t.Run("BudgetIsGlobal", func(t *testing.T) {
+		groupOpts := opts
+		groupOpts.MaxQueueSize = 20
+		groupOpts.OverflowPolicy = OverflowDropNewest
+		g := createGroup(ctx, &groupClient{}, groupOpts)
+		defer func() { assert.NoError(t, g.Close()) }()
+
+		s1, err := g.Sender(GroupKey{TestName: "one"})
+		require.NoError(t, err)
+		s2, err := g.Sender(GroupKey{TestName: "two"})
+		require.NoError(t, err)
+
+		// Each line is 8 bytes, so the lines of the first log leave
+		// no room for a line of the second.
+		s1.Send(message.ConvertToComposer(level.Info, "line 001"))
+		s1.Send(message.ConvertToComposer(level.Info, "line 002"))
+		s2.Send(message.ConvertToComposer(level.Info, "line 003"))
+		assert.Zero(t, s1.(*buildlogger).dropped.lines)
+		assert.Equal(t, 1, s2.(*buildlogger).dropped.lines)
+		assert.Equal(t, 16, g.budget.inUse())
+	})
+	t.Run("FlushesEveryLog", func(t *testing.T) {
+		gc := &groupClient{}
+		g := createGroup(ctx, gc, opts)
+		defer func() { assert.NoError(t, g.Close()) }()
+
+		for i := 0; i < 3; i++ {
+			s, err := g.Sender(GroupKey{TestName: fmt.Sprintf("test%d", i)})
+			require.NoError(t, err)
+			s.Send(message.ConvertToComposer(level.Info, fmt.Sprintf("line %d", i)))
+		}
+		require.NoError(t, g.Flush(ctx))
+
+		gc.mu.Lock()
+		defer gc.mu.Unlock()
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, []string{fmt.Sprintf("line %d", i)}, gc.lines[fmt.Sprintf("-test%d", i)])
+		}
+	})
+	t.Run("BackgroundFlush", func(t *testing.T) {
+		gc := &groupClient{}
+		groupOpts := opts
+		groupOpts.MaxBufferSize = 1
+		g := createGroup(ctx, gc, groupOpts)
+		defer func() { assert.NoError(t, g.Close()) }()
+
+		for i := 0; i < 3; i++ {
+			s, err := g.Sender(GroupKey{TestName: fmt.Sprintf("test%d", i)})
+			require.NoError(t, err)
+			s.Send(message.ConvertToComposer(level.Info, "line"))
+		}
+		assert.Eventually(t, func() bool {
+			gc.mu.Lock()
+			defer gc.mu.Unlock()
+			return len(gc.lines) == 3
+		}, 5*time.Second, 10*time.Millisecond, "the shared flusher should send the lines of every log")
+	})
+	t.Run("CloseClosesEveryLog", func(t *testing.T) {
+		gc := &groupClient{}
+		g := createGroup(ctx, gc, opts)
+
+		one := GroupKey{TestName: "one"}
+		two := GroupKey{TestName: "two"}
+		for _, key := range []GroupKey{one, two} {
+			s, err := g.Sender(key)
+			require.NoError(t, err)
+			s.Send(message.ConvertToComposer(level.Info, "last line of "+key.TestName))
+		}
+		require.NoError(t, g.SetExitCode(two, 3))
+		require.NoError(t, g.Close())
+		assert.NoError(t, g.Close())
+
+		gc.mu.Lock()
+		require.Len(t, gc.closed, 2)
+		assert.EqualValues(t, 0, gc.closed["-one"].ExitCode)
+		assert.EqualValues(t, 3, gc.closed["-two"].ExitCode)
+		assert.Equal(t, []string{"last line of one"}, gc.lines["-one"])
+		assert.Equal(t, []string{"last line of two"}, gc.lines["-two"])
+		gc.mu.Unlock()
+
+		assert.Error(t, g.ctx.Err())
+		assert.Empty(t, g.flusher.list())
+		_, err := g.Sender(GroupKey{TestName: "three"})
+		assert.Error(t, err)
+	})
+	t.Run("CloseSkipsClosedLogs", func(t *testing.T) {
+		gc := &groupClient{}
+		g := createGroup(ctx, gc, opts)
+
+		s, err := g.Sender(GroupKey{TestName: "one"})
+		require.NoError(t, err)
+		require.NoError(t, s.Close())
+		gc.mu.Lock()
+		gc.closed = nil
+		gc.mu.Unlock()
+
+		require.NoError(t, g.Close())
+		assert.Empty(t, gc.closed)
+	})
+	t.Run("UnknownKey", func(t *testing.T) {
+		g := createGroup(ctx, &groupClient{}, opts)
+		defer func() { assert.NoError(t, g.Close()) }()
+
+		assert.Error(t, g.SetExitCode(GroupKey{TestName: "missing"}, 1))
+		_, err := g.GetLogID(GroupKey{TestName: "missing"})
+		assert.Error(t, err)
+	})
+	t.Run("CreateLogError", func(t *testing.T) {
+		g := createGroup(ctx, &groupClient{createErr: true}, opts)
+		defer func() { assert.NoError(t, g.Close()) }()
+
+		_, err := g.Sender(GroupKey{TestName: "one"})
+		assert.Error(t, err)
+		assert.Empty(t, g.list())
+		assert.Empty(t, g.flusher.list())
+	})
+	t.Run("SpoolDirPerLog", func(t *testing.T) {
+		groupOpts := opts
+		groupOpts.SpoolDir = t.TempDir()
+		g := createGroup(ctx, &groupClient{}, groupOpts)
+		defer func() { assert.NoError(t, g.Close()) }()
+
+		key := GroupKey{ProcessName: "a/b", TestName: "test", Trial: 2}
+		s, err := g.Sender(key)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(groupOpts.SpoolDir, "a%2Fb,test,2"), s.(*buildlogger).spool.dir)
+	})
+}
+
+func TestNewGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, err := testutil.NewMockBuildloggerServer(ctx, 4700)
+	require.NoError(t, err)
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		g, err := NewGroup(ctx, &LoggerOptions{Format: LogFormat(100)})
+		assert.Error(t, err)
+		assert.Nil(t, g)
+	})
+	t.Run("DialsOneConnection", func(t *testing.T) {
+		opts := &LoggerOptions{
+			Local:       &mockSender{Base: send.NewBase("test")},
+			BaseAddress: srv.DialOpts.BaseAddress,
+			RPCPort:     srv.DialOpts.RPCPort,
+			Insecure:    true,
+		}
+		g, err := NewGroup(ctx, opts)
+		require.NoError(t, err)
+		require.NotNil(t, g.conn)
+
+		for i := 0; i < 3; i++ {
+			s, err := g.Sender(GroupKey{TestName: fmt.Sprintf("test%d", i)})
+			require.NoError(t, err)
+			s.Send(message.ConvertToComposer(level.Info, "line"))
+			assert.Nil(t, s.(*buildlogger).conn)
+		}
+		require.NoError(t, g.Close())
+		assert.Equal(t, connectivity.Shutdown, g.conn.GetState())
+
+		srv.Mu.Lock()
+		defer srv.Mu.Unlock()
+		require.NotNil(t, srv.Close)
+	})
+	t.Run("ExistingConnection", func(t *testing.T) {
+		conn, err := grpc.DialContext(ctx, srv.Address(), grpc.WithInsecure())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		g, err := NewGroup(ctx, &LoggerOptions{
+			Local:      &mockSender{Base: send.NewBase("test")},
+			ClientConn: conn,
+		})
+		require.NoError(t, err)
+		assert.Nil(t, g.conn)
+		_, err = g.Sender(GroupKey{TestName: "test"})
+		require.NoError(t, err)
+		require.NoError(t, g.Close())
+		assert.NotEqual(t, connectivity.Shutdown, conn.GetState())
+	})
+}
@@ -0,0 +1,111 @@
+package buildlogger
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"iter"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mongodb/grip/level"
+	"github.com/pkg/errors"
+)
+
+// LogLine is a log line fetched from Cedar.
+type LogLine struct {
+	Timestamp time.Time
+	Priority  level.Priority
+	Data      string
+}
+
+// GetLines returns an iterator over the lines of the logs requested via HTTP
+// to a Cedar service, for use with range. The time and priority of each line
+// are always requested and parsed into the LogLine, regardless of the print
+// time and print priority options. Iteration stops after yielding the first
+// error, if any.
+func GetLines(ctx context.Context, opts GetOptions) iter.Seq2[LogLine, error] {
+	return func(yield func(LogLine, error) bool) {
+		if opts.Meta {
+			yield(LogLine{}, errors.New("cannot iterate over log metadata as log lines"))
+			return
+		}
+
+		opts.PrintTime = true
+		opts.PrintPriority = true
+		r, err := Get(ctx, opts)
+		if err != nil {
+			yield(LogLine{}, err)
+			return
+		}
+		defer r.Close()
+
+		// The lines are read from the concatenated pages, so a line
+		// split across a page boundary is read whole.
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if line != "" {
+				if !yield(parseLogLine(line), nil) {
+					return
+				}
+			}
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				yield(LogLine{}, errors.Wrap(err, "reading log lines"))
+				return
+			}
+		}
+	}
+}
+
+// parseLogLine parses a log line with the print time and print priority
+// prefixes, in either order.
+func parseLogLine(line string) LogLine {
+	out := LogLine{}
+	data := []byte(strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"))
+	for {
+		if ts, rest, ok := splitTime(data); ok && out.Timestamp.IsZero() {
+			out.Timestamp = ts
+			data = rest
+			continue
+		}
+		if p, rest, ok := splitPriority(data); ok && out.Priority == 0 {
+			out.Priority = p
+			data = rest
+			continue
+		}
+		break
+	}
+	out.Data = string(data)
+
+	return out
+}
+
+// splitPriority splits the log line into the priority of its print priority
+// prefix, such as "[P: 40] ", and the rest of the line. It returns false if
+// the line has no print priority prefix.
+func splitPriority(line []byte) (level.Priority, []byte, bool) {
+	const prefix = "[P:"
+	if len(line) < len(prefix) || string(line[:len(prefix)]) != prefix {
+		return 0, line, false
+	}
+
+	end := len(prefix)
+	for end < len(line) && line[end] != ']' {
+		end++
+	}
+	if end+1 >= len(line) || line[end+1] != ' ' {
+		return 0, line, false
+	}
+
+	p, err := strconv.Atoi(strings.TrimSpace(string(line[len(prefix):end])))
+	if err != nil {
+		return 0, line, false
+	}
+
+	return level.Priority(p), line[end+2:], true
+}
@@ -0,0 +1,130 @@
+package buildlogger
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/timber"
+	"github.com/mongodb/grip/level"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetLines(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := time.Date(2020, time.January, 2, 3, 4, 5, 6e6, time.UTC)
+	prefix := fmt.Sprintf("[%s] [P: 40] ", ts.Format(printTimeLayout))
+	// The second line is split across the two pages.
+	pages := []string{
+		prefix + "first\n" + prefix + "sec",
+		"ond\n" + prefix + "third",
+	}
+	var query string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := 0
+		if r.URL.Query().Get("page") == "2" {
+			page = 1
+		} else {
+			query = r.URL.RawQuery
+			w.Header().Set("Link", fmt.Sprintf("<%s/rest/v1/buildlogger/id?page=2>; rel=\"next\"", server.URL))
+		}
+		_, _ = w.Write([]byte(pages[page]))
+	}))
+	defer server.Close()
+
+	opts := GetOptions{
+		Cedar: timber.GetOptions{BaseURL: server.URL},
+		ID:    "id",
+	}
+
+	t.Run("Range", func(t *testing.T) {
+		var lines []LogLine
+		for line, err := range GetLines(ctx, opts) {
+			require.NoError(t, err)
+			lines = append(lines, line)
+		}
+		assert.Contains(t, query, "print_time=true")
+		assert.Contains(t, query, "print_priority=true")
+		require.Len(t, lines, 3)
+		for i, data := range []string{"first", "second", "third"} {
+			assert.True(t, ts.Equal(lines[i].Timestamp))
+			assert.Equal(t, level.Info, lines[i].Priority)
+			assert.Equal(t, data, lines[i].Data)
+		}
+	})
+	t.Run("Break", func(t *testing.T) {
+		count := 0
+		for _, err := range GetLines(ctx, opts) {
+			require.NoError(t, err)
+			count++
+			break
+		}
+		assert.Equal(t, 1, count)
+	})
+	t.Run("RequestError", func(t *testing.T) {
+		badOpts := opts
+		badOpts.ID = ""
+		var errs []error
+		for _, err := range GetLines(ctx, badOpts) {
+			errs = append(errs, err)
+		}
+		require.Len(t, errs, 1)
+		assert.Error(t, errs[0])
+	})
+	t.Run("Meta", func(t *testing.T) {
+		metaOpts := opts
+		metaOpts.Meta = true
+		for _, err := range GetLines(ctx, metaOpts) {
+			assert.Error(t, err)
+		}
+	})
+}
+
+func TestParseLogLine(t *testing.T) {
+	ts := time.Date(2020, time.January, 2, 3, 4, 5, 6e6, time.UTC)
+	for _, test := range []struct {
+		name     string
+		line     string
+		expected LogLine
+	}{
+		{
+			name:     "TimeAndPriority",
+			line:     "[2020/01/02 03:04:05.006] [P: 40] hello world\n",
+			expected: LogLine{Timestamp: ts, Priority: level.Info, Data: "hello world"},
+		},
+		{
+			name:     "PriorityAndTime",
+			line:     "[P:100] [2020/01/02 03:04:05.006] hello\r\n",
+			expected: LogLine{Timestamp: ts, Priority: level.Emergency, Data: "hello"},
+		},
+		{
+			name:     "DataWithPrefixes",
+			line:     "[P: 30] [P: 40] data",
+			expected: LogLine{Priority: level.Debug, Data: "[P: 40] data"},
+		},
+		{
+			name:     "EmptyData",
+			line:     "[2020/01/02 03:04:05.006] [P: 30] \n",
+			expected: LogLine{Timestamp: ts, Priority: level.Debug},
+		},
+		{
+			name:     "NoPrefix",
+			line:     "[P: x] hello",
+			expected: LogLine{Data: "[P: x] hello"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			actual := parseLogLine(test.line)
+			assert.True(t, test.expected.Timestamp.Equal(actual.Timestamp))
+			assert.Equal(t, test.expected.Priority, actual.Priority)
+			assert.Equal(t, test.expected.Data, actual.Data)
+		})
+	}
+}
@@ -0,0 +1,446 @@
+package buildlogger
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The local backend stores each log in its own directory, named after the log
+// ID, under the local directory:
+//
+//	<dir>/<log id>/meta.json
+//	<dir>/<log id>/<chunk key>.chunk
+//
+// The meta.json file holds the log metadata in the same JSON format as Cedar's
+// REST API, with an artifact type of "local" and one chunk per request of log
+// lines appended to the log, in order. Each chunk file holds the lines of a
+// single request, one per line, in the format:
+//
+//	<priority> <unix timestamp in nanoseconds> <length of data> <data>\n
+//
+// Since the length of the data is given, the data may contain new lines.
+const (
+	localMetaFile    = "meta.json"
+	localChunkSuffix = ".chunk"
+)
+
+// localClient is a buildlogger client that stores logs in a local directory
+// instead of sending them to Cedar.
+type localClient struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func newLocalClient(dir string) (*localClient, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "creating local log directory")
+	}
+
+	return &localClient{dir: dir}, nil
+}
+
+func (c *localClient) CreateLog(_ context.Context, in *gopb.LogData, _ ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := in.GetInfo()
+	log := &apiLog{
+		ID: localLogID(info, time.Now()),
+		Info: apiLogInfo{
+			Project:     info.GetProject(),
+			Version:     info.GetVersion(),
+			Variant:     info.GetVariant(),
+			TaskName:    info.GetTaskName(),
+			TaskID:      info.GetTaskId(),
+			Execution:   info.GetExecution(),
+			TestName:    info.GetTestName(),
+			Trial:       info.GetTrial(),
+			ProcessName: info.GetProcName(),
+			Format:      logFormatNames[LogFormat(info.GetFormat())],
+			Tags:        info.GetTags(),
+			Arguments:   info.GetArguments(),
+			Mainline:    info.GetMainline(),
+		},
+		CreatedAt: time.Now().UTC(),
+		Artifact:  apiLogArtifact{Type: logStorageNames[LogStorageLocal]},
+	}
+
+	if err := os.MkdirAll(filepath.Join(c.dir, log.ID), 0755); err != nil {
+		return nil, errors.Wrap(err, "creating log directory")
+	}
+	if err := writeLocalMeta(c.dir, log); err != nil {
+		return nil, err
+	}
+
+	return &gopb.BuildloggerResponse{LogId: log.ID}, nil
+}
+
+func (c *localClient) AppendLogLines(_ context.Context, in *gopb.LogLines, _ ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	log, err := readLocalMeta(c.dir, in.GetLogId())
+	if err != nil {
+		return nil, err
+	}
+	if log.CompletedAt != nil {
+		return nil, errors.Errorf("log '%s' is already closed", log.ID)
+	}
+	if len(in.GetLines()) == 0 {
+		return &gopb.BuildloggerResponse{LogId: log.ID}, nil
+	}
+
+	chunk := apiLogChunk{
+		Key:      fmt.Sprintf("%06d", len(log.Artifact.Chunks)),
+		NumLines: len(in.GetLines()),
+	}
+	var buf bytes.Buffer
+	for _, line := range in.GetLines() {
+		ts := line.GetTimestamp().AsTime()
+		if chunk.Start.IsZero() || ts.Before(chunk.Start) {
+			chunk.Start = ts
+		}
+		if ts.After(chunk.End) {
+			chunk.End = ts
+		}
+		writeLocalLine(&buf, line)
+	}
+
+	if err := writeFileAtomic(filepath.Join(c.dir, log.ID, chunk.Key+localChunkSuffix), buf.Bytes()); err != nil {
+		return nil, errors.Wrap(err, "writing log chunk")
+	}
+	log.Artifact.Chunks = append(log.Artifact.Chunks, chunk)
+	if err := writeLocalMeta(c.dir, log); err != nil {
+		return nil, err
+	}
+
+	return &gopb.BuildloggerResponse{LogId: log.ID}, nil
+}
+
+func (c *localClient) StreamLogLines(ctx context.Context, _ ...grpc.CallOption) (gopb.Buildlogger_StreamLogLinesClient, error) {
+	return &localStream{ctx: ctx, client: c}, nil
+}
+
+func (c *localClient) CloseLog(_ context.Context, in *gopb.LogEndInfo, _ ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	log, err := readLocalMeta(c.dir, in.GetLogId())
+	if err != nil {
+		return nil, err
+	}
+	if log.CompletedAt != nil {
+		return nil, errors.Errorf("log '%s' is already closed", log.ID)
+	}
+
+	completedAt := time.Now().UTC()
+	log.CompletedAt = &completedAt
+	log.Info.ExitCode = in.GetExitCode()
+	if err := writeLocalMeta(c.dir, log); err != nil {
+		return nil, err
+	}
+
+	return &gopb.BuildloggerResponse{LogId: log.ID}, nil
+}
+
+// localStream appends every request sent over the stream as its own chunk.
+type localStream struct {
+	grpc.ClientStream
+	ctx    context.Context
+	client *localClient
+	logID  string
+}
+
+func (s *localStream) Send(lines *gopb.LogLines) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	s.logID = lines.GetLogId()
+	_, err := s.client.AppendLogLines(s.ctx, lines)
+	return err
+}
+
+func (s *localStream) CloseAndRecv() (*gopb.BuildloggerResponse, error) {
+	return &gopb.BuildloggerResponse{LogId: s.logID}, nil
+}
+
+func (s *localStream) CloseSend() error         { return nil }
+func (s *localStream) Context() context.Context { return s.ctx }
+
+// localLogID returns a log ID derived from the log's information and creation
+// time.
+func localLogID(info *gopb.LogInfo, createdAt time.Time) string {
+	hash := sha1.New()
+	_, _ = fmt.Fprint(hash,
+		info.GetProject(),
+		info.GetVersion(),
+		info.GetVariant(),
+		info.GetTaskName(),
+		info.GetTaskId(),
+		info.GetExecution(),
+		info.GetTestName(),
+		info.GetTrial(),
+		info.GetProcName(),
+		createdAt.UnixNano(),
+	)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func readLocalMeta(dir, id string) (*apiLog, error) {
+	if id == "" || filepath.Base(id) != id {
+		return nil, errors.Errorf("invalid log id '%s'", id)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, id, localMetaFile))
+	if os.IsNotExist(err) {
+		return nil, errors.Errorf("log '%s' not found", id)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading metadata of log '%s'", id)
+	}
+
+	log := &apiLog{}
+	if err = json.Unmarshal(data, log); err != nil {
+		return nil, errors.Wrapf(err, "decoding metadata of log '%s'", id)
+	}
+
+	return log, nil
+}
+
+func writeLocalMeta(dir string, log *apiLog) error {
+	data, err := json.MarshalIndent(log, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "encoding metadata of log '%s'", log.ID)
+	}
+
+	return errors.Wrapf(writeFileAtomic(filepath.Join(dir, log.ID, localMetaFile), data), "writing metadata of log '%s'", log.ID)
+}
+
+// writeFileAtomic writes the file such that readers never see it partially
+// written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func writeLocalLine(w io.Writer, line *gopb.LogLine) {
+	_, _ = fmt.Fprintf(w, "%d %d %d ", line.GetPriority(), line.GetTimestamp().AsTime().UnixNano(), len(line.GetData()))
+	_, _ = w.Write(line.GetData())
+	_, _ = w.Write([]byte{'\n'})
+}
+
+func readLocalLines(path string) ([]*gopb.LogLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []*gopb.LogLine
+	r := bufio.NewReader(f)
+	for {
+		var fields [3]int64
+		for i := range fields {
+			field, err := r.ReadString(' ')
+			if err == io.EOF && i == 0 && field == "" {
+				return lines, nil
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "reading line %d", len(lines))
+			}
+			fields[i], err = strconv.ParseInt(field[:len(field)-1], 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing line %d", len(lines))
+			}
+		}
+		if fields[2] < 0 {
+			return nil, errors.Errorf("invalid data length for line %d", len(lines))
+		}
+
+		data := make([]byte, fields[2]+1)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, errors.Wrapf(err, "reading line %d", len(lines))
+		}
+		if data[len(data)-1] != '\n' {
+			return nil, errors.Errorf("missing new line at the end of line %d", len(lines))
+		}
+
+		lines = append(lines, &gopb.LogLine{
+			Priority:  int32(fields[0]),
+			Timestamp: timestamppb.New(time.Unix(0, fields[1])),
+			Data:      data[:len(data)-1],
+		})
+	}
+}
+
+// getLocal returns the logs or log metadata requested from the local
+// directory, formatted like Cedar's REST API responses.
+func getLocal(opts GetOptions) (io.ReadCloser, error) {
+	if opts.GroupID != "" {
+		return nil, errors.New("cannot request logs by group id from a local directory")
+	}
+
+	logs, err := findLocalLogs(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Meta {
+		var data []byte
+		if opts.ID != "" {
+			data, err = json.Marshal(logs[0])
+		} else {
+			data, err = json.Marshal(logs)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "encoding log metadata")
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	var lines []*gopb.LogLine
+	for _, log := range logs {
+		for _, chunk := range log.Artifact.Chunks {
+			chunkLines, err := readLocalLines(filepath.Join(opts.LocalDir, log.ID, chunk.Key+localChunkSuffix))
+			if err != nil {
+				return nil, errors.Wrapf(err, "reading chunk '%s' of log '%s'", chunk.Key, log.ID)
+			}
+			for _, line := range chunkLines {
+				ts := line.GetTimestamp().AsTime()
+				if ts.Before(opts.Start) || (!opts.End.IsZero() && ts.After(opts.End)) {
+					continue
+				}
+				lines = append(lines, line)
+			}
+		}
+	}
+	if len(logs) > 1 {
+		sort.SliceStable(lines, func(i, j int) bool {
+			return lines[i].GetTimestamp().AsTime().Before(lines[j].GetTimestamp().AsTime())
+		})
+	}
+	if opts.Tail > 0 && opts.Tail < len(lines) {
+		lines = lines[len(lines)-opts.Tail:]
+	}
+	if opts.Limit > 0 && opts.Limit < len(lines) {
+		lines = lines[:opts.Limit]
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if opts.PrintTime {
+			_, _ = fmt.Fprintf(&buf, "[%s] ", line.GetTimestamp().AsTime().Format(printTimeLayout))
+		}
+		if opts.PrintPriority {
+			_, _ = fmt.Fprintf(&buf, "[P: %3d] ", line.GetPriority())
+		}
+		buf.Write(line.GetData())
+		buf.WriteByte('\n')
+	}
+
+	return io.NopCloser(&buf), nil
+}
+
+// findLocalLogs returns the metadata of the requested logs, ordered by
+// creation time. When the execution is not specified, only the logs of the
+// latest execution are returned.
+func findLocalLogs(opts GetOptions) ([]*apiLog, error) {
+	if opts.ID != "" {
+		log, err := readLocalMeta(opts.LocalDir, opts.ID)
+		if err != nil {
+			return nil, err
+		}
+		return []*apiLog{log}, nil
+	}
+
+	entries, err := os.ReadDir(opts.LocalDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading local log directory")
+	}
+
+	var logs []*apiLog
+	latest := int32(-1)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		log, err := readLocalMeta(opts.LocalDir, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if !localLogMatches(log, opts) {
+			continue
+		}
+		if log.Info.Execution > latest {
+			latest = log.Info.Execution
+		}
+		logs = append(logs, log)
+	}
+	if opts.Execution == nil {
+		filtered := logs[:0]
+		for _, log := range logs {
+			if log.Info.Execution == latest {
+				filtered = append(filtered, log)
+			}
+		}
+		logs = filtered
+	}
+	if len(logs) == 0 {
+		return nil, errors.New("no matching logs found")
+	}
+
+	sort.SliceStable(logs, func(i, j int) bool { return logs[i].CreatedAt.Before(logs[j].CreatedAt) })
+
+	return logs, nil
+}
+
+func localLogMatches(log *apiLog, opts GetOptions) bool {
+	if log.Info.TaskID != opts.TaskID {
+		return false
+	}
+	if opts.TestName != "" && log.Info.TestName != opts.TestName {
+		return false
+	}
+	if opts.ProcessName != "" && log.Info.ProcessName != opts.ProcessName {
+		return false
+	}
+	if opts.Execution != nil && int(log.Info.Execution) != *opts.Execution {
+		return false
+	}
+	for _, tag := range opts.Tags {
+		found := false
+		for _, logTag := range log.Info.Tags {
+			if tag == logTag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
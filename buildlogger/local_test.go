@@ -0,0 +1,264 @@
+package buildlogger
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/evergreen-ci/timber"
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/mongodb/grip/send"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestLocalBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newLocalLogger := func(t *testing.T, dir string, procName string) (send.Sender, *LoggerOptions) {
+		opts := &LoggerOptions{
+			Project:     "project",
+			TaskID:      "task",
+			ProcessName: procName,
+			Format:      LogFormatText,
+			Tags:        []string{"tag"},
+			LocalDir:    dir,
+		}
+		s, err := NewLoggerWithContext(ctx, procName, send.LevelInfo{Default: level.Info, Threshold: level.Debug}, opts)
+		require.NoError(t, err)
+		return s, opts
+	}
+
+	t.Run("WritesReadableLogs", func(t *testing.T) {
+		dir := t.TempDir()
+		s, opts := newLocalLogger(t, dir, "mongod")
+		require.NotEmpty(t, opts.GetLogID())
+
+		s.Send(message.ConvertToComposer(level.Info, "first"))
+		s.Send(message.ConvertToComposer(level.Error, "second\nthird"))
+		require.NoError(t, s.Flush(ctx))
+		s.Send(message.ConvertToComposer(level.Info, "fourth"))
+		opts.SetExitCode(2)
+		require.NoError(t, s.Close())
+
+		assert.FileExists(t, filepath.Join(dir, opts.GetLogID(), localMetaFile))
+
+		getOpts := GetOptions{LocalDir: dir, ID: opts.GetLogID()}
+		meta, err := GetMeta(ctx, getOpts)
+		require.NoError(t, err)
+		require.Len(t, meta, 1)
+		assert.Equal(t, opts.GetLogID(), meta[0].ID)
+		assert.Equal(t, "project", meta[0].Project)
+		assert.Equal(t, "mongod", meta[0].ProcessName)
+		assert.Equal(t, LogFormatText, meta[0].Format)
+		assert.Equal(t, LogStorageLocal, meta[0].Storage)
+		assert.EqualValues(t, 2, meta[0].ExitCode)
+		assert.True(t, meta[0].Completed())
+		require.Len(t, meta[0].Chunks, 2)
+		assert.Equal(t, 3, meta[0].Chunks[0].NumLines)
+		assert.Equal(t, 1, meta[0].Chunks[1].NumLines)
+
+		var lines []LogLine
+		for line, err := range GetLines(ctx, getOpts) {
+			require.NoError(t, err)
+			lines = append(lines, line)
+		}
+		require.Len(t, lines, 4)
+		for i, data := range []string{"first", "second", "third", "fourth"} {
+			assert.Equal(t, data, lines[i].Data)
+			assert.False(t, lines[i].Timestamp.IsZero())
+		}
+		assert.Equal(t, level.Info, lines[0].Priority)
+		assert.Equal(t, level.Error, lines[1].Priority)
+
+		getOpts.Tail = 2
+		r, err := Get(ctx, getOpts)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, "third\nfourth\n", string(data))
+	})
+	t.Run("TaskLogs", func(t *testing.T) {
+		dir := t.TempDir()
+		s1, opts1 := newLocalLogger(t, dir, "mongod")
+		s2, opts2 := newLocalLogger(t, dir, "mongos")
+		s1.Send(message.ConvertToComposer(level.Info, "mongod"))
+		s2.Send(message.ConvertToComposer(level.Info, "mongos"))
+		require.NoError(t, s1.Close())
+		require.NoError(t, s2.Close())
+
+		meta, err := GetMeta(ctx, GetOptions{LocalDir: dir, TaskID: "task"})
+		require.NoError(t, err)
+		require.Len(t, meta, 2)
+		assert.Equal(t, opts1.GetLogID(), meta[0].ID)
+		assert.Equal(t, opts2.GetLogID(), meta[1].ID)
+
+		r, err := Get(ctx, GetOptions{LocalDir: dir, TaskID: "task"})
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, "mongod\nmongos\n", string(data))
+
+		r, err = Get(ctx, GetOptions{LocalDir: dir, TaskID: "task", ProcessName: "mongos"})
+		require.NoError(t, err)
+		data, err = io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, "mongos\n", string(data))
+
+		_, err = Get(ctx, GetOptions{LocalDir: dir, TaskID: "task", Tags: []string{"other"}})
+		assert.Error(t, err)
+		_, err = Get(ctx, GetOptions{LocalDir: dir, TaskID: "task", GroupID: "group"})
+		assert.Error(t, err)
+	})
+	t.Run("LatestExecution", func(t *testing.T) {
+		dir := t.TempDir()
+		client, err := newLocalClient(dir)
+		require.NoError(t, err)
+		for execution := int32(0); execution < 2; execution++ {
+			_, err = client.CreateLog(ctx, &gopb.LogData{Info: &gopb.LogInfo{TaskId: "task", Execution: execution}})
+			require.NoError(t, err)
+		}
+
+		meta, err := GetMeta(ctx, GetOptions{LocalDir: dir, TaskID: "task"})
+		require.NoError(t, err)
+		require.Len(t, meta, 1)
+		assert.EqualValues(t, 1, meta[0].Execution)
+
+		execution := 0
+		meta, err = GetMeta(ctx, GetOptions{LocalDir: dir, TaskID: "task", Execution: &execution})
+		require.NoError(t, err)
+		require.Len(t, meta, 1)
+		assert.EqualValues(t, 0, meta[0].Execution)
+	})
+	t.Run("Follow", func(t *testing.T) {
+		dir := t.TempDir()
+		s, opts := newLocalLogger(t, dir, "mongod")
+		s.Send(message.ConvertToComposer(level.Info, "first"))
+		require.NoError(t, s.Flush(ctx))
+
+		r, err := Get(ctx, GetOptions{LocalDir: dir, ID: opts.GetLogID(), Follow: true, PollInterval: 10 * time.Millisecond})
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, r.Close()) }()
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			s.Send(message.ConvertToComposer(level.Info, "second"))
+			assert.NoError(t, s.Close())
+		}()
+
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, "first\nsecond\n", string(data))
+	})
+	t.Run("Group", func(t *testing.T) {
+		dir := t.TempDir()
+		g, err := NewGroup(ctx, &LoggerOptions{TaskID: "task", LocalDir: dir})
+		require.NoError(t, err)
+		key := GroupKey{ProcessName: "mongod"}
+		s, err := g.Sender(key)
+		require.NoError(t, err)
+		s.Send(message.ConvertToComposer(level.Info, "line"))
+		id, err := g.GetLogID(key)
+		require.NoError(t, err)
+		require.NoError(t, g.Close())
+
+		meta, err := GetMeta(ctx, GetOptions{LocalDir: dir, ID: id})
+		require.NoError(t, err)
+		require.Len(t, meta, 1)
+		assert.Equal(t, "mongod", meta[0].ProcessName)
+		assert.True(t, meta[0].Completed())
+	})
+	t.Run("ClosedLog", func(t *testing.T) {
+		client, err := newLocalClient(t.TempDir())
+		require.NoError(t, err)
+		resp, err := client.CreateLog(ctx, &gopb.LogData{Info: &gopb.LogInfo{}})
+		require.NoError(t, err)
+		_, err = client.CloseLog(ctx, &gopb.LogEndInfo{LogId: resp.LogId})
+		require.NoError(t, err)
+
+		_, err = client.AppendLogLines(ctx, &gopb.LogLines{LogId: resp.LogId, Lines: []*gopb.LogLine{{Data: []byte("line")}}})
+		assert.Error(t, err)
+		_, err = client.CloseLog(ctx, &gopb.LogEndInfo{LogId: resp.LogId})
+		assert.Error(t, err)
+	})
+	t.Run("UnknownLog", func(t *testing.T) {
+		client, err := newLocalClient(t.TempDir())
+		require.NoError(t, err)
+		_, err = client.AppendLogLines(ctx, &gopb.LogLines{LogId: "unknown"})
+		assert.Error(t, err)
+		_, err = client.AppendLogLines(ctx, &gopb.LogLines{LogId: "../unknown"})
+		assert.Error(t, err)
+	})
+}
+
+func TestUseLocal(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		opts     LoggerOptions
+		expected bool
+	}{
+		{name: "NoConnection", opts: LoggerOptions{LocalDir: "dir"}, expected: true},
+		{name: "LocalStorage", opts: LoggerOptions{LocalDir: "dir", BaseAddress: "cedar", Storage: LogStorageLocal}, expected: true},
+		{name: "BaseAddress", opts: LoggerOptions{LocalDir: "dir", BaseAddress: "cedar"}},
+		{name: "NoDirectory", opts: LoggerOptions{Storage: LogStorageLocal}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.opts.useLocal())
+		})
+	}
+
+	t.Run("ValidateSkipsConnection", func(t *testing.T) {
+		opts := &LoggerOptions{LocalDir: "dir"}
+		assert.NoError(t, opts.validate())
+		opts = &LoggerOptions{LocalDir: "dir", BaseAddress: "cedar"}
+		assert.Error(t, opts.validate())
+	})
+	t.Run("GetSkipsCedar", func(t *testing.T) {
+		assert.NoError(t, GetOptions{LocalDir: "dir", ID: "id"}.Validate())
+		assert.Error(t, GetOptions{Cedar: timber.GetOptions{}, ID: "id"}.Validate())
+	})
+}
+
+func TestLocalLines(t *testing.T) {
+	ts := time.Date(2020, time.January, 2, 3, 4, 5, 6, time.UTC)
+	lines := []*gopb.LogLine{
+		{Priority: int32(level.Info), Timestamp: timestamppb.New(ts), Data: []byte("first")},
+		{Priority: int32(level.Error), Timestamp: timestamppb.New(ts.Add(time.Second)), Data: []byte("multi\nline ")},
+		{Priority: int32(level.Debug), Timestamp: timestamppb.New(ts), Data: []byte{}},
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		writeLocalLine(&buf, line)
+	}
+	path := filepath.Join(t.TempDir(), "chunk")
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
+
+	actual, err := readLocalLines(path)
+	require.NoError(t, err)
+	require.Len(t, actual, len(lines))
+	for i := range lines {
+		assert.Equal(t, lines[i].Priority, actual[i].Priority)
+		assert.True(t, lines[i].Timestamp.AsTime().Equal(actual[i].Timestamp.AsTime()))
+		assert.Equal(t, string(lines[i].Data), string(actual[i].Data))
+	}
+
+	t.Run("Truncated", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, buf.Bytes()[:buf.Len()-3], 0644))
+		_, err := readLocalLines(path)
+		assert.Error(t, err)
+	})
+	t.Run("Malformed", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte("40 x 4 line\n"), 0644))
+		_, err := readLocalLines(path)
+		assert.Error(t, err)
+	})
+}
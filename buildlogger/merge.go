@@ -0,0 +1,163 @@
+package buildlogger
+
+import (
+	"container/heap"
+	"context"
+	"iter"
+
+	"github.com/mongodb/grip"
+	"github.com/pkg/errors"
+)
+
+// mergeBufferSize is the number of lines fetched ahead of the merge for each
+// log.
+const mergeBufferSize = 1000
+
+// MergeOptions specify the logs to merge with GetMerged.
+type MergeOptions struct {
+	// The options used to fetch every log, such as the Cedar options and
+	// the time range. The ID and ProcessName are set for each log.
+	Get GetOptions
+
+	// The IDs of the logs to merge.
+	LogIDs []string
+	// The process names of the logs to merge, which are fetched by the
+	// task ID of the get options.
+	ProcessNames []string
+}
+
+// Validate ensures MergeOptions is configured correctly.
+func (opts MergeOptions) Validate() error {
+	catcher := grip.NewBasicCatcher()
+
+	catcher.AddWhen(len(opts.LogIDs) == 0 && len(opts.ProcessNames) == 0, errors.New("must provide log ids or process names to merge"))
+	catcher.AddWhen(len(opts.LogIDs) > 0 && len(opts.ProcessNames) > 0, errors.New("cannot provide both log ids and process names"))
+	catcher.AddWhen(len(opts.LogIDs) > 0 && (opts.Get.ID != "" || opts.Get.TaskID != ""), errors.New("cannot provide an id or task id when merging logs by id"))
+	catcher.AddWhen(len(opts.ProcessNames) > 0 && opts.Get.TaskID == "", errors.New("must provide a task id when merging logs by process name"))
+	catcher.AddWhen(opts.Get.Meta, errors.New("cannot merge log metadata"))
+	catcher.AddWhen(opts.Get.Follow, errors.New("cannot follow merged logs"))
+
+	return catcher.Resolve()
+}
+
+// sources returns the name and get options of each log to merge.
+func (opts MergeOptions) sources() ([]string, []GetOptions) {
+	var names []string
+	var getOpts []GetOptions
+	for _, id := range opts.LogIDs {
+		logOpts := opts.Get
+		logOpts.ID = id
+		names = append(names, id)
+		getOpts = append(getOpts, logOpts)
+	}
+	for _, procName := range opts.ProcessNames {
+		logOpts := opts.Get
+		logOpts.ProcessName = procName
+		names = append(names, procName)
+		getOpts = append(getOpts, logOpts)
+	}
+
+	return names, getOpts
+}
+
+// MergedLine is a log line fetched by GetMerged, tagged with the log it came
+// from: its ID or process name, depending on how the logs were requested.
+type MergedLine struct {
+	LogLine
+	Log string
+}
+
+// GetMerged returns an iterator over the lines of several logs, fetched
+// concurrently via HTTP to a Cedar service, merged in timestamp order. Lines
+// with the same timestamp are ordered by the order in which their logs were
+// given. Iteration stops after yielding the first error, if any.
+func GetMerged(ctx context.Context, opts MergeOptions) iter.Seq2[MergedLine, error] {
+	return func(yield func(MergedLine, error) bool) {
+		if err := opts.Validate(); err != nil {
+			yield(MergedLine{}, errors.Wrap(err, "invalid merge options"))
+			return
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		names, getOpts := opts.sources()
+		sources := make([]chan mergeItem, len(getOpts))
+		for i := range getOpts {
+			sources[i] = make(chan mergeItem, mergeBufferSize)
+			go fetchMergeSource(ctx, getOpts[i], sources[i])
+		}
+
+		h := &mergeHeap{}
+		next := func(i int) bool {
+			item, ok := <-sources[i]
+			if !ok {
+				return true
+			}
+			if item.err != nil {
+				yield(MergedLine{}, errors.Wrapf(item.err, "fetching log '%s'", names[i]))
+				return false
+			}
+			item.source = i
+			heap.Push(h, item)
+			return true
+		}
+
+		for i := range sources {
+			if !next(i) {
+				return
+			}
+		}
+		for h.Len() > 0 {
+			item := heap.Pop(h).(mergeItem)
+			if !yield(MergedLine{LogLine: item.line, Log: names[item.source]}, nil) {
+				return
+			}
+			if !next(item.source) {
+				return
+			}
+		}
+	}
+}
+
+func fetchMergeSource(ctx context.Context, opts GetOptions, out chan<- mergeItem) {
+	defer close(out)
+
+	for line, err := range GetLines(ctx, opts) {
+		select {
+		case out <- mergeItem{line: line, err: err}:
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+type mergeItem struct {
+	line   LogLine
+	err    error
+	source int
+}
+
+// mergeHeap holds the next line of each log, ordered by timestamp and then by
+// log.
+type mergeHeap []mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].line.Timestamp.Equal(h[j].line.Timestamp) {
+		return h[i].source < h[j].source
+	}
+	return h[i].line.Timestamp.Before(h[j].line.Timestamp)
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeItem)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return item
+}
@@ -0,0 +1,122 @@
+package buildlogger
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/timber"
+	"github.com/mongodb/grip/level"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetMerged(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := time.Date(2020, time.January, 2, 3, 4, 5, 0, time.UTC)
+	// The lines of each log, by the offset of their timestamps in
+	// seconds.
+	logs := map[string][]int{
+		"mongod": {0, 2, 2, 5},
+		"mongos": {1, 2, 3},
+		"empty":  {},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("proc_name")
+		if name == "" {
+			name = path.Base(r.URL.Path)
+		}
+		offsets, ok := logs[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for i, offset := range offsets {
+			_, _ = fmt.Fprintf(w, "[%s] [P: 40] %s %d\n", ts.Add(time.Duration(offset)*time.Second).Format(printTimeLayout), name, i)
+		}
+	}))
+	defer server.Close()
+
+	collect := func(t *testing.T, opts MergeOptions) []string {
+		var lines []string
+		for line, err := range GetMerged(ctx, opts) {
+			require.NoError(t, err)
+			assert.Equal(t, level.Info, line.Priority)
+			lines = append(lines, fmt.Sprintf("%s: %s", line.Log, line.Data))
+		}
+		return lines
+	}
+	expected := []string{
+		"mongod: mongod 0",
+		"mongos: mongos 0",
+		"mongod: mongod 1",
+		"mongod: mongod 2",
+		"mongos: mongos 1",
+		"mongos: mongos 2",
+		"mongod: mongod 3",
+	}
+
+	t.Run("LogIDs", func(t *testing.T) {
+		assert.Equal(t, expected, collect(t, MergeOptions{
+			Get:    GetOptions{Cedar: timber.GetOptions{BaseURL: server.URL}},
+			LogIDs: []string{"mongod", "empty", "mongos"},
+		}))
+	})
+	t.Run("ProcessNames", func(t *testing.T) {
+		assert.Equal(t, expected, collect(t, MergeOptions{
+			Get:          GetOptions{Cedar: timber.GetOptions{BaseURL: server.URL}, TaskID: "task"},
+			ProcessNames: []string{"mongod", "mongos"},
+		}))
+	})
+	t.Run("Break", func(t *testing.T) {
+		count := 0
+		for _, err := range GetMerged(ctx, MergeOptions{
+			Get:    GetOptions{Cedar: timber.GetOptions{BaseURL: server.URL}},
+			LogIDs: []string{"mongod", "mongos"},
+		}) {
+			require.NoError(t, err)
+			count++
+			if count == 2 {
+				break
+			}
+		}
+		assert.Equal(t, 2, count)
+	})
+	t.Run("FetchError", func(t *testing.T) {
+		var errs []error
+		for _, err := range GetMerged(ctx, MergeOptions{
+			Get:    GetOptions{Cedar: timber.GetOptions{BaseURL: server.URL}},
+			LogIDs: []string{"mongod", "missing"},
+		}) {
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		require.Len(t, errs, 1)
+		assert.Contains(t, errs[0].Error(), "missing")
+	})
+	t.Run("InvalidOptions", func(t *testing.T) {
+		cedar := timber.GetOptions{BaseURL: server.URL}
+		for name, opts := range map[string]MergeOptions{
+			"NoLogs":                {Get: GetOptions{Cedar: cedar}},
+			"LogIDsAndProcessNames": {Get: GetOptions{Cedar: cedar, TaskID: "task"}, LogIDs: []string{"a"}, ProcessNames: []string{"b"}},
+			"LogIDsAndTaskID":       {Get: GetOptions{Cedar: cedar, TaskID: "task"}, LogIDs: []string{"a"}},
+			"ProcessNamesAndNoTask": {Get: GetOptions{Cedar: cedar}, ProcessNames: []string{"b"}},
+			"Meta":                  {Get: GetOptions{Cedar: cedar, Meta: true}, LogIDs: []string{"a"}},
+			"Follow":                {Get: GetOptions{Cedar: cedar, Follow: true}, LogIDs: []string{"a"}},
+		} {
+			t.Run(name, func(t *testing.T) {
+				assert.Error(t, opts.Validate())
+				for _, err := range GetMerged(ctx, opts) {
+					assert.Error(t, err)
+				}
+			})
+		}
+	})
+}
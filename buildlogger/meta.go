@@ -0,0 +1,206 @@
+package buildlogger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LogMetadata describes a buildlogger log stored in Cedar.
+type LogMetadata struct {
+	ID string
+
+	// Information identifying the log, as set when it was created.
+	Project     string
+	Version     string
+	Variant     string
+	TaskName    string
+	TaskID      string
+	Execution   int32
+	TestName    string
+	Trial       int32
+	ProcessName string
+	Format      LogFormat
+	Tags        []string
+	Arguments   map[string]string
+	Mainline    bool
+
+	// The exit code set when the log was closed.
+	ExitCode int32
+
+	Storage     LogStorage
+	CreatedAt   time.Time
+	CompletedAt time.Time
+	Chunks      []LogChunkInfo
+}
+
+// Completed returns whether the log has been closed.
+func (m LogMetadata) Completed() bool { return !m.CompletedAt.IsZero() }
+
+// LogChunkInfo describes a chunk of log lines stored in the blob storage of a
+// buildlogger log.
+type LogChunkInfo struct {
+	Key      string
+	NumLines int
+	Start    time.Time
+	End      time.Time
+}
+
+// apiLog is Cedar's REST representation of the metadata of a buildlogger log.
+type apiLog struct {
+	ID          string         `json:"id"`
+	Info        apiLogInfo     `json:"info"`
+	CreatedAt   time.Time      `json:"created_at"`
+	CompletedAt *time.Time     `json:"completed_at"`
+	Artifact    apiLogArtifact `json:"artifact"`
+}
+
+type apiLogInfo struct {
+	Project     string            `json:"project"`
+	Version     string            `json:"version"`
+	Variant     string            `json:"variant"`
+	TaskName    string            `json:"task_name"`
+	TaskID      string            `json:"task_id"`
+	Execution   int32             `json:"execution"`
+	TestName    string            `json:"test_name"`
+	Trial       int32             `json:"trial"`
+	ProcessName string            `json:"proc_name"`
+	Format      string            `json:"format"`
+	Tags        []string          `json:"tags"`
+	Arguments   map[string]string `json:"args"`
+	ExitCode    int32             `json:"exit_code"`
+	Mainline    bool              `json:"mainline"`
+}
+
+type apiLogArtifact struct {
+	Type   string        `json:"type"`
+	Chunks []apiLogChunk `json:"chunks"`
+}
+
+type apiLogChunk struct {
+	Key      string    `json:"key"`
+	NumLines int       `json:"num_lines"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+}
+
+// logFormatNames and logStorageNames are the names Cedar uses for the log
+// formats and storage types.
+var (
+	logFormatNames = map[LogFormat]string{
+		LogFormatUnknown: "unknown",
+		LogFormatText:    "text",
+		LogFormatJSON:    "json",
+		LogFormatBSON:    "bson",
+	}
+	logStorageNames = map[LogStorage]string{
+		LogStorageS3:     "s3",
+		LogStorageGridFS: "gridfs",
+		LogStorageLocal:  "local",
+	}
+)
+
+func (l *apiLog) export() (LogMetadata, error) {
+	m := LogMetadata{
+		ID:          l.ID,
+		Project:     l.Info.Project,
+		Version:     l.Info.Version,
+		Variant:     l.Info.Variant,
+		TaskName:    l.Info.TaskName,
+		TaskID:      l.Info.TaskID,
+		Execution:   l.Info.Execution,
+		TestName:    l.Info.TestName,
+		Trial:       l.Info.Trial,
+		ProcessName: l.Info.ProcessName,
+		Tags:        l.Info.Tags,
+		Arguments:   l.Info.Arguments,
+		Mainline:    l.Info.Mainline,
+		ExitCode:    l.Info.ExitCode,
+		CreatedAt:   l.CreatedAt,
+	}
+	if l.CompletedAt != nil {
+		m.CompletedAt = *l.CompletedAt
+	}
+
+	for format, name := range logFormatNames {
+		if l.Info.Format == name {
+			m.Format = format
+		}
+	}
+
+	storageFound := false
+	for storage, name := range logStorageNames {
+		if l.Artifact.Type == name {
+			m.Storage = storage
+			storageFound = true
+		}
+	}
+	if !storageFound {
+		return LogMetadata{}, errors.Errorf("unrecognized storage type '%s' for log '%s'", l.Artifact.Type, l.ID)
+	}
+
+	for _, chunk := range l.Artifact.Chunks {
+		m.Chunks = append(m.Chunks, LogChunkInfo{
+			Key:      chunk.Key,
+			NumLines: chunk.NumLines,
+			Start:    chunk.Start,
+			End:      chunk.End,
+		})
+	}
+
+	return m, nil
+}
+
+// GetMeta returns the metadata of the logs requested via HTTP to a Cedar
+// service: a single log when requesting a log by ID, or every matching log of
+// a task or test otherwise.
+func GetMeta(ctx context.Context, opts GetOptions) ([]LogMetadata, error) {
+	if opts.Follow {
+		return nil, errors.New("cannot follow log metadata")
+	}
+	opts.Meta = true
+
+	r, err := Get(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return decodeLogMetadata(r)
+}
+
+// decodeLogMetadata decodes the metadata of either a single log or an array of
+// logs.
+func decodeLogMetadata(r io.Reader) ([]LogMetadata, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading log metadata")
+	}
+
+	var logs []apiLog
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		err = json.Unmarshal(data, &logs)
+	} else {
+		logs = make([]apiLog, 1)
+		err = json.Unmarshal(data, &logs[0])
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding log metadata")
+	}
+
+	meta := make([]LogMetadata, 0, len(logs))
+	for i := range logs {
+		m, err := logs[i].export()
+		if err != nil {
+			return nil, err
+		}
+		meta = append(meta, m)
+	}
+
+	return meta, nil
+}
@@ -0,0 +1,149 @@
+package buildlogger
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/timber"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testLogMetadata = `{
+	"id": "log0",
+	"info": {
+		"project": "project",
+		"version": "version",
+		"variant": "variant",
+		"task_name": "task_name",
+		"task_id": "task",
+		"execution": 1,
+		"test_name": "test",
+		"trial": 2,
+		"proc_name": "mongod",
+		"format": "json",
+		"tags": ["tag"],
+		"args": {"arg": "value"},
+		"exit_code": 3,
+		"mainline": true
+	},
+	"created_at": "2020-01-02T03:04:05.000Z",
+	"completed_at": "2020-01-02T04:04:05.000Z",
+	"artifact": {
+		"type": "gridfs",
+		"prefix": "log0",
+		"version": 1,
+		"chunks": [
+			{"key": "chunk0", "num_lines": 10, "start": "2020-01-02T03:04:05.000Z", "end": "2020-01-02T03:14:05.000Z"}
+		]
+	}
+}`
+
+func TestGetMeta(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		if strings.Contains(r.URL.Path, "/task_id/") {
+			_, _ = w.Write([]byte(`[` + testLogMetadata + `, {"id": "log1", "info": {"format": "text"}, "created_at": "2020-01-02T03:04:05.000Z", "completed_at": null, "artifact": {"type": "s3"}}]`))
+			return
+		}
+		_, _ = w.Write([]byte(testLogMetadata))
+	}))
+	defer server.Close()
+
+	created := time.Date(2020, time.January, 2, 3, 4, 5, 0, time.UTC)
+
+	t.Run("ID", func(t *testing.T) {
+		meta, err := GetMeta(ctx, GetOptions{
+			Cedar: timber.GetOptions{BaseURL: server.URL},
+			ID:    "log0",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "/rest/v1/buildlogger/log0/meta", path)
+		require.Len(t, meta, 1)
+
+		m := meta[0]
+		assert.Equal(t, "log0", m.ID)
+		assert.Equal(t, "project", m.Project)
+		assert.Equal(t, "version", m.Version)
+		assert.Equal(t, "variant", m.Variant)
+		assert.Equal(t, "task_name", m.TaskName)
+		assert.Equal(t, "task", m.TaskID)
+		assert.EqualValues(t, 1, m.Execution)
+		assert.Equal(t, "test", m.TestName)
+		assert.EqualValues(t, 2, m.Trial)
+		assert.Equal(t, "mongod", m.ProcessName)
+		assert.Equal(t, LogFormatJSON, m.Format)
+		assert.Equal(t, []string{"tag"}, m.Tags)
+		assert.Equal(t, map[string]string{"arg": "value"}, m.Arguments)
+		assert.True(t, m.Mainline)
+		assert.EqualValues(t, 3, m.ExitCode)
+		assert.Equal(t, LogStorageGridFS, m.Storage)
+		assert.True(t, created.Equal(m.CreatedAt))
+		assert.True(t, created.Add(time.Hour).Equal(m.CompletedAt))
+		assert.True(t, m.Completed())
+		require.Len(t, m.Chunks, 1)
+		assert.Equal(t, "chunk0", m.Chunks[0].Key)
+		assert.Equal(t, 10, m.Chunks[0].NumLines)
+		assert.True(t, created.Equal(m.Chunks[0].Start))
+		assert.True(t, created.Add(10*time.Minute).Equal(m.Chunks[0].End))
+	})
+	t.Run("TaskID", func(t *testing.T) {
+		meta, err := GetMeta(ctx, GetOptions{
+			Cedar:  timber.GetOptions{BaseURL: server.URL},
+			TaskID: "task",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "/rest/v1/buildlogger/task_id/task/meta", path)
+		require.Len(t, meta, 2)
+		assert.Equal(t, "log0", meta[0].ID)
+		assert.Equal(t, "log1", meta[1].ID)
+		assert.Equal(t, LogFormatText, meta[1].Format)
+		assert.Equal(t, LogStorageS3, meta[1].Storage)
+		assert.False(t, meta[1].Completed())
+	})
+	t.Run("InvalidOptions", func(t *testing.T) {
+		_, err := GetMeta(ctx, GetOptions{
+			Cedar:  timber.GetOptions{BaseURL: server.URL},
+			ID:     "log0",
+			Follow: true,
+		})
+		assert.Error(t, err)
+		_, err = GetMeta(ctx, GetOptions{
+			Cedar:   timber.GetOptions{BaseURL: server.URL},
+			TaskID:  "task",
+			GroupID: "group",
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestDecodeLogMetadata(t *testing.T) {
+	t.Run("UnknownStorage", func(t *testing.T) {
+		_, err := decodeLogMetadata(strings.NewReader(`{"id": "log", "artifact": {"type": "tape"}}`))
+		assert.Error(t, err)
+	})
+	t.Run("UnknownFormat", func(t *testing.T) {
+		meta, err := decodeLogMetadata(strings.NewReader(`{"id": "log", "info": {"format": "xml"}, "artifact": {"type": "local"}}`))
+		require.NoError(t, err)
+		require.Len(t, meta, 1)
+		assert.Equal(t, LogFormatUnknown, meta[0].Format)
+		assert.Equal(t, LogStorageLocal, meta[0].Storage)
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := decodeLogMetadata(strings.NewReader(`{"id": `))
+		assert.Error(t, err)
+	})
+	t.Run("Empty", func(t *testing.T) {
+		meta, err := decodeLogMetadata(strings.NewReader(`[]`))
+		require.NoError(t, err)
+		assert.Empty(t, meta)
+	})
+}
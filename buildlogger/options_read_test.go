@@ -11,6 +11,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"google.golang.org/grpc/codes"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -38,10 +39,25 @@ func TestLoadLoggerOptions(t *testing.T) {
 		Storage: LogStorageS3,
 
 		MaxBufferSize: 1024,
+		MaxRPCSize:    512,
 		FlushInterval: time.Minute,
 
+		MonotonicTimestamps: true,
 		DisableNewLineCheck: true,
 
+		SpoolDir: "spool",
+		Retry: RetryOptions{
+			MaxAttempts:    5,
+			BaseBackoff:    time.Second,
+			MaxBackoff:     time.Minute,
+			RetryableCodes: []codes.Code{codes.Unavailable, codes.Internal},
+		},
+		Redact: RedactOptions{
+			Values:      []string{"secret"},
+			Patterns:    []string{`token=\S+`},
+			Replacement: "***",
+		},
+
 		BaseAddress: "cedar.mongodb.com",
 		RPCPort:     "8080",
 		Insecure:    false,
@@ -0,0 +1,629 @@
+package buildlogger
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/mongodb/grip/level"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// logLinesLinesField is the protobuf field number of gopb.LogLines.Lines.
+const logLinesLinesField = 2
+
+// OverflowPolicy describes what the Buildlogger Sender does with new log
+// lines when its queue of unsent log lines is full.
+type OverflowPolicy string
+
+// Valid OverflowPolicy values.
+const (
+	// OverflowBlock blocks Send until there is room in the queue.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropOldest drops the oldest queued log lines to make room
+	// for new ones.
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// OverflowDropNewest drops new log lines until there is room in the
+	// queue.
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+	// OverflowSpill moves the queued log lines to the spool directory to
+	// make room for new ones.
+	OverflowSpill OverflowPolicy = "spill"
+)
+
+func (p OverflowPolicy) validate() error {
+	switch p {
+	case "", OverflowBlock, OverflowDropOldest, OverflowDropNewest, OverflowSpill:
+		return nil
+	default:
+		return errors.Errorf("invalid overflow policy '%s' specified", p)
+	}
+}
+
+// batch is a sealed set of buffered log lines that are sent together. Batches
+// are numbered in the order they are sealed, which is the order in which they
+// must be delivered.
+type batch struct {
+	seq   uint64
+	logID string
+	lines []*gopb.LogLine
+	size  int
+	// writer is the ID of the sender that sealed the batch and first is
+	// the sequence number of the first unsent line, see withSequence.
+	writer string
+	first  uint64
+	// persisted is set while the spool holds exactly the batch's unsent
+	// lines, so that they need not be spooled again.
+	persisted bool
+}
+
+func (b *batch) export() *gopb.LogLines {
+	lines := &gopb.LogLines{
+		LogId: b.logID,
+		Lines: b.lines,
+	}
+	setSpoolSequence(lines, b.writer, b.first)
+
+	return lines
+}
+
+// seal moves the buffered log lines into a new batch at the end of the queue,
+// writing the batch ahead to the spool, if there is one, until it is
+// acknowledged. It must be called with the lock held.
+func (b *buildlogger) seal() {
+	if len(b.buffer) == 0 {
+		return
+	}
+
+	b.seq++
+	sealed := &batch{
+		seq:    b.seq,
+		logID:  b.opts.GetLogID(),
+		lines:  b.buffer,
+		size:   b.bufferSize,
+		writer: b.writer,
+		first:  b.lineSeq,
+	}
+	if b.spool != nil {
+		// A batch that cannot be written ahead is still spooled if it
+		// cannot be sent.
+		if err := b.spool.write(sealed.seq, sealed.export()); err != nil {
+			b.logLocal(level.Error, errors.Wrap(err, "writing log lines ahead to spool"))
+		} else {
+			sealed.persisted = true
+		}
+	}
+	b.queue = append(b.queue, sealed)
+	b.lineSeq += uint64(len(b.buffer))
+	b.queueSize += b.bufferSize
+	b.buffer = []*gopb.LogLine{}
+	b.bufferSize = 0
+}
+
+// signal wakes up the background flusher without waiting for it.
+func (b *buildlogger) signal() {
+	select {
+	case b.flusher.signal <- struct{}{}:
+	default:
+	}
+}
+
+// reserve makes room in the memory budget for a log line of the given size
+// according to the overflow policy, returning false if the line should not be
+// buffered. It must be called with the lock held and may release the lock
+// while blocking.
+func (b *buildlogger) reserve(size int) bool {
+	if b.budget.fits(size) {
+		return true
+	}
+
+	// Make sure the flusher can make progress on everything buffered so
+	// far, regardless of the policy.
+	b.seal()
+	b.signal()
+
+	policy := b.opts.OverflowPolicy
+	if b.degraded && b.spool == nil && (policy == "" || policy == OverflowBlock) {
+		// Nothing leaves the queue while the log has not been created,
+		// so blocking would block Send until the sender is closed.
+		policy = OverflowDropOldest
+	}
+
+	switch policy {
+	case OverflowDropNewest:
+		b.dropped.lines++
+		b.dropped.bytes += size
+		return false
+	case OverflowDropOldest:
+		for len(b.queue) > 0 && !b.budget.fits(size) {
+			b.dropped.addBatch(b.queue[0])
+			if dropped := b.dequeue(); dropped.persisted {
+				if err := b.spool.remove(dropped.seq); err != nil {
+					b.logLocal(level.Error, err)
+				}
+			}
+		}
+		return true
+	case OverflowSpill:
+		if err := b.spillQueue(); err != nil {
+			b.logLocal(level.Error, err)
+			b.dropped.lines++
+			b.dropped.bytes += size
+			return false
+		}
+		return true
+	default:
+		for !b.closed {
+			fits, generation := b.budget.check(size)
+			if fits || b.budget.inUse() == 0 {
+				break
+			}
+
+			b.mu.Unlock()
+			b.budget.wait(generation)
+			b.mu.Lock()
+		}
+		return !b.closed
+	}
+}
+
+// dequeue removes the batch at the front of the queue, releasing its memory.
+// It must be called with the lock held.
+func (b *buildlogger) dequeue() *batch {
+	next := b.queue[0]
+	b.queue = b.queue[1:]
+	b.queueSize -= next.size
+	b.budget.release(next.size)
+
+	return next
+}
+
+// requeue puts the batch back at the front of the queue. It must be called
+// with the lock held.
+func (b *buildlogger) requeue(failed *batch) {
+	b.queue = append([]*batch{failed}, b.queue...)
+	b.queueSize += failed.size
+	b.budget.acquire(failed.size)
+}
+
+// spillQueue moves all queued batches to the spool, writing those not already
+// written ahead. It must be called with the lock held.
+func (b *buildlogger) spillQueue() error {
+	for len(b.queue) > 0 {
+		next := b.queue[0]
+		if !next.persisted {
+			if err := b.spool.write(next.seq, next.export()); err != nil {
+				return errors.Wrap(err, "spilling queued log lines")
+			}
+		}
+		b.dequeue()
+	}
+
+	return nil
+}
+
+// drain sends all spooled and queued batches in sequence order, stopping at
+// the first batch that cannot be sent. Only one drain runs at a time, and the
+// lock is never held during an RPC, so Send does not wait on the network.
+func (b *buildlogger) drain(ctx context.Context) error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	if b.drained {
+		return nil
+	}
+
+	return b.drainLocked(ctx)
+}
+
+// drainLocked is drain with the flush lock held.
+func (b *buildlogger) drainLocked(ctx context.Context) error {
+	if err := b.holdDegraded(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	attempted := false
+	defer func() {
+		if attempted {
+			b.stats.recordFlush(time.Since(start))
+		}
+	}()
+
+	for {
+		next, spooled, err := b.nextBatch()
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			if b.streamFull() {
+				if err = b.ackStream(ctx); err != nil {
+					return b.handleFailedStream(ctx, err)
+				}
+			}
+			return nil
+		}
+		attempted = true
+
+		if err = b.sendBatch(ctx, next); err != nil {
+			b.unstream(next)
+			return b.handleFailedBatch(ctx, next, spooled, err)
+		}
+
+		if spooled {
+			// Spooled lines are kept until the server acknowledges
+			// them.
+			if err = b.ackStream(ctx); err != nil {
+				b.unstream(next)
+				return b.handleFailedBatch(ctx, next, spooled, err)
+			}
+		}
+		if b.spool != nil && !b.opts.Stream {
+			// Streamed lines are removed from the spool once the
+			// stream is acknowledged, see ackStream.
+			if err = b.spool.remove(next.seq); err != nil {
+				return err
+			}
+		}
+
+		b.mu.Lock()
+		b.lastFlush = time.Now()
+		b.mu.Unlock()
+	}
+}
+
+// nextBatch returns the batch with the lowest sequence number, from either
+// the spool or the queue, and whether it came from the spool. A batch from
+// the queue is removed from the queue while it is in flight, and spooled
+// batches already streamed are skipped until they are acknowledged. A batch
+// written ahead to the spool is taken from the queue.
+func (b *buildlogger) nextBatch() (*batch, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var streamed uint64
+	if n := len(b.streamed); n > 0 {
+		streamed = b.streamed[n-1].seq
+	}
+	spooledSeq, ok := b.spool.firstAfter(streamed)
+	if ok && (len(b.queue) == 0 || spooledSeq < b.queue[0].seq) {
+		lines, err := b.spool.read(spooledSeq)
+		if err != nil {
+			return nil, false, errors.Wrap(err, "reading spool")
+		}
+		if lines.LogId == "" {
+			lines.LogId = b.opts.GetLogID()
+		}
+		spooled := &batch{seq: spooledSeq, logID: lines.LogId, lines: lines.Lines, persisted: true}
+		spooled.writer, spooled.first = spoolSequence(lines)
+		for _, line := range spooled.lines {
+			spooled.size += len(line.Data)
+		}
+		return spooled, true, nil
+	}
+
+	if len(b.queue) == 0 {
+		return nil, false, nil
+	}
+
+	return b.dequeue(), false, nil
+}
+
+// sendBatch sends the batch in as many requests as needed to keep each one
+// within the max RPC size, rolling over the sender's log as needed. Lines are
+// removed from the batch as they are sent, so a batch that fails part way
+// through only resends the remainder.
+func (b *buildlogger) sendBatch(ctx context.Context, next *batch) error {
+	for len(next.lines) > 0 {
+		logID, own := b.addressee(next.logID)
+		n := rpcLines(logID, next.lines, b.opts.MaxRPCSize)
+		if own {
+			if n = b.rolloverLimit(next.lines[:n]); n == 0 {
+				if err := b.rollover(ctx); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		lines := &gopb.LogLines{LogId: logID, Lines: next.lines[:n]}
+		if b.opts.Stream {
+			if err := b.streamLines(ctx, next, lines); err != nil {
+				return err
+			}
+		} else if err := b.appendLines(withSequence(ctx, next.writer, next.first), lines); err != nil {
+			return err
+		}
+		if own {
+			b.recordSent(next.lines[:n])
+		}
+		sent := 0
+		for _, line := range next.lines[:n] {
+			sent += len(line.Data)
+		}
+		if !b.opts.Stream {
+			b.stats.recordSent(n, sent)
+		}
+		next.size -= sent
+		next.lines = next.lines[n:]
+		next.first += uint64(n)
+		next.persisted = false
+	}
+
+	return nil
+}
+
+// rpcLines returns how many of the given lines, and always at least one, fit
+// in a single request of at most maxSize serialized bytes. A maxSize of 0 or
+// less means there is no limit.
+func rpcLines(logID string, lines []*gopb.LogLine, maxSize int) int {
+	if maxSize <= 0 {
+		return len(lines)
+	}
+
+	size := proto.Size(&gopb.LogLines{LogId: logID})
+	for i, line := range lines {
+		size += protowire.SizeTag(logLinesLinesField) + protowire.SizeBytes(proto.Size(line))
+		if size > maxSize && i > 0 {
+			return i
+		}
+	}
+
+	return len(lines)
+}
+
+// handleFailedBatch decides the fate of a batch that could not be sent with the
+// given context. With a spool, the batch and everything queued behind it are
+// spooled. Otherwise the batch is dropped when a retry policy is configured,
+// since its attempts are exhausted or the error is not retryable, or put back
+// at the front of the queue for the next flush. A batch whose attempts were
+// cut short because the context is done is never dropped.
+func (b *buildlogger) handleFailedBatch(ctx context.Context, failed *batch, spooled bool, err error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.spool != nil:
+		if !failed.persisted {
+			if spoolErr := b.spool.write(failed.seq, failed.export()); spoolErr != nil {
+				if !spooled {
+					b.requeue(failed)
+				}
+				return errors.Wrapf(spoolErr, "spooling log lines after send error '%s'", err)
+			}
+		}
+		if spillErr := b.spillQueue(); spillErr != nil {
+			return errors.Wrapf(spillErr, "spooling log lines after send error '%s'", err)
+		}
+		return errors.Wrap(err, "sending log lines, spooled for replay")
+	case b.opts.Retry.enabled() && ctx.Err() == nil:
+		b.dropped.addBatch(failed)
+		return errors.Wrapf(err, "dropped %d log lines (%d dropped in total)", len(failed.lines), b.dropped.lines)
+	default:
+		b.requeue(failed)
+		return err
+	}
+}
+
+// flushLoop runs the sender's own flusher for the lifetime of the sender.
+func (b *buildlogger) flushLoop() { b.flusher.run(b.ctx) }
+
+// sealStale seals the buffer, along with any pending suppression notices, if
+// it has not been flushed for the given interval.
+func (b *buildlogger) sealStale(interval time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if time.Since(b.lastFlush) < interval {
+		return
+	}
+
+	// The flusher is what makes room in the memory budget, so it cannot
+	// wait for room for the notices like Send does.
+	for _, notice := range b.suppressionNotices() {
+		if b.degraded {
+			b.sendDegraded(notice)
+		}
+		b.appendLine(notice)
+	}
+	if len(b.buffer) > 0 {
+		b.seal()
+	}
+}
+
+// flusher sends the batches of one or more senders in the background. A
+// sender created on its own has its own flusher, while the senders of a Group
+// share one.
+type flusher struct {
+	mu      sync.Mutex
+	opts    *LoggerOptions
+	signal  chan struct{}
+	senders []*buildlogger
+	timer   *time.Timer
+}
+
+func newFlusher(opts *LoggerOptions) *flusher {
+	return &flusher{
+		opts:   opts,
+		signal: make(chan struct{}, 1),
+	}
+}
+
+func (f *flusher) add(b *buildlogger) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.senders = append(f.senders, b)
+}
+
+func (f *flusher) remove(b *buildlogger) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := range f.senders {
+		if f.senders[i] == b {
+			f.senders = append(f.senders[:i], f.senders[i+1:]...)
+			return
+		}
+	}
+}
+
+func (f *flusher) list() []*buildlogger {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]*buildlogger{}, f.senders...)
+}
+
+// run sends batches as soon as they are sealed, seals buffers every flush
+// interval, and keeps retrying batches that could not be sent with backoff,
+// until the context is done.
+func (f *flusher) run(ctx context.Context) {
+	var timer <-chan time.Time
+	if f.opts.FlushInterval > 0 {
+		f.mu.Lock()
+		f.timer = time.NewTimer(f.opts.FlushInterval)
+		timer = f.timer.C
+		f.mu.Unlock()
+		defer f.timer.Stop()
+	}
+
+	var (
+		retry    <-chan time.Time
+		failures int
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-f.signal:
+		case <-retry:
+		case <-timer:
+			for _, b := range f.list() {
+				b.sealStale(f.opts.FlushInterval)
+			}
+			f.mu.Lock()
+			_ = f.timer.Reset(f.opts.FlushInterval)
+			f.mu.Unlock()
+		}
+
+		retry = nil
+		failed := false
+		for _, b := range f.list() {
+			if err := b.drain(b.ctx); err != nil {
+				if b.ctx.Err() != nil || errors.Cause(err) == errLogNotCreated {
+					// The sender was closed while draining, or
+					// its log is being created in the
+					// background.
+					continue
+				}
+				b.logLocal(level.Error, err)
+				failed = true
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if failed {
+			failures++
+			wait := f.opts.Retry.backoff(failures)
+			if wait <= 0 {
+				wait = defaultRetryBaseBackoff
+			}
+			retry = time.After(wait)
+		} else {
+			failures = 0
+		}
+	}
+}
+
+// memoryBudget bounds the number of bytes of log lines held in memory, waiting
+// to be sent, by one or more senders. A negative max means there is no bound.
+type memoryBudget struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	max        int
+	used       int
+	generation uint64
+}
+
+func newMemoryBudget(max int) *memoryBudget {
+	m := &memoryBudget{max: max}
+	m.cond = sync.NewCond(&m.mu)
+
+	return m
+}
+
+func (m *memoryBudget) fits(size int) bool {
+	fits, _ := m.check(size)
+	return fits
+}
+
+// check returns whether there is room for the given number of bytes along with
+// the budget's current generation, for use with wait.
+func (m *memoryBudget) check(size int) (bool, uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.max < 0 || m.used+size <= m.max, m.generation
+}
+
+func (m *memoryBudget) inUse() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.used
+}
+
+func (m *memoryBudget) acquire(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.used += size
+}
+
+func (m *memoryBudget) release(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.used -= size
+	m.generation++
+	m.cond.Broadcast()
+}
+
+// wake wakes up everything waiting on the budget, such as when a sender is
+// closed.
+func (m *memoryBudget) wake() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.generation++
+	m.cond.Broadcast()
+}
+
+// wait blocks until the budget changes from the given generation.
+func (m *memoryBudget) wait(generation uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for m.generation == generation {
+		m.cond.Wait()
+	}
+}
+
+// droppedLines accounts for log lines that were given up on, either because
+// all send attempts were exhausted or because the queue overflowed.
+type droppedLines struct {
+	lines   int
+	bytes   int
+	batches int
+}
+
+func (d *droppedLines) addBatch(dropped *batch) {
+	d.lines += len(dropped.lines)
+	d.bytes += dropped.size
+	d.batches++
+}
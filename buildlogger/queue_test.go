@@ -0,0 +1,299 @@
+package buildlogger
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/evergreen-ci/timber/testutil"
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/mongodb/grip/send"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOverflowPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Each line is 8 bytes, so two lines fill a batch and three lines
+	// overflow the queue.
+	createQueuedSender := func(t *testing.T, mc *mockClient, policy OverflowPolicy) *buildlogger {
+		b := createSender(ctx, mc, &mockSender{Base: send.NewBase("test")})
+		b.opts.MaxBufferSize = 10
+		b.opts.MaxQueueSize = 20
+		b.opts.OverflowPolicy = policy
+		b.budget = newMemoryBudget(b.opts.MaxQueueSize)
+		return b
+	}
+	sendLines := func(b *buildlogger, lines ...string) {
+		for _, line := range lines {
+			b.Send(message.ConvertToComposer(level.Info, line))
+		}
+	}
+	sentData := func(mc *mockClient) []string {
+		var data []string
+		for _, lines := range mc.allLogLines {
+			for _, line := range lines.Lines {
+				data = append(data, string(line.Data))
+			}
+		}
+		return data
+	}
+
+	t.Run("DropNewest", func(t *testing.T) {
+		mc := &mockClient{}
+		b := createQueuedSender(t, mc, OverflowDropNewest)
+
+		sendLines(b, "line 001", "line 002", "line 003")
+		require.Len(t, b.queue, 1)
+		assert.Empty(t, b.buffer)
+		assert.Equal(t, droppedLines{lines: 1, bytes: 8}, b.dropped)
+
+		require.NoError(t, b.Flush(ctx))
+		assert.Equal(t, []string{"line 001", "line 002"}, sentData(mc))
+	})
+	t.Run("DropOldest", func(t *testing.T) {
+		mc := &mockClient{}
+		b := createQueuedSender(t, mc, OverflowDropOldest)
+
+		sendLines(b, "line 001", "line 002", "line 003")
+		assert.Empty(t, b.queue)
+		assert.Zero(t, b.queueSize)
+		assert.Len(t, b.buffer, 1)
+		assert.Equal(t, droppedLines{lines: 2, bytes: 16, batches: 1}, b.dropped)
+
+		require.NoError(t, b.Flush(ctx))
+		assert.Equal(t, []string{"line 003"}, sentData(mc))
+	})
+	t.Run("Spill", func(t *testing.T) {
+		mc := &mockClient{}
+		b := createQueuedSender(t, mc, OverflowSpill)
+		require.NoError(t, b.openSpool(t.TempDir()))
+
+		sendLines(b, "line 001", "line 002", "line 003")
+		assert.Empty(t, b.queue)
+		assert.Zero(t, b.queueSize)
+		assert.Equal(t, 1, b.spool.len())
+		assert.Zero(t, b.dropped)
+
+		require.NoError(t, b.Flush(ctx))
+		assert.Equal(t, []string{"line 001", "line 002", "line 003"}, sentData(mc))
+		assert.Zero(t, b.spool.len())
+	})
+	t.Run("Block", func(t *testing.T) {
+		mc := &mockClient{}
+		b := createQueuedSender(t, mc, OverflowBlock)
+
+		sendLines(b, "line 001", "line 002")
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			sendLines(b, "line 003")
+		}()
+
+		select {
+		case <-done:
+			t.Fatal("send should block while the queue is full")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		require.NoError(t, b.Flush(ctx))
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("send should unblock once the queue is drained")
+		}
+
+		require.NoError(t, b.Flush(ctx))
+		assert.Equal(t, []string{"line 001", "line 002", "line 003"}, sentData(mc))
+		assert.Zero(t, b.dropped)
+	})
+	t.Run("BlockUnblocksOnClose", func(t *testing.T) {
+		mc := &mockClient{appendErr: true}
+		b := createQueuedSender(t, mc, OverflowBlock)
+
+		sendLines(b, "line 001", "line 002")
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			sendLines(b, "line 003")
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		b.mu.Lock()
+		b.closed = true
+		b.budget.wake()
+		b.mu.Unlock()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("send should unblock once the sender is closed")
+		}
+		assert.Len(t, b.queue, 1)
+		assert.Empty(t, b.buffer)
+	})
+	t.Run("Unbounded", func(t *testing.T) {
+		mc := &mockClient{}
+		b := createQueuedSender(t, mc, OverflowDropNewest)
+		b.opts.MaxQueueSize = -1
+		b.budget = newMemoryBudget(b.opts.MaxQueueSize)
+
+		sendLines(b, "line 001", "line 002", "line 003", "line 004", "line 005")
+		assert.Len(t, b.queue, 2)
+		assert.Zero(t, b.dropped)
+	})
+}
+
+func TestFlushLoop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, err := testutil.NewMockBuildloggerServer(ctx, 4600)
+	require.NoError(t, err)
+	conn, err := grpc.DialContext(ctx, srv.Address(), grpc.WithInsecure())
+	require.NoError(t, err)
+
+	opts := &LoggerOptions{
+		ClientConn:    conn,
+		Local:         &mockSender{Base: send.NewBase("test")},
+		MaxBufferSize: 1,
+		FlushInterval: -1,
+	}
+	s, err := MakeLoggerWithContext(ctx, "test", opts)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		s.Send(message.ConvertToComposer(level.Info, fmt.Sprintf("line %d", i)))
+	}
+
+	assert.Eventually(t, func() bool {
+		srv.Mu.Lock()
+		defer srv.Mu.Unlock()
+		return len(srv.Data[opts.GetLogID()]) == 3
+	}, 5*time.Second, 10*time.Millisecond, "sealed batches should be sent without an explicit flush")
+	require.NoError(t, s.Close())
+
+	srv.Mu.Lock()
+	defer srv.Mu.Unlock()
+	for i, lines := range srv.Data[opts.GetLogID()] {
+		require.Len(t, lines.Lines, 1)
+		assert.EqualValues(t, fmt.Sprintf("line %d", i), lines.Lines[0].Data)
+	}
+}
+
+// failingClient fails the append RPCs with the given call numbers, starting at
+// 1.
+type failingClient struct {
+	*mockClient
+	calls   int
+	failing map[int]bool
+}
+
+func (fc *failingClient) AppendLogLines(ctx context.Context, in *gopb.LogLines, opts ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	fc.calls++
+	if fc.failing[fc.calls] {
+		return nil, errors.New("append error")
+	}
+
+	return fc.mockClient.AppendLogLines(ctx, in, opts...)
+}
+
+func TestSendBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var expected []string
+	for i := 0; i < 10; i++ {
+		expected = append(expected, fmt.Sprintf("%03d %s", i, strings.Repeat("x", 96)))
+	}
+	sendAll := func(b *buildlogger) {
+		for _, line := range expected {
+			b.Send(message.ConvertToComposer(level.Info, line))
+		}
+	}
+	sentData := func(mc *mockClient) []string {
+		var data []string
+		for _, lines := range mc.allLogLines {
+			for _, line := range lines.Lines {
+				data = append(data, string(line.Data))
+			}
+		}
+		return data
+	}
+
+	t.Run("SplitsAtMaxRPCSize", func(t *testing.T) {
+		mc := &mockClient{}
+		b := createSender(ctx, mc, &mockSender{Base: send.NewBase("test")})
+		b.opts.MaxBufferSize = 1 << 20
+		b.opts.MaxRPCSize = 350
+
+		sendAll(b)
+		require.NoError(t, b.Flush(ctx))
+		assert.Greater(t, len(mc.allLogLines), 1)
+		for _, lines := range mc.allLogLines {
+			assert.LessOrEqual(t, proto.Size(lines), b.opts.MaxRPCSize)
+			assert.NotEmpty(t, lines.Lines)
+		}
+		assert.Equal(t, expected, sentData(mc))
+	})
+	t.Run("OversizedLineSentAlone", func(t *testing.T) {
+		mc := &mockClient{}
+		b := createSender(ctx, mc, &mockSender{Base: send.NewBase("test")})
+		b.opts.MaxBufferSize = 1 << 20
+		b.opts.MaxRPCSize = 50
+
+		sendAll(b)
+		require.NoError(t, b.Flush(ctx))
+		require.Len(t, mc.allLogLines, len(expected))
+		assert.Equal(t, expected, sentData(mc))
+	})
+	t.Run("ResendsOnlyRemainder", func(t *testing.T) {
+		fc := &failingClient{mockClient: &mockClient{}, failing: map[int]bool{2: true}}
+		b := createSender(ctx, fc, &mockSender{Base: send.NewBase("test")})
+		b.opts.MaxBufferSize = 1 << 20
+		b.opts.MaxRPCSize = 350
+
+		sendAll(b)
+		assert.Error(t, b.Flush(ctx))
+		require.Len(t, fc.allLogLines, 1)
+		sent := len(fc.allLogLines[0].Lines)
+		require.Len(t, b.queue, 1)
+		assert.Len(t, b.queue[0].lines, len(expected)-sent)
+		assert.Equal(t, (len(expected)-sent)*len(expected[0]), b.queueSize)
+
+		require.NoError(t, b.Flush(ctx))
+		assert.Equal(t, expected, sentData(fc.mockClient))
+		assert.Zero(t, b.queueSize)
+	})
+	t.Run("SpoolsOnlyRemainder", func(t *testing.T) {
+		fc := &failingClient{mockClient: &mockClient{}, failing: map[int]bool{2: true, 4: true}}
+		b := createSender(ctx, fc, &mockSender{Base: send.NewBase("test")})
+		b.opts.MaxBufferSize = 1 << 20
+		b.opts.MaxRPCSize = 350
+		require.NoError(t, b.openSpool(t.TempDir()))
+
+		sendAll(b)
+		assert.Error(t, b.Flush(ctx))
+		assert.Equal(t, 1, b.spool.len())
+		assert.Error(t, b.Flush(ctx))
+		assert.Equal(t, 1, b.spool.len())
+
+		require.NoError(t, b.Flush(ctx))
+		assert.Zero(t, b.spool.len())
+		assert.Equal(t, expected, sentData(fc.mockClient))
+	})
+	t.Run("RPCLines", func(t *testing.T) {
+		lines := []*gopb.LogLine{{Data: []byte(expected[0])}, {Data: []byte(expected[1])}}
+		assert.Equal(t, 2, rpcLines("id", lines, 0))
+		assert.Equal(t, 2, rpcLines("id", lines, proto.Size(&gopb.LogLines{LogId: "id", Lines: lines})))
+		assert.Equal(t, 1, rpcLines("id", lines, proto.Size(&gopb.LogLines{LogId: "id", Lines: lines})-1))
+		assert.Equal(t, 1, rpcLines("id", lines, 1))
+	})
+}
@@ -0,0 +1,97 @@
+package buildlogger
+
+import (
+	"context"
+
+	"github.com/evergreen-ci/timber"
+	"github.com/mongodb/grip/send"
+	"github.com/pkg/errors"
+)
+
+// ReattachOptions identify an existing log to which a new sender appends, such
+// as the log of an agent that restarted in the middle of a task.
+type ReattachOptions struct {
+	// The ID of the log, as returned by GetLogIDs.
+	LogID string
+	// The options for requests to Cedar's REST API, used to check that the
+	// log is still open. Not required when using the local backend.
+	Cedar timber.GetOptions
+}
+
+// Validate ensures ReattachOptions is configured correctly.
+func (opts ReattachOptions) Validate() error {
+	if opts.LogID == "" {
+		return errors.New("must provide a log id")
+	}
+
+	return nil
+}
+
+// ReattachLogger returns a grip Sender backed by cedar Buildlogger that
+// appends to the existing log with the given ID instead of creating a new
+// one.
+func ReattachLogger(name string, reattach ReattachOptions, opts *LoggerOptions) (send.Sender, error) {
+	return ReattachLoggerWithContext(context.Background(), name, reattach, opts)
+}
+
+// ReattachLoggerWithContext returns a grip Sender backed by cedar Buildlogger
+// that appends to the existing log with the given ID instead of creating a new
+// one, using the passed in context. The log must still be open; it is closed,
+// as usual, when the sender is closed. The information identifying the log is
+// taken from the log itself, so it need not be set in the options, except for
+// the format, which must match that of the log if set. Lines spooled by a
+// previous sender of the log with the same spool directory are replayed
+// first. When rolling over, the chunk numbering continues from the log's chunk
+// tag.
+func ReattachLoggerWithContext(ctx context.Context, name string, reattach ReattachOptions, opts *LoggerOptions) (send.Sender, error) {
+	if err := reattach.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid reattach options")
+	}
+
+	getOpts := GetOptions{Cedar: reattach.Cedar, ID: reattach.LogID}
+	if opts.useLocal() {
+		getOpts.LocalDir = opts.LocalDir
+	}
+	meta, err := GetMeta(ctx, getOpts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting metadata of log '%s'", reattach.LogID)
+	}
+	if len(meta) != 1 {
+		return nil, errors.Errorf("expected metadata of one log, got %d", len(meta))
+	}
+	log := meta[0]
+	if log.Completed() {
+		return nil, errors.Errorf("log '%s' is already closed", log.ID)
+	}
+	if opts.Format != LogFormatUnknown && opts.Format != log.Format {
+		return nil, errors.Errorf("log format does not match the format of log '%s'", log.ID)
+	}
+
+	opts.Project = log.Project
+	opts.Version = log.Version
+	opts.Variant = log.Variant
+	opts.TaskName = log.TaskName
+	opts.TaskID = log.TaskID
+	opts.Execution = log.Execution
+	opts.TestName = log.TestName
+	opts.Trial = log.Trial
+	opts.ProcessName = log.ProcessName
+	opts.Format = log.Format
+	opts.Tags = log.Tags
+	opts.Arguments = log.Arguments
+	opts.Mainline = log.Mainline
+
+	return makeLogger(ctx, name, opts, func(b *buildlogger) error {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		b.setLog(log.ID)
+		b.chunk, _ = chunkTag(log.Tags)
+		b.logCreatedAt = log.CreatedAt
+		for _, chunk := range log.Chunks {
+			b.logLines += chunk.NumLines
+		}
+
+		return nil
+	})
+}
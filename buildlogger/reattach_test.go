@@ -0,0 +1,138 @@
+package buildlogger
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/evergreen-ci/timber"
+	"github.com/evergreen-ci/timber/testutil"
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/mongodb/grip/send"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestReattachLogger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("LocalBackend", func(t *testing.T) {
+		dir := t.TempDir()
+		client, err := newLocalClient(dir)
+		require.NoError(t, err)
+		resp, err := client.CreateLog(ctx, &gopb.LogData{Info: &gopb.LogInfo{
+			TaskId:   "task",
+			ProcName: "mongod",
+			Format:   gopb.LogFormat(LogFormatText),
+		}})
+		require.NoError(t, err)
+		_, err = client.AppendLogLines(ctx, &gopb.LogLines{
+			LogId: resp.LogId,
+			Lines: []*gopb.LogLine{{Priority: int32(level.Info), Timestamp: timestamppb.Now(), Data: []byte("before restart")}},
+		})
+		require.NoError(t, err)
+
+		opts := &LoggerOptions{LocalDir: dir}
+		s, err := ReattachLoggerWithContext(ctx, "reattached", ReattachOptions{LogID: resp.LogId}, opts)
+		require.NoError(t, err)
+		require.NoError(t, s.SetLevel(send.LevelInfo{Default: level.Info, Threshold: level.Debug}))
+		assert.Equal(t, resp.LogId, opts.GetLogID())
+		assert.Equal(t, "task", opts.TaskID)
+		assert.Equal(t, "mongod", opts.ProcessName)
+		assert.Equal(t, LogFormatText, opts.Format)
+
+		s.Send(message.ConvertToComposer(level.Info, "after restart"))
+		opts.SetExitCode(1)
+		require.NoError(t, s.Close())
+
+		var lines []string
+		for line, err := range GetLines(ctx, GetOptions{LocalDir: dir, ID: resp.LogId}) {
+			require.NoError(t, err)
+			lines = append(lines, line.Data)
+		}
+		assert.Equal(t, []string{"before restart", "after restart"}, lines)
+		meta, err := GetMeta(ctx, GetOptions{LocalDir: dir, ID: resp.LogId})
+		require.NoError(t, err)
+		require.Len(t, meta, 1)
+		assert.True(t, meta[0].Completed())
+		assert.EqualValues(t, 1, meta[0].ExitCode)
+
+		_, err = ReattachLoggerWithContext(ctx, "reattached", ReattachOptions{LogID: resp.LogId}, &LoggerOptions{LocalDir: dir})
+		assert.Error(t, err, "log is closed")
+	})
+	t.Run("MismatchedFormat", func(t *testing.T) {
+		dir := t.TempDir()
+		client, err := newLocalClient(dir)
+		require.NoError(t, err)
+		resp, err := client.CreateLog(ctx, &gopb.LogData{Info: &gopb.LogInfo{Format: gopb.LogFormat(LogFormatText)}})
+		require.NoError(t, err)
+
+		_, err = ReattachLoggerWithContext(ctx, "reattached", ReattachOptions{LogID: resp.LogId}, &LoggerOptions{LocalDir: dir, Format: LogFormatJSON})
+		assert.Error(t, err)
+	})
+	t.Run("UnknownLog", func(t *testing.T) {
+		_, err := ReattachLoggerWithContext(ctx, "reattached", ReattachOptions{LogID: "unknown"}, &LoggerOptions{LocalDir: t.TempDir()})
+		assert.Error(t, err)
+	})
+	t.Run("InvalidOptions", func(t *testing.T) {
+		_, err := ReattachLoggerWithContext(ctx, "reattached", ReattachOptions{}, &LoggerOptions{LocalDir: t.TempDir()})
+		assert.Error(t, err)
+		_, err = ReattachLoggerWithContext(ctx, "reattached", ReattachOptions{LogID: "id"}, &LoggerOptions{BaseAddress: "localhost"})
+		assert.Error(t, err, "missing cedar REST options")
+	})
+	t.Run("Cedar", func(t *testing.T) {
+		srv, err := testutil.NewMockBuildloggerServer(ctx, 4800)
+		require.NoError(t, err)
+
+		completed := false
+		var metaPath string
+		rest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			metaPath = r.URL.Path
+			completedAt := "null"
+			if completed {
+				completedAt = `"2020-01-02T03:04:05Z"`
+			}
+			_, _ = fmt.Fprintf(w, `{"id": "id", "info": {"task_id": "task", "format": "text"}, "completed_at": %s, "artifact": {"type": "s3"}}`, completedAt)
+		}))
+		defer rest.Close()
+
+		opts := &LoggerOptions{
+			Local:       &mockSender{Base: send.NewBase("test")},
+			BaseAddress: srv.DialOpts.BaseAddress,
+			RPCPort:     srv.DialOpts.RPCPort,
+			Insecure:    true,
+		}
+		reattach := ReattachOptions{LogID: "id", Cedar: timber.GetOptions{BaseURL: rest.URL}}
+		s, err := ReattachLoggerWithContext(ctx, "reattached", reattach, opts)
+		require.NoError(t, err)
+		assert.Equal(t, "/rest/v1/buildlogger/id/meta", metaPath)
+		require.NoError(t, s.SetLevel(send.LevelInfo{Default: level.Info, Threshold: level.Debug}))
+
+		s.Send(message.ConvertToComposer(level.Info, "line"))
+		opts.SetExitCode(2)
+		require.NoError(t, s.Close())
+
+		srv.Mu.Lock()
+		assert.Nil(t, srv.Create)
+		require.Len(t, srv.Data["id"], 1)
+		assert.Equal(t, "line", string(srv.Data["id"][0].Lines[0].Data))
+		require.NotNil(t, srv.Close)
+		assert.Equal(t, "id", srv.Close.LogId)
+		assert.EqualValues(t, 2, srv.Close.ExitCode)
+		srv.Mu.Unlock()
+
+		completed = true
+		_, err = ReattachLoggerWithContext(ctx, "reattached", reattach, &LoggerOptions{
+			BaseAddress: srv.DialOpts.BaseAddress,
+			RPCPort:     srv.DialOpts.RPCPort,
+			Insecure:    true,
+		})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,230 @@
+package buildlogger
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const defaultRedactReplacement = "[REDACTED]"
+
+// Redactor scrubs sensitive data, such as secrets, from a log line.
+type Redactor interface {
+	Redact(string) string
+}
+
+// RedactOptions configure the scrubbing of secrets from log lines before they
+// are buffered, prefixed, or spooled, and from the error messages sent to the
+// local sender.
+type RedactOptions struct {
+	// Literal secret values to redact.
+	Values []string `bson:"values" json:"values" yaml:"values"`
+	// Regular expressions matching secrets to redact.
+	Patterns []string `bson:"patterns" json:"patterns" yaml:"patterns"`
+	// Custom redactors, applied after the values and patterns.
+	Redactors []Redactor `bson:"-" json:"-" yaml:"-"`
+	// The text that replaces redacted values and pattern matches.
+	// Defaults to "[REDACTED]".
+	Replacement string `bson:"replacement" json:"replacement" yaml:"replacement"`
+
+	redactors []Redactor
+}
+
+func (opts *RedactOptions) validate() error {
+	if opts.Replacement == "" {
+		opts.Replacement = defaultRedactReplacement
+	}
+
+	opts.redactors = nil
+	values := make([]string, 0, len(opts.Values))
+	for _, value := range opts.Values {
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	if len(values) > 0 {
+		// The replacer prefers earlier values, so longer values
+		// come first to fully redact secrets that contain others.
+		sort.SliceStable(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+		pairs := make([]string, 0, 2*len(values))
+		for _, value := range values {
+			pairs = append(pairs, value, opts.Replacement)
+		}
+		opts.redactors = append(opts.redactors, &replacerRedactor{strings.NewReplacer(pairs...)})
+	}
+
+	for _, pattern := range opts.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.Wrapf(err, "compiling redaction pattern '%s'", pattern)
+		}
+		opts.redactors = append(opts.redactors, &regexpRedactor{re: re, replacement: opts.Replacement})
+	}
+
+	for _, redactor := range opts.Redactors {
+		if redactor == nil {
+			return errors.New("redactors cannot be nil")
+		}
+		opts.redactors = append(opts.redactors, redactor)
+	}
+
+	return nil
+}
+
+func (opts *RedactOptions) enabled() bool { return len(opts.redactors) > 0 }
+
+func (opts *RedactOptions) redact(s string) string {
+	for _, redactor := range opts.redactors {
+		s = redactor.Redact(s)
+	}
+
+	return s
+}
+
+func (opts *RedactOptions) redactError(err error) error {
+	if err == nil || !opts.enabled() {
+		return err
+	}
+
+	return errors.New(opts.redact(err.Error()))
+}
+
+// redactValue redacts every string in the given structured log line payload.
+// Values of types other than strings, maps, and slices are first normalized
+// into those types by a round trip through the log's format.
+func (opts *RedactOptions) redactValue(v interface{}, format LogFormat) interface{} {
+	if !opts.enabled() {
+		return v
+	}
+
+	return opts.redactValueNormalized(v, format, false)
+}
+
+func (opts *RedactOptions) redactValueNormalized(v interface{}, format LogFormat, normalized bool) interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return opts.redact(val)
+	case message.Fields:
+		out := make(message.Fields, len(val))
+		for k, elem := range val {
+			out[k] = opts.redactValueNormalized(elem, format, normalized)
+		}
+		return out
+	case bson.M:
+		out := make(bson.M, len(val))
+		for k, elem := range val {
+			out[k] = opts.redactValueNormalized(elem, format, normalized)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, elem := range val {
+			out[k] = opts.redactValueNormalized(elem, format, normalized)
+		}
+		return out
+	case map[string]string:
+		out := make(map[string]string, len(val))
+		for k, elem := range val {
+			out[k] = opts.redact(elem)
+		}
+		return out
+	case bson.D:
+		out := make(bson.D, len(val))
+		for i, elem := range val {
+			out[i] = bson.E{Key: elem.Key, Value: opts.redactValueNormalized(elem.Value, format, normalized)}
+		}
+		return out
+	case bson.A:
+		out := make(bson.A, len(val))
+		for i, elem := range val {
+			out[i] = opts.redactValueNormalized(elem, format, normalized)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, elem := range val {
+			out[i] = opts.redactValueNormalized(elem, format, normalized)
+		}
+		return out
+	case []string:
+		out := make([]string, len(val))
+		for i, elem := range val {
+			out[i] = opts.redact(elem)
+		}
+		return out
+	}
+
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return v
+	case reflect.String:
+		return opts.redact(reflect.ValueOf(v).String())
+	}
+
+	if normalized {
+		return v
+	}
+	out, err := format.normalize(v)
+	if err != nil {
+		// The payload cannot be serialized, so it is replaced by
+		// the message's string form, which is redacted, anyway.
+		return v
+	}
+
+	return opts.redactValueNormalized(out, format, true)
+}
+
+// normalize converts the value into the generic maps, slices, and primitive
+// types produced by unmarshalling it in the format.
+func (f LogFormat) normalize(v interface{}) (interface{}, error) {
+	if f == LogFormatBSON {
+		type wrapper struct {
+			V interface{} `bson:"v"`
+		}
+		data, err := bson.Marshal(wrapper{V: v})
+		if err != nil {
+			return nil, err
+		}
+		out := wrapper{}
+		if err = bson.Unmarshal(data, &out); err != nil {
+			return nil, err
+		}
+		return out.V, nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	if err = json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+type replacerRedactor struct {
+	*strings.Replacer
+}
+
+func (r *replacerRedactor) Redact(s string) string { return r.Replace(s) }
+
+type regexpRedactor struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+func (r *regexpRedactor) Redact(s string) string {
+	return r.re.ReplaceAllLiteralString(s, r.replacement)
+}
@@ -0,0 +1,153 @@
+package buildlogger
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/mongodb/grip/send"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type upperRedactor struct{}
+
+func (upperRedactor) Redact(s string) string { return strings.ToUpper(s) }
+
+func TestRedactOptions(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		opts := &RedactOptions{}
+		require.NoError(t, opts.validate())
+		assert.Equal(t, defaultRedactReplacement, opts.Replacement)
+		assert.False(t, opts.enabled())
+		assert.Equal(t, "secret", opts.redact("secret"))
+
+		fields := message.Fields{"key": "secret"}
+		assert.Equal(t, fields, opts.redactValue(fields, LogFormatJSON))
+		err := errors.New("secret")
+		assert.Equal(t, err, opts.redactError(err))
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		assert.Error(t, (&RedactOptions{Patterns: []string{"("}}).validate())
+		assert.Error(t, (&RedactOptions{Redactors: []Redactor{nil}}).validate())
+	})
+	t.Run("Values", func(t *testing.T) {
+		opts := &RedactOptions{Values: []string{"", "abc", "abcdef"}}
+		require.NoError(t, opts.validate())
+		assert.True(t, opts.enabled())
+		assert.Equal(t, "key=[REDACTED] other=[REDACTED]", opts.redact("key=abcdef other=abc"))
+	})
+	t.Run("Patterns", func(t *testing.T) {
+		opts := &RedactOptions{
+			Patterns:    []string{`token=\S+`},
+			Replacement: "***",
+		}
+		require.NoError(t, opts.validate())
+		assert.Equal(t, "curl -d *** url", opts.redact("curl -d token=abc$123 url"))
+	})
+	t.Run("RedactorsRunLast", func(t *testing.T) {
+		opts := &RedactOptions{
+			Values:    []string{"secret"},
+			Redactors: []Redactor{upperRedactor{}},
+		}
+		require.NoError(t, opts.validate())
+		assert.Equal(t, "THE [REDACTED]", opts.redact("the secret"))
+	})
+	t.Run("Error", func(t *testing.T) {
+		opts := &RedactOptions{Values: []string{"secret"}}
+		require.NoError(t, opts.validate())
+		assert.NoError(t, opts.redactError(nil))
+		assert.EqualError(t, opts.redactError(errors.Wrap(errors.New("bad secret"), "sending")), "sending: bad [REDACTED]")
+	})
+	t.Run("StructuredValues", func(t *testing.T) {
+		opts := &RedactOptions{Values: []string{"secret"}}
+		require.NoError(t, opts.validate())
+
+		type payload struct {
+			Name  string   `bson:"name" json:"name"`
+			Count int      `bson:"count" json:"count"`
+			Tags  []string `bson:"tags" json:"tags"`
+		}
+		fields := message.Fields{
+			"name":   "secret",
+			"count":  1,
+			"nested": map[string]interface{}{"list": []interface{}{"a secret", 2}},
+			"struct": payload{Name: "my secret", Count: 3, Tags: []string{"secret"}},
+		}
+		for _, format := range []LogFormat{LogFormatJSON, LogFormatBSON} {
+			redacted := opts.redactValue(fields, format)
+			data, err := format.marshal(StructuredLine{Data: redacted})
+			require.NoError(t, err)
+			assert.NotContains(t, string(data), "secret")
+			assert.Equal(t, "secret", fields["name"], "original payload should not be modified")
+		}
+
+		assert.Equal(t, bson.D{{Key: "k", Value: "[REDACTED]"}}, opts.redactValue(bson.D{{Key: "k", Value: "secret"}}, LogFormatBSON))
+		assert.Equal(t, map[string]string{"k": "[REDACTED]"}, opts.redactValue(map[string]string{"k": "secret"}, LogFormatJSON))
+		assert.Equal(t, 5, opts.redactValue(5, LogFormatJSON))
+		assert.Nil(t, opts.redactValue(nil, LogFormatJSON))
+	})
+}
+
+func TestSendRedacts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	redact := RedactOptions{Values: []string{"hunter2"}, Patterns: []string{`key-[0-9a-f]+`}}
+	require.NoError(t, redact.validate())
+
+	t.Run("TextLines", func(t *testing.T) {
+		b := createSender(ctx, &mockClient{}, &mockSender{Base: send.NewBase("test")})
+		b.opts.MaxBufferSize = 4096
+		b.opts.Prefix = "prefix"
+		b.opts.Redact = redact
+
+		b.Send(message.ConvertToComposer(level.Info, "password hunter2\napi key-0a1b2c"))
+		require.Len(t, b.buffer, 2)
+		assert.Equal(t, "[prefix] password [REDACTED]", string(b.buffer[0].Data))
+		assert.Equal(t, "[prefix] api [REDACTED]", string(b.buffer[1].Data))
+		assert.Equal(t, len(b.buffer[0].Data)+len(b.buffer[1].Data), b.bufferSize)
+	})
+	t.Run("StructuredLines", func(t *testing.T) {
+		b := createSender(ctx, &mockClient{}, &mockSender{Base: send.NewBase("test")})
+		b.opts.MaxBufferSize = 4096
+		b.opts.Format = LogFormatJSON
+		b.opts.Redact = redact
+
+		b.Send(message.NewFields(level.Info, message.Fields{"password": "hunter2", "message": "using key-ff"}))
+		require.Len(t, b.buffer, 1)
+		line := &StructuredLine{}
+		require.NoError(t, json.Unmarshal(b.buffer[0].Data, line))
+		data, ok := line.Data.(map[string]interface{})
+		require.True(t, ok)
+		assert.Equal(t, "[REDACTED]", data["password"])
+		assert.Equal(t, "using [REDACTED]", data["message"])
+	})
+	t.Run("LocalErrors", func(t *testing.T) {
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, &mockClient{appendErr: true}, ms)
+		b.opts.Redact = RedactOptions{Values: []string{"append"}}
+		require.NoError(t, b.opts.Redact.validate())
+
+		b.Send(message.ConvertToComposer(level.Info, "line"))
+		assert.Error(t, b.Close())
+		assert.NotEmpty(t, ms.lastMessage)
+		assert.NotContains(t, ms.lastMessage, "append")
+	})
+	t.Run("ErrorHandler", func(t *testing.T) {
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, &mockClient{}, ms)
+		b.opts.Redact = redact
+
+		b.handleError(nil, message.ConvertToComposer(level.Info, "hunter2"))
+		assert.Empty(t, ms.lastMessage)
+		b.handleError(errors.New("failed with hunter2"), message.ConvertToComposer(level.Info, "sending hunter2"))
+		assert.Contains(t, ms.lastMessage, "[REDACTED]")
+		assert.NotContains(t, ms.lastMessage, "hunter2")
+	})
+}
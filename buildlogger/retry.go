@@ -0,0 +1,124 @@
+package buildlogger
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultRetryBaseBackoff = 100 * time.Millisecond
+	defaultRetryMaxBackoff  = 10 * time.Second
+)
+
+// RetryOptions configure how the RPCs made by the Buildlogger Sender to cedar
+// are retried. Retries apply to creating, appending to, and closing the log,
+// and are independent of any retry interceptors configured on the gRPC client
+// connection.
+type RetryOptions struct {
+	// The maximum number of attempts made for each RPC, including the
+	// first. When set, log lines that still cannot be sent after the last
+	// attempt are spooled, if a spool directory is configured, or dropped
+	// otherwise. Log lines whose attempts are cut short because the
+	// context of the flush is done are kept for the next flush. When
+	// unset, RPCs are attempted once and log lines that cannot be sent
+	// remain buffered for the next flush.
+	MaxAttempts int `bson:"max_attempts" json:"max_attempts" yaml:"max_attempts"`
+	// The backoff before the first retry, doubling for each subsequent
+	// retry with jitter applied. Defaults to 100 milliseconds.
+	BaseBackoff time.Duration `bson:"base_backoff" json:"base_backoff" yaml:"base_backoff"`
+	// The maximum backoff between retries. Defaults to 10 seconds.
+	MaxBackoff time.Duration `bson:"max_backoff" json:"max_backoff" yaml:"max_backoff"`
+	// The gRPC status codes that are retried. Defaults to Unavailable,
+	// DeadlineExceeded, and Aborted.
+	RetryableCodes []codes.Code `bson:"retryable_codes" json:"retryable_codes" yaml:"retryable_codes"`
+}
+
+func (opts *RetryOptions) validate() error {
+	if opts.MaxAttempts < 0 {
+		return errors.New("max attempts cannot be negative")
+	}
+	if opts.BaseBackoff < 0 || opts.MaxBackoff < 0 {
+		return errors.New("backoff cannot be negative")
+	}
+
+	if opts.BaseBackoff == 0 {
+		opts.BaseBackoff = defaultRetryBaseBackoff
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = defaultRetryMaxBackoff
+	}
+	if opts.MaxBackoff < opts.BaseBackoff {
+		return errors.New("max backoff cannot be less than base backoff")
+	}
+	if len(opts.RetryableCodes) == 0 {
+		opts.RetryableCodes = []codes.Code{codes.Unavailable, codes.DeadlineExceeded, codes.Aborted}
+	}
+
+	return nil
+}
+
+func (opts *RetryOptions) enabled() bool { return opts.MaxAttempts > 0 }
+
+func (opts *RetryOptions) retryable(err error) bool {
+	code := status.Code(errors.Cause(err))
+	for _, retryable := range opts.RetryableCodes {
+		if code == retryable {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoff returns the jittered wait before the given retry, starting at 1.
+func (opts *RetryOptions) backoff(retry int) time.Duration {
+	wait := opts.BaseBackoff
+	for i := 1; i < retry && wait < opts.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > opts.MaxBackoff {
+		wait = opts.MaxBackoff
+	}
+	if wait <= 1 {
+		return wait
+	}
+
+	half := wait / 2
+	return half + time.Duration(rand.Int63n(int64(wait-half)))
+}
+
+// do calls fn until it succeeds, returns an error that is not retryable, the
+// attempts are exhausted, or the context errors.
+func (opts *RetryOptions) do(ctx context.Context, fn func(context.Context) error) error {
+	attempts := opts.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			timer := time.NewTimer(opts.backoff(attempt - 1))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return errors.Wrapf(err, "retry interrupted after %d attempts: %s", attempt-1, ctx.Err())
+			case <-timer.C:
+			}
+		}
+
+		if err = fn(ctx); err == nil || !opts.retryable(err) {
+			return err
+		}
+	}
+
+	if attempts > 1 {
+		return errors.Wrapf(err, "giving up after %d attempts", attempts)
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package buildlogger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryOptions(t *testing.T) {
+	t.Run("ValidateDefaults", func(t *testing.T) {
+		opts := &RetryOptions{}
+		require.NoError(t, opts.validate())
+		assert.Zero(t, opts.MaxAttempts)
+		assert.False(t, opts.enabled())
+		assert.Equal(t, defaultRetryBaseBackoff, opts.BaseBackoff)
+		assert.Equal(t, defaultRetryMaxBackoff, opts.MaxBackoff)
+		assert.ElementsMatch(t, []codes.Code{codes.Unavailable, codes.DeadlineExceeded, codes.Aborted}, opts.RetryableCodes)
+	})
+	t.Run("ValidateInvalid", func(t *testing.T) {
+		assert.Error(t, (&RetryOptions{MaxAttempts: -1}).validate())
+		assert.Error(t, (&RetryOptions{BaseBackoff: -time.Second}).validate())
+		assert.Error(t, (&RetryOptions{BaseBackoff: time.Minute, MaxBackoff: time.Second}).validate())
+	})
+	t.Run("Backoff", func(t *testing.T) {
+		opts := &RetryOptions{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+		for retry, max := range map[int]time.Duration{
+			1:  100 * time.Millisecond,
+			2:  200 * time.Millisecond,
+			3:  400 * time.Millisecond,
+			4:  800 * time.Millisecond,
+			5:  time.Second,
+			80: time.Second,
+		} {
+			for i := 0; i < 10; i++ {
+				wait := opts.backoff(retry)
+				assert.True(t, wait >= max/2, "retry %d waited %s", retry, wait)
+				assert.True(t, wait <= max, "retry %d waited %s", retry, wait)
+			}
+		}
+	})
+	t.Run("Do", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		opts := &RetryOptions{MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		require.NoError(t, opts.validate())
+
+		t.Run("RetriesRetryableErrors", func(t *testing.T) {
+			attempts := 0
+			require.NoError(t, opts.do(ctx, func(context.Context) error {
+				attempts++
+				if attempts < 3 {
+					return status.Error(codes.Unavailable, "unavailable")
+				}
+				return nil
+			}))
+			assert.Equal(t, 3, attempts)
+		})
+		t.Run("GivesUpAfterMaxAttempts", func(t *testing.T) {
+			attempts := 0
+			err := opts.do(ctx, func(context.Context) error {
+				attempts++
+				return status.Error(codes.DeadlineExceeded, "timed out")
+			})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "giving up after 3 attempts")
+			assert.Equal(t, 3, attempts)
+		})
+		t.Run("DoesNotRetryOtherErrors", func(t *testing.T) {
+			attempts := 0
+			err := opts.do(ctx, func(context.Context) error {
+				attempts++
+				return errors.New("append error")
+			})
+			assert.EqualError(t, err, "append error")
+			assert.Equal(t, 1, attempts)
+		})
+		t.Run("DisabledMakesOneAttempt", func(t *testing.T) {
+			attempts := 0
+			disabled := &RetryOptions{}
+			require.NoError(t, disabled.validate())
+			err := disabled.do(ctx, func(context.Context) error {
+				attempts++
+				return status.Error(codes.Unavailable, "unavailable")
+			})
+			require.Error(t, err)
+			assert.Equal(t, codes.Unavailable, status.Code(err))
+			assert.Equal(t, 1, attempts)
+		})
+		t.Run("StopsWhenContextErrors", func(t *testing.T) {
+			slow := &RetryOptions{MaxAttempts: 5, BaseBackoff: time.Minute, MaxBackoff: time.Minute}
+			require.NoError(t, slow.validate())
+			subCtx, subCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+			defer subCancel()
+			attempts := 0
+			err := slow.do(subCtx, func(context.Context) error {
+				attempts++
+				return status.Error(codes.Unavailable, "unavailable")
+			})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "retry interrupted")
+			assert.Equal(t, 1, attempts)
+		})
+	})
+}
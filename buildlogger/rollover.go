@@ -0,0 +1,181 @@
+package buildlogger
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/pkg/errors"
+)
+
+// chunkTagPrefix prefixes the tag numbering each log of a sender that rolls
+// over, starting at "chunk:0".
+const chunkTagPrefix = "chunk:"
+
+// RolloverOptions configure when the Buildlogger Sender closes its current log
+// and continues in a new one. The logs of a sender share the same information
+// and are tagged with their chunk number, such as "chunk:1". Thresholds are
+// checked as log lines are sent, so a log past its max age is only rolled
+// over when the next lines are sent. By default, logs are never rolled over.
+type RolloverOptions struct {
+	// The maximum number of bytes of log line data in a log.
+	MaxSize int `bson:"max_size" json:"max_size" yaml:"max_size"`
+	// The maximum number of lines in a log.
+	MaxLines int `bson:"max_lines" json:"max_lines" yaml:"max_lines"`
+	// The maximum time from the creation of a log to its last lines.
+	MaxAge time.Duration `bson:"max_age" json:"max_age" yaml:"max_age"`
+}
+
+func (opts *RolloverOptions) validate() error {
+	if opts.MaxSize < 0 || opts.MaxLines < 0 || opts.MaxAge < 0 {
+		return errors.New("rollover thresholds cannot be negative")
+	}
+
+	return nil
+}
+
+func (opts *RolloverOptions) enabled() bool {
+	return opts.MaxSize > 0 || opts.MaxLines > 0 || opts.MaxAge > 0
+}
+
+// chunkTag returns the chunk number in the given tags, if any.
+func chunkTag(tags []string) (int, bool) {
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, chunkTagPrefix) {
+			continue
+		}
+		if chunk, err := strconv.Atoi(strings.TrimPrefix(tag, chunkTagPrefix)); err == nil {
+			return chunk, true
+		}
+	}
+
+	return 0, false
+}
+
+// logTags returns the tags of the log with the given chunk number.
+func (b *buildlogger) logTags(chunk int) []string {
+	if !b.opts.Rollover.enabled() {
+		return b.opts.Tags
+	}
+
+	tags := make([]string, 0, len(b.opts.Tags)+1)
+	for _, tag := range b.opts.Tags {
+		if !strings.HasPrefix(tag, chunkTagPrefix) {
+			tags = append(tags, tag)
+		}
+	}
+
+	return append(tags, fmt.Sprintf("%s%d", chunkTagPrefix, chunk))
+}
+
+// setLog makes the log with the given ID the sender's current log. It must be
+// called with the lock held.
+func (b *buildlogger) setLog(id string) {
+	b.opts.logIDs.add(id)
+	b.logCreatedAt = time.Now()
+	b.logLines = 0
+	b.logBytes = 0
+}
+
+// addressee returns the log to which lines addressed to the given log are
+// sent, and whether that log belongs to the sender. Lines addressed to any of
+// the sender's logs are sent to its current log. Lines spooled by another
+// sender keep their log.
+func (b *buildlogger) addressee(logID string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if logID == "" || b.opts.logIDs.contains(logID) {
+		return b.opts.GetLogID(), true
+	}
+
+	return logID, false
+}
+
+// rolloverLimit returns how many of the given lines fit in the current log,
+// which is 0 if the log must be rolled over first. A log without lines always
+// fits at least one line. It must be called with the flush lock held.
+func (b *buildlogger) rolloverLimit(lines []*gopb.LogLine) int {
+	opts := b.opts.Rollover
+	if !opts.enabled() {
+		return len(lines)
+	}
+	if b.logLines == 0 {
+		return 1 + b.countFitting(lines[1:], 1, len(lines[0].Data))
+	}
+	if opts.MaxAge > 0 && time.Since(b.logCreatedAt) >= opts.MaxAge {
+		return 0
+	}
+
+	return b.countFitting(lines, b.logLines, b.logBytes)
+}
+
+// countFitting returns how many of the given lines fit in a log that already
+// has the given number of lines and bytes.
+func (b *buildlogger) countFitting(lines []*gopb.LogLine, numLines, numBytes int) int {
+	opts := b.opts.Rollover
+	for i, line := range lines {
+		numLines++
+		numBytes += len(line.Data)
+		if (opts.MaxLines > 0 && numLines > opts.MaxLines) || (opts.MaxSize > 0 && numBytes > opts.MaxSize) {
+			return i
+		}
+	}
+
+	return len(lines)
+}
+
+// recordSent accounts for lines sent to the current log. It must be called
+// with the flush lock held.
+func (b *buildlogger) recordSent(lines []*gopb.LogLine) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.logLines += len(lines)
+	for _, line := range lines {
+		b.logBytes += len(line.Data)
+	}
+}
+
+// rollover closes the current log and creates the next one. If the new log
+// cannot be created, the next rollover only retries creating it. It must be
+// called with the flush lock held.
+func (b *buildlogger) rollover(ctx context.Context) error {
+	// Lines sent over the stream are only acknowledged once it is closed,
+	// which must happen before the log is.
+	if err := b.ackStream(ctx); err != nil {
+		return errors.Wrap(err, "rolling over")
+	}
+
+	b.mu.Lock()
+	current := b.opts.GetLogID()
+	b.mu.Unlock()
+
+	if !b.logClosed {
+		err := b.opts.Retry.do(ctx, func(ctx context.Context) error {
+			_, err := b.client.CloseLog(ctx, &gopb.LogEndInfo{LogId: current})
+			return b.stats.recordRPC(err)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "closing log '%s' to roll over", current)
+		}
+		b.logClosed = true
+	}
+
+	id, err := b.createLog(ctx, b.chunk+1)
+	if err != nil {
+		return errors.Wrap(err, "rolling over log")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.chunk++
+	b.logClosed = false
+	b.setLog(id)
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package buildlogger
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/mongodb/grip/send"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newRolloverLogger := func(t *testing.T, dir string, rollover RolloverOptions) (send.Sender, *LoggerOptions) {
+		opts := &LoggerOptions{
+			TaskID:   "task",
+			Tags:     []string{"tag"},
+			LocalDir: dir,
+			Rollover: rollover,
+		}
+		s, err := NewLoggerWithContext(ctx, "rollover", send.LevelInfo{Default: level.Info, Threshold: level.Debug}, opts)
+		require.NoError(t, err)
+		return s, opts
+	}
+	// checkLogs checks that the sender's logs are closed, tagged with
+	// their chunk number, and hold the given lines.
+	checkLogs := func(t *testing.T, dir string, opts *LoggerOptions, expected [][]string) {
+		ids := opts.GetLogIDs()
+		require.Len(t, ids, len(expected))
+		assert.Equal(t, ids[len(ids)-1], opts.GetLogID())
+		for i, id := range ids {
+			meta, err := GetMeta(ctx, GetOptions{LocalDir: dir, ID: id})
+			require.NoError(t, err)
+			require.Len(t, meta, 1)
+			assert.Equal(t, []string{"tag", fmt.Sprintf("chunk:%d", i)}, meta[0].Tags)
+			assert.True(t, meta[0].Completed())
+
+			var lines []string
+			for line, err := range GetLines(ctx, GetOptions{LocalDir: dir, ID: id}) {
+				require.NoError(t, err)
+				lines = append(lines, line.Data)
+			}
+			assert.Equal(t, expected[i], lines)
+		}
+	}
+
+	t.Run("LogIDsReadDuringRollover", func(t *testing.T) {
+		dir := t.TempDir()
+		opts := &LoggerOptions{
+			TaskID:        "task",
+			LocalDir:      dir,
+			Rollover:      RolloverOptions{MaxLines: 1},
+			MaxBufferSize: 1,
+			FlushInterval: time.Millisecond,
+		}
+		s, err := NewLoggerWithContext(ctx, "rollover", send.LevelInfo{Default: level.Info, Threshold: level.Debug}, opts)
+		require.NoError(t, err)
+
+		// The background flusher rolls over while the IDs are read.
+		done := make(chan struct{})
+		read := make(chan struct{})
+		go func() {
+			defer close(read)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				id := opts.GetLogID()
+				ids := opts.GetLogIDs()
+				assert.NotEmpty(t, id)
+				assert.NotEmpty(t, ids)
+			}
+		}()
+		for i := 0; i < 20; i++ {
+			s.Send(message.ConvertToComposer(level.Info, fmt.Sprint(i)))
+			time.Sleep(time.Millisecond)
+		}
+		require.NoError(t, s.Close())
+		close(done)
+		<-read
+
+		assert.Len(t, opts.GetLogIDs(), 20)
+	})
+	t.Run("MaxLines", func(t *testing.T) {
+		dir := t.TempDir()
+		s, opts := newRolloverLogger(t, dir, RolloverOptions{MaxLines: 2})
+		s.Send(message.ConvertToComposer(level.Info, "1\n2\n3"))
+		require.NoError(t, s.Flush(ctx))
+		s.Send(message.ConvertToComposer(level.Info, "4\n5"))
+		require.NoError(t, s.Close())
+
+		checkLogs(t, dir, opts, [][]string{{"1", "2"}, {"3", "4"}, {"5"}})
+	})
+	t.Run("MaxSize", func(t *testing.T) {
+		dir := t.TempDir()
+		s, opts := newRolloverLogger(t, dir, RolloverOptions{MaxSize: 10})
+		s.Send(message.ConvertToComposer(level.Info, "aaaa\nbbbb\ncccc\ndddddddddddddddd\neeee"))
+		require.NoError(t, s.Close())
+
+		// A line larger than the max size gets a log of its own.
+		checkLogs(t, dir, opts, [][]string{{"aaaa", "bbbb"}, {"cccc"}, {"dddddddddddddddd"}, {"eeee"}})
+	})
+	t.Run("MaxAge", func(t *testing.T) {
+		dir := t.TempDir()
+		s, opts := newRolloverLogger(t, dir, RolloverOptions{MaxAge: 50 * time.Millisecond})
+		s.Send(message.ConvertToComposer(level.Info, "first"))
+		s.Send(message.ConvertToComposer(level.Info, "second"))
+		require.NoError(t, s.Flush(ctx))
+		time.Sleep(60 * time.Millisecond)
+		s.Send(message.ConvertToComposer(level.Info, "third"))
+		require.NoError(t, s.Close())
+
+		checkLogs(t, dir, opts, [][]string{{"first", "second"}, {"third"}})
+	})
+	t.Run("Stream", func(t *testing.T) {
+		dir := t.TempDir()
+		opts := &LoggerOptions{
+			TaskID:   "task",
+			Tags:     []string{"tag"},
+			LocalDir: dir,
+			Stream:   true,
+			Rollover: RolloverOptions{MaxLines: 1},
+		}
+		s, err := NewLoggerWithContext(ctx, "rollover", send.LevelInfo{Default: level.Info, Threshold: level.Debug}, opts)
+		require.NoError(t, err)
+		s.Send(message.ConvertToComposer(level.Info, "first\nsecond"))
+		require.NoError(t, s.Close())
+
+		checkLogs(t, dir, opts, [][]string{{"first"}, {"second"}})
+	})
+	t.Run("Disabled", func(t *testing.T) {
+		dir := t.TempDir()
+		opts := &LoggerOptions{TaskID: "task", Tags: []string{"tag"}, LocalDir: dir}
+		s, err := NewLoggerWithContext(ctx, "rollover", send.LevelInfo{Default: level.Info, Threshold: level.Debug}, opts)
+		require.NoError(t, err)
+		s.Send(message.ConvertToComposer(level.Info, "first\nsecond"))
+		require.NoError(t, s.Close())
+
+		require.Len(t, opts.GetLogIDs(), 1)
+		meta, err := GetMeta(ctx, GetOptions{LocalDir: dir, ID: opts.GetLogID()})
+		require.NoError(t, err)
+		require.Len(t, meta, 1)
+		assert.Equal(t, []string{"tag"}, meta[0].Tags)
+	})
+	t.Run("Reattach", func(t *testing.T) {
+		dir := t.TempDir()
+		client, err := newLocalClient(dir)
+		require.NoError(t, err)
+		resp, err := client.CreateLog(ctx, &gopb.LogData{Info: &gopb.LogInfo{TaskId: "task", Tags: []string{"tag", "chunk:3"}}})
+		require.NoError(t, err)
+
+		opts := &LoggerOptions{LocalDir: dir, Rollover: RolloverOptions{MaxLines: 1}}
+		s, err := ReattachLoggerWithContext(ctx, "reattached", ReattachOptions{LogID: resp.LogId}, opts)
+		require.NoError(t, err)
+		require.NoError(t, s.SetLevel(send.LevelInfo{Default: level.Info, Threshold: level.Debug}))
+		s.Send(message.ConvertToComposer(level.Info, "first\nsecond"))
+		require.NoError(t, s.Close())
+
+		ids := opts.GetLogIDs()
+		require.Len(t, ids, 2)
+		assert.Equal(t, resp.LogId, ids[0])
+		meta, err := GetMeta(ctx, GetOptions{LocalDir: dir, ID: ids[1]})
+		require.NoError(t, err)
+		require.Len(t, meta, 1)
+		assert.Equal(t, []string{"tag", "chunk:4"}, meta[0].Tags)
+	})
+	t.Run("Group", func(t *testing.T) {
+		dir := t.TempDir()
+		g, err := NewGroup(ctx, &LoggerOptions{TaskID: "task", LocalDir: dir, Rollover: RolloverOptions{MaxLines: 1}})
+		require.NoError(t, err)
+		key := GroupKey{ProcessName: "mongod"}
+		s, err := g.Sender(key)
+		require.NoError(t, err)
+		s.Send(message.ConvertToComposer(level.Info, "first\nsecond"))
+		require.NoError(t, g.Flush(ctx))
+
+		ids, err := g.GetLogIDs(key)
+		require.NoError(t, err)
+		require.Len(t, ids, 2)
+		id, err := g.GetLogID(key)
+		require.NoError(t, err)
+		assert.Equal(t, ids[1], id)
+		require.NoError(t, g.Close())
+	})
+	t.Run("InvalidOptions", func(t *testing.T) {
+		opts := &LoggerOptions{LocalDir: t.TempDir(), Rollover: RolloverOptions{MaxLines: -1}}
+		assert.Error(t, opts.validate())
+	})
+}
+
+func TestChunkTag(t *testing.T) {
+	chunk, ok := chunkTag([]string{"tag", "chunk:x", "chunk:12"})
+	assert.True(t, ok)
+	assert.Equal(t, 12, chunk)
+
+	_, ok = chunkTag([]string{"tag"})
+	assert.False(t, ok)
+}
@@ -0,0 +1,85 @@
+package buildlogger
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/evergreen-ci/timber"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The protobuf field numbers, unknown to gopb.LogLines, under which the
+// sequence of a spooled batch is stored, so that spool files remain plain
+// LogLines messages.
+const (
+	spoolWriterField    protowire.Number = 1000
+	spoolFirstLineField protowire.Number = 1001
+)
+
+// withSequence returns the context of an AppendLogLines request, or of a
+// StreamLogLines request, for log lines written by the given sender, the first
+// of which has the given sequence number. Every line of a sender is numbered
+// when it is sealed into a batch, and keeps its number across retries, spool
+// replays, and resends over a new stream, so that Cedar can detect resent and
+// missing lines. The metadata of a stream is only sent when it is opened, so
+// the lines sent over a stream must be numbered consecutively. Lines written
+// by a sender that predates sequence numbers, replayed from its spool, are
+// sent without one.
+func withSequence(ctx context.Context, writer string, first uint64) context.Context {
+	if writer == "" {
+		return ctx
+	}
+
+	return metadata.AppendToOutgoingContext(ctx,
+		timber.BuildloggerWriterKey, writer,
+		timber.BuildloggerSequenceKey, strconv.FormatUint(first, 10),
+	)
+}
+
+// setSpoolSequence stores the sequence of a batch in its spooled log lines.
+func setSpoolSequence(lines *gopb.LogLines, writer string, first uint64) {
+	if writer == "" {
+		return
+	}
+
+	var raw []byte
+	raw = protowire.AppendTag(raw, spoolWriterField, protowire.BytesType)
+	raw = protowire.AppendString(raw, writer)
+	raw = protowire.AppendTag(raw, spoolFirstLineField, protowire.VarintType)
+	raw = protowire.AppendVarint(raw, first)
+	lines.ProtoReflect().SetUnknown(raw)
+}
+
+// spoolSequence returns the sequence of a batch stored in its spooled log
+// lines, if any.
+func spoolSequence(lines *gopb.LogLines) (string, uint64) {
+	var (
+		writer string
+		first  uint64
+	)
+	raw := lines.ProtoReflect().GetUnknown()
+	for len(raw) > 0 {
+		num, typ, n := protowire.ConsumeTag(raw)
+		if n < 0 {
+			return "", 0
+		}
+		raw = raw[n:]
+
+		switch {
+		case num == spoolWriterField && typ == protowire.BytesType:
+			writer, n = protowire.ConsumeString(raw)
+		case num == spoolFirstLineField && typ == protowire.VarintType:
+			first, n = protowire.ConsumeVarint(raw)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, raw)
+		}
+		if n < 0 {
+			return "", 0
+		}
+		raw = raw[n:]
+	}
+
+	return writer, first
+}
@@ -0,0 +1,172 @@
+package buildlogger
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/evergreen-ci/timber"
+	"github.com/evergreen-ci/timber/testutil"
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/mongodb/grip/send"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// unreliableClient wraps a BuildloggerClient, losing the response of the
+// append RPCs in lost after they succeed, as if they timed out, and failing
+// the append RPCs in failed without sending them. Calls are numbered starting
+// at 1.
+type unreliableClient struct {
+	gopb.BuildloggerClient
+	calls  int
+	lost   map[int]bool
+	failed map[int]bool
+}
+
+func (uc *unreliableClient) AppendLogLines(ctx context.Context, in *gopb.LogLines, opts ...grpc.CallOption) (*gopb.BuildloggerResponse, error) {
+	uc.calls++
+	if uc.failed[uc.calls] {
+		return nil, status.Error(codes.Internal, "append error")
+	}
+
+	resp, err := uc.BuildloggerClient.AppendLogLines(ctx, in, opts...)
+	if err == nil && uc.lost[uc.calls] {
+		return nil, status.Error(codes.DeadlineExceeded, "response lost")
+	}
+
+	return resp, err
+}
+
+func TestSequence(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, err := testutil.NewMockBuildloggerServer(ctx, 4900)
+	require.NoError(t, err)
+	conn, err := grpc.DialContext(ctx, srv.Address(), grpc.WithInsecure())
+	require.NoError(t, err)
+
+	newSequenceSender := func(t *testing.T, client *unreliableClient, logID string) *buildlogger {
+		client.BuildloggerClient = gopb.NewBuildloggerClient(conn)
+		b := createSender(ctx, client, &mockSender{Base: send.NewBase("test")})
+		b.opts.logIDs.add(logID)
+		b.opts.MaxBufferSize = 4096
+		b.opts.Retry = RetryOptions{MaxAttempts: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+		require.NoError(t, b.opts.Retry.validate())
+		require.NoError(t, b.SetLevel(send.LevelInfo{Default: level.Info, Threshold: level.Debug}))
+		return b
+	}
+	sendLines := func(t *testing.T, b *buildlogger, lines ...string) error {
+		for _, line := range lines {
+			b.Send(message.ConvertToComposer(level.Info, line))
+		}
+		return b.Flush(ctx)
+	}
+	checkServer := func(t *testing.T, logID string, expectedLines []string, duplicates, gaps []testutil.LineRange) {
+		srv.Mu.Lock()
+		defer srv.Mu.Unlock()
+
+		var lines []string
+		for _, req := range srv.Data[logID] {
+			for _, line := range req.Lines {
+				lines = append(lines, string(line.Data))
+			}
+		}
+		assert.Equal(t, expectedLines, lines)
+		assert.Equal(t, duplicates, srv.Duplicates)
+		assert.Equal(t, gaps, srv.Gaps)
+		srv.Duplicates = nil
+		srv.Gaps = nil
+	}
+
+	t.Run("InOrder", func(t *testing.T) {
+		b := newSequenceSender(t, &unreliableClient{}, "in_order")
+		require.NoError(t, sendLines(t, b, "0", "1"))
+		require.NoError(t, sendLines(t, b, "2"))
+
+		checkServer(t, "in_order", []string{"0", "1", "2"}, nil, nil)
+	})
+	t.Run("RetryAfterLostResponse", func(t *testing.T) {
+		b := newSequenceSender(t, &unreliableClient{lost: map[int]bool{2: true}}, "lost")
+		require.NoError(t, sendLines(t, b, "0"))
+		require.NoError(t, sendLines(t, b, "1", "2"))
+		require.NoError(t, sendLines(t, b, "3"))
+
+		checkServer(t, "lost", []string{"0", "1", "2", "1", "2", "3"}, []testutil.LineRange{
+			{LogID: "lost", Writer: b.writer, Start: 1, Count: 2},
+		}, nil)
+	})
+	t.Run("DroppedBatch", func(t *testing.T) {
+		b := newSequenceSender(t, &unreliableClient{failed: map[int]bool{2: true}}, "dropped")
+		require.NoError(t, sendLines(t, b, "0"))
+		assert.Error(t, sendLines(t, b, "1", "2"))
+		require.NoError(t, sendLines(t, b, "3"))
+
+		checkServer(t, "dropped", []string{"0", "3"}, nil, []testutil.LineRange{
+			{LogID: "dropped", Writer: b.writer, Start: 1, Count: 2},
+		})
+	})
+	t.Run("SplitBatchReplayedFromSpool", func(t *testing.T) {
+		dir := t.TempDir()
+		first := newSequenceSender(t, &unreliableClient{failed: map[int]bool{2: true}}, "spooled")
+		require.NoError(t, first.openSpool(dir))
+		first.opts.MaxRPCSize = 1
+		assert.Error(t, sendLines(t, first, "0", "1", "2"))
+		first.cancel()
+
+		second := newSequenceSender(t, &unreliableClient{}, "spooled")
+		require.NoError(t, second.openSpool(dir))
+		require.NoError(t, sendLines(t, second, "3"))
+
+		// The first sender's remaining lines keep their numbers when
+		// replayed by the second sender, whose lines are numbered on
+		// their own.
+		checkServer(t, "spooled", []string{"0", "1", "2", "3"}, nil, nil)
+		assert.NotEqual(t, first.writer, second.writer)
+	})
+}
+
+func TestWithSequence(t *testing.T) {
+	ctx := withSequence(context.Background(), "writer", 42)
+	md, ok := metadata.FromOutgoingContext(ctx)
+	require.True(t, ok)
+	assert.Equal(t, []string{"writer"}, md.Get(timber.BuildloggerWriterKey))
+	assert.Equal(t, []string{"42"}, md.Get(timber.BuildloggerSequenceKey))
+
+	_, ok = metadata.FromOutgoingContext(withSequence(context.Background(), "", 42))
+	assert.False(t, ok)
+}
+
+func TestSpoolSequence(t *testing.T) {
+	for _, test := range []struct {
+		writer string
+		first  uint64
+	}{
+		{writer: "writer", first: 0},
+		{writer: "writer", first: 1 << 40},
+		{},
+	} {
+		t.Run(fmt.Sprintf("%q/%d", test.writer, test.first), func(t *testing.T) {
+			b := &batch{logID: "id", lines: []*gopb.LogLine{{Data: []byte("line")}}, writer: test.writer, first: test.first}
+			data, err := proto.Marshal(b.export())
+			require.NoError(t, err)
+
+			lines := &gopb.LogLines{}
+			require.NoError(t, proto.Unmarshal(data, lines))
+			assert.Equal(t, "id", lines.LogId)
+			require.Len(t, lines.Lines, 1)
+			writer, first := spoolSequence(lines)
+			assert.Equal(t, test.writer, writer)
+			assert.Equal(t, test.first, first)
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package buildlogger
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+)
+
+// SlogHandler is a log/slog Handler that sends each record to a Buildlogger
+// Sender as one message. With a structured log format, the message's payload
+// is a document holding the record's message, under "msg", and its
+// attributes, with groups as nested documents. Otherwise, the message is the
+// record's message followed by its attributes as key=value pairs, with the
+// keys of grouped attributes qualified by the group names, separated by dots.
+// The time of the record is used as the time of the log line.
+type SlogHandler struct {
+	sender Sender
+	format LogFormat
+	attrs  []slogAttrs
+	groups []string
+}
+
+// slogAttrs are attributes added with WithAttrs, along with the groups open
+// at the time.
+type slogAttrs struct {
+	groups []string
+	attrs  []slog.Attr
+}
+
+// NewSlogHandler returns a log/slog Handler backed by a new Buildlogger Sender
+// created with the given options. Closing the handler's Sender flushes the
+// remaining records and closes the log.
+func NewSlogHandler(opts *LoggerOptions) (*SlogHandler, error) {
+	return NewSlogHandlerWithContext(context.Background(), opts)
+}
+
+// NewSlogHandlerWithContext returns a log/slog Handler backed by a new
+// Buildlogger Sender created with the given options, using the passed in
+// context.
+func NewSlogHandlerWithContext(ctx context.Context, opts *LoggerOptions) (*SlogHandler, error) {
+	s, err := MakeLoggerWithContext(ctx, "slog", opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "making buildlogger sender")
+	}
+
+	return &SlogHandler{sender: s.(Sender), format: opts.Format}, nil
+}
+
+// Sender returns the Sender backing the handler, which is shared by the
+// handlers derived from it with WithAttrs and WithGroup.
+func (h *SlogHandler) Sender() Sender { return h.sender }
+
+// Enabled returns whether the sender logs messages with the priority of the
+// given level, see SlogPriority.
+func (h *SlogHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return SlogPriority(l) >= h.sender.Level().Threshold
+}
+
+// Handle sends the record to the sender.
+func (h *SlogHandler) Handle(_ context.Context, r slog.Record) error {
+	m := &slogMessage{
+		Base: message.Base{Time: r.Time},
+		text: r.Message,
+	}
+	if err := m.SetPriority(SlogPriority(r.Level)); err != nil {
+		return errors.Wrap(err, "setting message priority")
+	}
+
+	if h.format.structured() {
+		m.fields = message.Fields{slog.MessageKey: r.Message}
+		for _, attrs := range h.attrs {
+			addSlogFields(m.fields, attrs.groups, attrs.attrs)
+		}
+		attrs := make([]slog.Attr, 0, r.NumAttrs())
+		r.Attrs(func(attr slog.Attr) bool {
+			attrs = append(attrs, attr)
+			return true
+		})
+		addSlogFields(m.fields, h.groups, attrs)
+	} else {
+		var b strings.Builder
+		b.WriteString(r.Message)
+		for _, attrs := range h.attrs {
+			for _, attr := range attrs.attrs {
+				writeSlogAttr(&b, attrs.groups, attr)
+			}
+		}
+		r.Attrs(func(attr slog.Attr) bool {
+			writeSlogAttr(&b, h.groups, attr)
+			return true
+		})
+		m.text = b.String()
+	}
+
+	h.sender.Send(m)
+
+	return nil
+}
+
+// WithAttrs returns a handler that adds the given attributes to each record,
+// in the groups open on this handler.
+func (h *SlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+
+	h2 := *h
+	h2.attrs = append(slices.Clip(h.attrs), slogAttrs{groups: h.groups, attrs: attrs})
+
+	return &h2
+}
+
+// WithGroup returns a handler that puts the attributes of each record, and
+// those added later with WithAttrs, in the given group.
+func (h *SlogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	h2 := *h
+	h2.groups = append(slices.Clip(h.groups), name)
+
+	return &h2
+}
+
+// SlogPriority returns the grip priority of the given log/slog level. Levels
+// between the standard slog levels have the priority of the next lower
+// standard level.
+func SlogPriority(l slog.Level) level.Priority {
+	switch {
+	case l >= slog.LevelError:
+		return level.Error
+	case l >= slog.LevelWarn:
+		return level.Warning
+	case l >= slog.LevelInfo:
+		return level.Info
+	default:
+		return level.Debug
+	}
+}
+
+// slogMessage is the message sent for a log/slog record.
+type slogMessage struct {
+	message.Base
+	text   string
+	fields message.Fields
+}
+
+func (m *slogMessage) String() string { return m.text }
+func (m *slogMessage) Loggable() bool { return true }
+
+func (m *slogMessage) Raw() interface{} {
+	if m.fields == nil {
+		return m.text
+	}
+
+	return m.fields
+}
+
+// addSlogFields adds the attributes, in the given groups, to the fields.
+// Following the log/slog rules, empty attributes are ignored, as are groups
+// without attributes, and the attributes of a group with an empty key are
+// added to the enclosing group.
+func addSlogFields(fields message.Fields, groups []string, attrs []slog.Attr) {
+	for _, attr := range attrs {
+		attr.Value = attr.Value.Resolve()
+		if attr.Equal(slog.Attr{}) {
+			continue
+		}
+
+		if attr.Value.Kind() == slog.KindGroup {
+			inner := groups[:len(groups):len(groups)]
+			if attr.Key != "" {
+				inner = append(inner, attr.Key)
+			}
+			addSlogFields(fields, inner, attr.Value.Group())
+			continue
+		}
+
+		group := fields
+		for _, name := range groups {
+			next, ok := group[name].(message.Fields)
+			if !ok {
+				next = message.Fields{}
+				group[name] = next
+			}
+			group = next
+		}
+		group[attr.Key] = slogFieldValue(attr.Value)
+	}
+}
+
+// slogFieldValue returns the value of a resolved, non-group attribute for a
+// structured log line.
+func slogFieldValue(v slog.Value) interface{} {
+	switch v.Kind() {
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return err.Error()
+		}
+		return v.Any()
+	case slog.KindBool:
+		return v.Bool()
+	case slog.KindDuration:
+		return v.Duration()
+	case slog.KindFloat64:
+		return v.Float64()
+	case slog.KindInt64:
+		return v.Int64()
+	case slog.KindString:
+		return v.String()
+	case slog.KindTime:
+		return v.Time()
+	case slog.KindUint64:
+		return v.Uint64()
+	default:
+		return v.String()
+	}
+}
+
+// writeSlogAttr writes the attribute, in the given groups, as one or more
+// space separated key=value pairs, following the same rules as addSlogFields.
+func writeSlogAttr(b *strings.Builder, groups []string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+
+	if attr.Value.Kind() == slog.KindGroup {
+		inner := groups[:len(groups):len(groups)]
+		if attr.Key != "" {
+			inner = append(inner, attr.Key)
+		}
+		for _, groupAttr := range attr.Value.Group() {
+			writeSlogAttr(b, inner, groupAttr)
+		}
+		return
+	}
+
+	b.WriteByte(' ')
+	for _, name := range groups {
+		b.WriteString(quoteSlogText(name))
+		b.WriteByte('.')
+	}
+	b.WriteString(quoteSlogText(attr.Key))
+	b.WriteByte('=')
+
+	var value string
+	switch attr.Value.Kind() {
+	case slog.KindTime:
+		value = attr.Value.Time().Format(time.RFC3339Nano)
+	case slog.KindAny:
+		if err, ok := attr.Value.Any().(error); ok {
+			value = err.Error()
+			break
+		}
+		value = attr.Value.String()
+	default:
+		value = attr.Value.String()
+	}
+	b.WriteString(quoteSlogText(value))
+}
+
+// quoteSlogText quotes the key or value of an attribute if it is empty or
+// would otherwise be ambiguous.
+func quoteSlogText(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if unicode.IsSpace(r) || r == '"' || r == '=' || !unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+
+	return s
+}
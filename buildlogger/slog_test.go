@@ -0,0 +1,166 @@
+package buildlogger
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/send"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlogHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	newSlogHandler := func(t *testing.T, format LogFormat) (*SlogHandler, *LoggerOptions) {
+		opts := &LoggerOptions{TaskID: "task", LocalDir: t.TempDir(), Format: format}
+		h, err := NewSlogHandlerWithContext(ctx, opts)
+		require.NoError(t, err)
+		return h, opts
+	}
+	// logRecord handles a record with the given level, message, and
+	// attributes, timestamped ts.
+	logRecord := func(t *testing.T, h slog.Handler, l slog.Level, msg string, attrs ...slog.Attr) {
+		r := slog.NewRecord(ts, l, msg, 0)
+		r.AddAttrs(attrs...)
+		require.NoError(t, h.Handle(ctx, r))
+	}
+	getLines := func(t *testing.T, opts *LoggerOptions) []LogLine {
+		var lines []LogLine
+		for line, err := range GetLines(ctx, GetOptions{LocalDir: opts.LocalDir, ID: opts.GetLogID()}) {
+			require.NoError(t, err)
+			lines = append(lines, line)
+		}
+		return lines
+	}
+	getStructuredLines := func(t *testing.T, opts *LoggerOptions) []StructuredLine {
+		r, err := Get(ctx, GetOptions{LocalDir: opts.LocalDir, ID: opts.GetLogID()})
+		require.NoError(t, err)
+		d, err := NewStructuredLineDecoder(r, opts.Format)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, d.Close()) }()
+
+		var lines []StructuredLine
+		for {
+			var line StructuredLine
+			if err := d.Decode(&line); err != nil {
+				break
+			}
+			lines = append(lines, line)
+		}
+		return lines
+	}
+
+	t.Run("Text", func(t *testing.T) {
+		h, opts := newSlogHandler(t, LogFormatText)
+		logger := slog.New(h)
+		logger.Info("started", "port", 8080, "addr", "local host")
+		logger.With("request", 1).WithGroup("http").Warn("slow", slog.Group("resp", "status", 200, "size", ""), "took", time.Second)
+		logRecord(t, h, slog.LevelError, "failed", slog.Any("err", errors.New("boom")), slog.Time("at", ts))
+		require.NoError(t, h.Sender().Close())
+
+		lines := getLines(t, opts)
+		require.Len(t, lines, 3)
+		assert.Equal(t, `started port=8080 addr="local host"`, lines[0].Data)
+		assert.Equal(t, level.Info, lines[0].Priority)
+		assert.Equal(t, `slow request=1 http.resp.status=200 http.resp.size="" http.took=1s`, lines[1].Data)
+		assert.Equal(t, level.Warning, lines[1].Priority)
+		assert.Equal(t, "failed err=boom at=2020-01-02T03:04:05Z", lines[2].Data)
+		assert.Equal(t, level.Error, lines[2].Priority)
+		assert.True(t, ts.Equal(lines[2].Timestamp))
+	})
+	t.Run("JSON", func(t *testing.T) {
+		h, opts := newSlogHandler(t, LogFormatJSON)
+		logger := slog.New(h).With("request", 1).WithGroup("http").With("method", "GET").WithGroup("resp")
+		logger.Info("done", "status", 200, slog.Group("", "inline", true), slog.Group("empty"))
+		logRecord(t, h, slog.LevelInfo, "no attributes")
+		require.NoError(t, h.Sender().Close())
+
+		lines := getStructuredLines(t, opts)
+		require.Len(t, lines, 2)
+		assert.Equal(t, map[string]interface{}{
+			"msg":     "done",
+			"request": float64(1),
+			"http": map[string]interface{}{
+				"method": "GET",
+				"resp": map[string]interface{}{
+					"status": float64(200),
+					"inline": true,
+				},
+			},
+		}, lines[0].Data)
+		assert.Equal(t, level.Info, lines[0].Priority)
+		assert.Equal(t, map[string]interface{}{"msg": "no attributes"}, lines[1].Data)
+		assert.True(t, ts.Equal(lines[1].Timestamp))
+	})
+	t.Run("EmptyGroupsOmitted", func(t *testing.T) {
+		h, opts := newSlogHandler(t, LogFormatText)
+		slog.New(h).WithGroup("unused").Info("message", slog.Attr{}, slog.Group("empty"))
+		require.NoError(t, h.Sender().Close())
+
+		lines := getLines(t, opts)
+		require.Len(t, lines, 1)
+		assert.Equal(t, "message", lines[0].Data)
+	})
+	t.Run("Enabled", func(t *testing.T) {
+		h, _ := newSlogHandler(t, LogFormatText)
+		assert.True(t, h.Enabled(ctx, slog.LevelDebug))
+
+		require.NoError(t, h.Sender().SetLevel(send.LevelInfo{Default: level.Info, Threshold: level.Warning}))
+		assert.False(t, h.Enabled(ctx, slog.LevelInfo))
+		assert.True(t, h.Enabled(ctx, slog.LevelWarn))
+		assert.True(t, h.WithGroup("group").Enabled(ctx, slog.LevelError))
+		require.NoError(t, h.Sender().Close())
+	})
+	t.Run("DerivedHandlersAreIndependent", func(t *testing.T) {
+		h, opts := newSlogHandler(t, LogFormatText)
+		base := slog.New(h).With("a", 1)
+		first := base.With("b", 2)
+		second := base.With("c", 3)
+		first.Info("first")
+		second.Info("second")
+		base.Info("base")
+		require.NoError(t, h.Sender().Close())
+
+		var data []string
+		for _, line := range getLines(t, opts) {
+			data = append(data, line.Data)
+		}
+		assert.Equal(t, []string{"first a=1 b=2", "second a=1 c=3", "base a=1"}, data)
+	})
+	t.Run("InvalidOptions", func(t *testing.T) {
+		_, err := NewSlogHandlerWithContext(ctx, &LoggerOptions{})
+		assert.Error(t, err)
+	})
+}
+
+func TestSlogPriority(t *testing.T) {
+	for l, expected := range map[slog.Level]level.Priority{
+		slog.LevelDebug - 4: level.Debug,
+		slog.LevelDebug:     level.Debug,
+		slog.LevelInfo:      level.Info,
+		slog.LevelInfo + 2:  level.Info,
+		slog.LevelWarn:      level.Warning,
+		slog.LevelError:     level.Error,
+		slog.LevelError + 4: level.Error,
+	} {
+		assert.Equal(t, expected, SlogPriority(l), l.String())
+	}
+}
+
+func TestQuoteSlogText(t *testing.T) {
+	assert.Equal(t, "plain", quoteSlogText("plain"))
+	assert.Equal(t, `""`, quoteSlogText(""))
+	assert.Equal(t, `"a b"`, quoteSlogText("a b"))
+	assert.Equal(t, `"a=b"`, quoteSlogText("a=b"))
+	assert.Equal(t, `"line\nbreak"`, quoteSlogText("line\nbreak"))
+	assert.Equal(t, `"\"quoted\""`, quoteSlogText(`"quoted"`))
+	assert.False(t, strings.ContainsAny(quoteSlogText("tab\there"), "\t"))
+}
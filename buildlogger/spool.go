@@ -0,0 +1,195 @@
+package buildlogger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+)
+
+const spoolFileExt = ".batch"
+
+// spool is a write-ahead directory of log line batches that have not been
+// acknowledged by Cedar. Each batch is stored in its own file named by the
+// batch's sequence number, so batches are replayed in the order they were
+// created regardless of the order in which they were spooled, including
+// batches left behind by a previous process using the same directory. A
+// spool directory must not be shared by concurrently open senders.
+type spool struct {
+	mu      sync.Mutex
+	dir     string
+	pending []uint64
+}
+
+// openSpool opens, creating if necessary, the spool directory and loads any
+// batches that are still pending from previous use.
+func openSpool(dir string) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "creating spool directory '%s'", dir)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading spool directory '%s'", dir)
+	}
+
+	s := &spool{dir: dir}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), spoolFileExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), spoolFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.pending = append(s.pending, seq)
+	}
+	sort.Slice(s.pending, func(i, j int) bool { return s.pending[i] < s.pending[j] })
+
+	return s, nil
+}
+
+// len returns the number of batches waiting to be replayed. It is safe to call
+// on a nil spool.
+func (s *spool) len() int {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.pending)
+}
+
+// first returns the lowest pending sequence number, if any.
+func (s *spool) first() (uint64, bool) {
+	return s.firstAfter(0)
+}
+
+// firstAfter returns the lowest pending sequence number greater than seq, if
+// any.
+func (s *spool) firstAfter(seq uint64) (uint64, bool) {
+	if s == nil {
+		return 0, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx := sort.Search(len(s.pending), func(i int) bool { return s.pending[i] > seq })
+	if idx == len(s.pending) {
+		return 0, false
+	}
+	return s.pending[idx], true
+}
+
+// last returns the highest pending sequence number, or 0 if there are no
+// pending batches.
+func (s *spool) last() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.pending) == 0 {
+		return 0
+	}
+	return s.pending[len(s.pending)-1]
+}
+
+// write durably persists the batch with the given sequence number.
+func (s *spool) write(seq uint64, lines *gopb.LogLines) error {
+	data, err := proto.Marshal(lines)
+	if err != nil {
+		return errors.Wrap(err, "marshalling log lines")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp := filepath.Join(s.dir, fmt.Sprintf(".%020d.tmp", seq))
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "creating spool file")
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return errors.Wrap(err, "writing spool file")
+	}
+	if err = os.Rename(tmp, s.path(seq)); err != nil {
+		_ = os.Remove(tmp)
+		return errors.Wrap(err, "committing spool file")
+	}
+
+	idx := sort.Search(len(s.pending), func(i int) bool { return s.pending[i] >= seq })
+	if idx == len(s.pending) || s.pending[idx] != seq {
+		s.pending = append(s.pending, 0)
+		copy(s.pending[idx+1:], s.pending[idx:])
+		s.pending[idx] = seq
+	}
+
+	return nil
+}
+
+// read returns the pending batch with the given sequence number. A corrupt
+// batch can never be replayed, so it is moved out of the way instead of
+// blocking the spool.
+func (s *spool) read(seq uint64) (*gopb.LogLines, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path(seq))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading spooled batch %d", seq)
+	}
+
+	lines := &gopb.LogLines{}
+	if err = proto.Unmarshal(data, lines); err != nil {
+		s.removePending(seq)
+		if renameErr := os.Rename(s.path(seq), s.path(seq)+".corrupt"); renameErr != nil {
+			return nil, errors.Wrapf(renameErr, "moving aside corrupt spooled batch %d", seq)
+		}
+		return nil, errors.Wrapf(err, "unmarshalling spooled batch %d", seq)
+	}
+
+	return lines, nil
+}
+
+// remove deletes the batch with the given sequence number once it has been
+// replayed.
+func (s *spool) remove(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(s.path(seq)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "removing replayed batch %d", seq)
+	}
+	s.removePending(seq)
+
+	return nil
+}
+
+func (s *spool) removePending(seq uint64) {
+	for i := range s.pending {
+		if s.pending[i] == seq {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolFileExt))
+}
@@ -0,0 +1,132 @@
+package buildlogger
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpool(t *testing.T) {
+	batches := []*gopb.LogLines{
+		{LogId: "id", Lines: []*gopb.LogLine{{Data: []byte("one")}}},
+		{LogId: "id", Lines: []*gopb.LogLine{{Data: []byte("two")}, {Data: []byte("three")}}},
+		{LogId: "id2", Lines: []*gopb.LogLine{{Data: []byte("four")}}},
+	}
+
+	drain := func(t *testing.T, s *spool) []*gopb.LogLines {
+		var replayed []*gopb.LogLines
+		for {
+			seq, ok := s.first()
+			if !ok {
+				return replayed
+			}
+			lines, err := s.read(seq)
+			require.NoError(t, err)
+			replayed = append(replayed, lines)
+			require.NoError(t, s.remove(seq))
+		}
+	}
+
+	t.Run("ReadsInSequenceOrder", func(t *testing.T) {
+		s, err := openSpool(t.TempDir())
+		require.NoError(t, err)
+		require.NoError(t, s.write(3, batches[2]))
+		require.NoError(t, s.write(1, batches[0]))
+		require.NoError(t, s.write(2, batches[1]))
+		assert.Equal(t, len(batches), s.len())
+		assert.EqualValues(t, 3, s.last())
+
+		replayed := drain(t, s)
+		require.Len(t, replayed, len(batches))
+		for i := range batches {
+			assert.Equal(t, batches[i].LogId, replayed[i].LogId)
+			require.Len(t, replayed[i].Lines, len(batches[i].Lines))
+			for j := range batches[i].Lines {
+				assert.Equal(t, batches[i].Lines[j].Data, replayed[i].Lines[j].Data)
+			}
+		}
+		assert.Zero(t, s.len())
+		assert.Zero(t, s.last())
+		entries, err := os.ReadDir(s.dir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+	t.Run("FirstAfter", func(t *testing.T) {
+		s, err := openSpool(t.TempDir())
+		require.NoError(t, err)
+		require.NoError(t, s.write(2, batches[0]))
+		require.NoError(t, s.write(5, batches[1]))
+
+		seq, ok := s.firstAfter(0)
+		assert.True(t, ok)
+		assert.EqualValues(t, 2, seq)
+		seq, ok = s.firstAfter(2)
+		assert.True(t, ok)
+		assert.EqualValues(t, 5, seq)
+		_, ok = s.firstAfter(5)
+		assert.False(t, ok)
+	})
+	t.Run("RewriteDoesNotDuplicate", func(t *testing.T) {
+		s, err := openSpool(t.TempDir())
+		require.NoError(t, err)
+		require.NoError(t, s.write(1, batches[0]))
+		require.NoError(t, s.write(1, batches[1]))
+		assert.Equal(t, 1, s.len())
+
+		lines, err := s.read(1)
+		require.NoError(t, err)
+		assert.Equal(t, batches[1].Lines[0].Data, lines.Lines[0].Data)
+	})
+	t.Run("ReopensPendingBatches", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := openSpool(dir)
+		require.NoError(t, err)
+		require.NoError(t, s.write(1, batches[0]))
+		require.NoError(t, s.write(2, batches[1]))
+
+		s, err = openSpool(dir)
+		require.NoError(t, err)
+		assert.Equal(t, 2, s.len())
+		assert.EqualValues(t, 2, s.last())
+		require.NoError(t, s.write(3, batches[2]))
+
+		replayed := drain(t, s)
+		require.Len(t, replayed, 3)
+		assert.Equal(t, batches[0].Lines[0].Data, replayed[0].Lines[0].Data)
+		assert.Equal(t, batches[2].LogId, replayed[2].LogId)
+	})
+	t.Run("MovesAsideCorruptBatches", func(t *testing.T) {
+		s, err := openSpool(t.TempDir())
+		require.NoError(t, err)
+		require.NoError(t, s.write(1, batches[0]))
+		require.NoError(t, os.WriteFile(s.path(1), []byte("not a protobuf"), 0644))
+		require.NoError(t, s.write(2, batches[1]))
+
+		_, err = s.read(1)
+		assert.Error(t, err)
+		assert.Equal(t, 1, s.len())
+		_, err = os.Stat(s.path(1) + ".corrupt")
+		assert.NoError(t, err)
+
+		seq, ok := s.first()
+		require.True(t, ok)
+		assert.EqualValues(t, 2, seq)
+	})
+	t.Run("NilSpool", func(t *testing.T) {
+		var s *spool
+		assert.Zero(t, s.len())
+		_, ok := s.first()
+		assert.False(t, ok)
+	})
+	t.Run("IgnoresUnknownFiles", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hello"), 0644))
+		s, err := openSpool(dir)
+		require.NoError(t, err)
+		assert.Zero(t, s.len())
+	})
+}
@@ -0,0 +1,188 @@
+package buildlogger
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/mongodb/grip/send"
+)
+
+// flushLatencySamples is the number of most recent flushes used to compute
+// the flush latency percentiles.
+const flushLatencySamples = 1000
+
+// Sender is a grip Sender backed by cedar Buildlogger that reports statistics
+// about the delivery of its log lines and can be closed with a deadline. The
+// senders returned by this package implement Sender.
+type Sender interface {
+	send.Sender
+	// Stats returns a snapshot of the sender's statistics.
+	Stats() Stats
+	// CloseWithContext closes the sender, like Close, with the given exit
+	// code and bounded by the given context.
+	CloseWithContext(ctx context.Context, exitCode int32) error
+}
+
+// Stats describe the delivery of the log lines of a Buildlogger Sender, for
+// monitoring the health of log shipping.
+type Stats struct {
+	// The log lines, and bytes of log line data, sent to cedar.
+	LinesSent int
+	BytesSent int
+	// The log lines, and bytes of log line data, given up on, either
+	// because all send attempts were exhausted or because the queue
+	// overflowed.
+	LinesDropped int
+	BytesDropped int
+	// The batches of log lines given up on after exhausting all send
+	// attempts, or dropped whole to make room in the queue.
+	BatchesDropped int
+	// The log lines, and bytes of log line data, suppressed according to
+	// the sender's suppress options.
+	LinesSuppressed int
+	BytesSuppressed int
+	// The number of flushes that sent, or tried to send, log lines.
+	Flushes int
+	// The number of failed RPCs, counting each failed attempt of an RPC
+	// that is retried.
+	RPCErrors int
+	// The last time log lines were sent to cedar.
+	LastFlush time.Time
+	// The number of bytes of log lines held in memory waiting to be sent,
+	// both buffered and queued.
+	BufferSize int
+	// The flush latency percentiles over the most recent flushes.
+	FlushLatencyP50 time.Duration
+	FlushLatencyP99 time.Duration
+}
+
+// fields returns the statistics as grip message fields.
+func (s Stats) fields() message.Fields {
+	return message.Fields{
+		"lines_sent":           s.LinesSent,
+		"bytes_sent":           s.BytesSent,
+		"lines_dropped":        s.LinesDropped,
+		"bytes_dropped":        s.BytesDropped,
+		"batches_dropped":      s.BatchesDropped,
+		"lines_suppressed":     s.LinesSuppressed,
+		"bytes_suppressed":     s.BytesSuppressed,
+		"flushes":              s.Flushes,
+		"rpc_errors":           s.RPCErrors,
+		"last_flush":           s.LastFlush,
+		"buffer_size":          s.BufferSize,
+		"flush_latency_p50_ms": s.FlushLatencyP50.Milliseconds(),
+		"flush_latency_p99_ms": s.FlushLatencyP99.Milliseconds(),
+	}
+}
+
+// senderStats accumulates the statistics that are not otherwise tracked by
+// the sender. It has its own lock since it is updated during RPCs, when the
+// sender's lock is not held.
+type senderStats struct {
+	mu        sync.Mutex
+	linesSent int
+	bytesSent int
+	flushes   int
+	rpcErrors int
+	latencies []time.Duration
+	next      int
+}
+
+func (s *senderStats) recordSent(lines, bytes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.linesSent += lines
+	s.bytesSent += bytes
+}
+
+// recordRPC counts the RPC error, if any, and returns it.
+func (s *senderStats) recordRPC(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rpcErrors++
+
+	return err
+}
+
+func (s *senderStats) recordFlush(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.flushes++
+	if len(s.latencies) < flushLatencySamples {
+		s.latencies = append(s.latencies, latency)
+		return
+	}
+	s.latencies[s.next] = latency
+	s.next = (s.next + 1) % flushLatencySamples
+}
+
+// export fills in the statistics tracked here.
+func (s *senderStats) export(stats *Stats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats.LinesSent = s.linesSent
+	stats.BytesSent = s.bytesSent
+	stats.Flushes = s.flushes
+	stats.RPCErrors = s.rpcErrors
+
+	if len(s.latencies) == 0 {
+		return
+	}
+	sorted := append([]time.Duration{}, s.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	stats.FlushLatencyP50 = percentile(sorted, 50)
+	stats.FlushLatencyP99 = percentile(sorted, 99)
+}
+
+// percentile returns the nearest-rank percentile of the sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+// Stats returns a snapshot of the sender's statistics. Stats is thread safe.
+func (b *buildlogger) Stats() Stats {
+	b.mu.Lock()
+	stats := Stats{
+		LinesDropped:    b.dropped.lines,
+		BytesDropped:    b.dropped.bytes,
+		BatchesDropped:  b.dropped.batches,
+		LinesSuppressed: b.suppression.lines,
+		BytesSuppressed: b.suppression.bytes,
+		LastFlush:       b.lastFlush,
+		BufferSize:      b.bufferSize + b.queueSize,
+	}
+	b.mu.Unlock()
+
+	b.stats.export(&stats)
+
+	return stats
+}
+
+// sendStats sends the sender's statistics to the stats sender, if any.
+func (b *buildlogger) sendStats() {
+	if b.opts.StatsSender == nil {
+		return
+	}
+
+	fields := b.Stats().fields()
+	fields["sender"] = b.Name()
+	fields["log_ids"] = b.opts.GetLogIDs()
+	b.opts.StatsSender.Send(message.NewFieldsMessage(level.Info, "buildlogger sender stats", fields))
+}
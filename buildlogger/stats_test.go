@@ -0,0 +1,130 @@
+package buildlogger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/mongodb/grip/send"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newStatsSender := func(t *testing.T, mc *mockClient) *buildlogger {
+		b := createSender(ctx, mc, &mockSender{Base: send.NewBase("test")})
+		b.opts.MaxBufferSize = 4096
+		require.NoError(t, b.SetLevel(send.LevelInfo{Default: level.Info, Threshold: level.Debug}))
+		return b
+	}
+
+	t.Run("Sent", func(t *testing.T) {
+		b := newStatsSender(t, &mockClient{})
+		assert.Equal(t, Stats{}, b.Stats())
+
+		b.Send(message.ConvertToComposer(level.Info, "first\nsecond"))
+		assert.Equal(t, 11, b.Stats().BufferSize)
+
+		require.NoError(t, b.Flush(ctx))
+		stats := b.Stats()
+		assert.Equal(t, 2, stats.LinesSent)
+		assert.Equal(t, 11, stats.BytesSent)
+		assert.Equal(t, 1, stats.Flushes)
+		assert.Zero(t, stats.RPCErrors)
+		assert.Zero(t, stats.BufferSize)
+		assert.False(t, stats.LastFlush.IsZero())
+		assert.True(t, stats.FlushLatencyP50 <= stats.FlushLatencyP99)
+
+		// Flushing nothing is not counted.
+		require.NoError(t, b.Flush(ctx))
+		assert.Equal(t, 1, b.Stats().Flushes)
+	})
+	t.Run("Errors", func(t *testing.T) {
+		mc := &mockClient{appendErr: true}
+		b := newStatsSender(t, mc)
+
+		b.Send(message.ConvertToComposer(level.Info, "line"))
+		assert.Error(t, b.Flush(ctx))
+		assert.Error(t, b.Flush(ctx))
+		stats := b.Stats()
+		assert.Equal(t, 2, stats.RPCErrors)
+		assert.Equal(t, 2, stats.Flushes)
+		assert.Zero(t, stats.LinesSent)
+		assert.Equal(t, 4, stats.BufferSize)
+		assert.True(t, stats.LastFlush.IsZero())
+	})
+	t.Run("Dropped", func(t *testing.T) {
+		b := newStatsSender(t, &mockClient{appendErr: true})
+		b.opts.OverflowPolicy = OverflowDropNewest
+		b.budget = newMemoryBudget(4)
+
+		b.Send(message.ConvertToComposer(level.Info, "line"))
+		b.Send(message.ConvertToComposer(level.Info, "dropped"))
+		stats := b.Stats()
+		assert.Equal(t, 1, stats.LinesDropped)
+		assert.Equal(t, 7, stats.BytesDropped)
+		assert.Zero(t, stats.BatchesDropped)
+	})
+	t.Run("DroppedBatches", func(t *testing.T) {
+		b := newStatsSender(t, &mockClient{appendErr: true})
+		b.opts.Retry = RetryOptions{MaxAttempts: 1}
+		require.NoError(t, b.opts.Retry.validate())
+
+		b.Send(message.ConvertToComposer(level.Info, "first\nsecond"))
+		assert.Error(t, b.Flush(ctx))
+		b.Send(message.ConvertToComposer(level.Info, "third"))
+		assert.Error(t, b.Flush(ctx))
+		stats := b.Stats()
+		assert.Equal(t, 2, stats.BatchesDropped)
+		assert.Equal(t, 3, stats.LinesDropped)
+	})
+	t.Run("StatsSender", func(t *testing.T) {
+		statsSender, err := send.NewInternalLogger("stats", send.LevelInfo{Default: level.Info, Threshold: level.Debug})
+		require.NoError(t, err)
+		b := newStatsSender(t, &mockClient{})
+		b.opts.StatsSender = statsSender
+		b.opts.logIDs.add("log")
+
+		b.Send(message.ConvertToComposer(level.Info, "line"))
+		require.NoError(t, b.Close())
+
+		require.True(t, statsSender.HasMessage())
+		msg := statsSender.GetMessage()
+		assert.Equal(t, level.Info, msg.Priority)
+		fields, ok := msg.Message.Raw().(message.Fields)
+		require.True(t, ok)
+		assert.Equal(t, 1, fields["lines_sent"])
+		assert.Equal(t, 4, fields["bytes_sent"])
+		assert.Equal(t, "test", fields["sender"])
+		assert.Equal(t, []string{"log"}, fields["log_ids"])
+	})
+	t.Run("Interface", func(t *testing.T) {
+		s, err := MakeLoggerWithContext(ctx, "test", &LoggerOptions{LocalDir: t.TempDir()})
+		require.NoError(t, err)
+		_, ok := s.(Sender)
+		assert.True(t, ok)
+		require.NoError(t, s.Close())
+	})
+}
+
+func TestFlushLatencyPercentiles(t *testing.T) {
+	s := &senderStats{}
+	for i := 1; i <= flushLatencySamples+100; i++ {
+		s.recordFlush(time.Duration(i) * time.Millisecond)
+	}
+
+	var stats Stats
+	s.export(&stats)
+	assert.Equal(t, flushLatencySamples+100, stats.Flushes)
+	// Only the most recent flushes are sampled, which took 101ms to
+	// 1100ms.
+	assert.Equal(t, 600*time.Millisecond, stats.FlushLatencyP50)
+	assert.Equal(t, 1090*time.Millisecond, stats.FlushLatencyP99)
+
+	assert.Equal(t, time.Second, percentile([]time.Duration{time.Second}, 50))
+}
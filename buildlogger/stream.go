@@ -0,0 +1,243 @@
+package buildlogger
+
+import (
+	"context"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/mongodb/grip/level"
+	"github.com/pkg/errors"
+)
+
+// streamedLines are log lines sent over the current stream. The server only
+// acknowledges the lines of a stream when the stream is closed, so they are
+// held until then, to be resent if the stream breaks first.
+type streamedLines struct {
+	seq    uint64
+	lines  *gopb.LogLines
+	size   int
+	writer string
+	first  uint64
+	// last is set if the lines are the last of their batch.
+	last bool
+}
+
+// streamLines sends lines of the batch over the stream, opening the stream if
+// necessary. The stream lives for the lifetime of the log, so it is not bound
+// to the context of any one flush. If the stream is broken, it is reopened
+// once and the lines not yet acknowledged are resent. The lines are counted as
+// sent once acknowledged, see ackStream. It must be called with the flush lock
+// held.
+func (b *buildlogger) streamLines(ctx context.Context, next *batch, lines *gopb.LogLines) error {
+	if b.stream != nil && (next.writer != b.streamWriter || (next.writer != "" && next.first != b.streamNext)) {
+		// The lines of a stream are numbered consecutively from the
+		// sequence number it was opened with, see withSequence.
+		if err := b.ackStream(ctx); err != nil {
+			return err
+		}
+	}
+
+	pending := &streamedLines{
+		seq:    next.seq,
+		lines:  lines,
+		writer: next.writer,
+		first:  next.first,
+		last:   len(lines.Lines) == len(next.lines),
+	}
+	for _, line := range lines.Lines {
+		pending.size += len(line.Data)
+	}
+
+	err := b.opts.Retry.do(ctx, func(ctx context.Context) error {
+		return b.stats.recordRPC(b.sendStreamed(pending))
+	})
+	if err != nil {
+		return errors.Wrap(err, "sending log lines over stream")
+	}
+
+	b.streamed = append(b.streamed, pending)
+	b.streamedSize += pending.size
+	b.streamNext = pending.first + uint64(len(lines.Lines))
+
+	return nil
+}
+
+// sendStreamed sends the lines over the stream, opening it if necessary, and
+// reopening it once if it is broken.
+func (b *buildlogger) sendStreamed(pending *streamedLines) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if b.stream == nil {
+			if err = b.openStream(pending); err != nil {
+				return err
+			}
+		}
+
+		if err = b.stream.Send(pending.lines); err == nil {
+			return nil
+		}
+		err = b.breakStream(err)
+	}
+
+	return err
+}
+
+// openStream opens a stream numbered from the first line not yet
+// acknowledged, or else from the given lines, and resends the lines not yet
+// acknowledged.
+func (b *buildlogger) openStream(next *streamedLines) error {
+	first := next
+	if len(b.streamed) > 0 {
+		first = b.streamed[0]
+	}
+
+	ctx, cancel := context.WithCancel(withSequence(b.ctx, first.writer, first.first))
+	stream, err := b.client.StreamLogLines(ctx)
+	if err != nil {
+		cancel()
+		return errors.Wrap(err, "opening log lines stream")
+	}
+	b.stream = stream
+	b.streamCancel = cancel
+	b.streamWriter = first.writer
+
+	for _, resend := range b.streamed {
+		if err = b.stream.Send(resend.lines); err != nil {
+			return b.breakStream(err)
+		}
+	}
+
+	return nil
+}
+
+// breakStream closes a stream that could not be sent to and returns why it
+// broke. The error returned by Send does not describe why the stream broke,
+// the status is only available on receive.
+func (b *buildlogger) breakStream(err error) error {
+	if _, closeErr := b.stream.CloseAndRecv(); closeErr != nil {
+		err = closeErr
+	}
+	b.abandonStream()
+
+	return err
+}
+
+func (b *buildlogger) abandonStream() {
+	b.streamCancel()
+	b.stream = nil
+	b.streamCancel = nil
+}
+
+// ackStream closes the stream, if any, and waits for the server to acknowledge
+// the lines sent over it, which are then counted as sent and, once all the
+// lines of their batch are, removed from the spool. If the stream breaks
+// first, it is reopened and the lines are resent, as long as the retry policy
+// allows. It must be called with the flush lock held.
+func (b *buildlogger) ackStream(ctx context.Context) error {
+	if len(b.streamed) == 0 {
+		return nil
+	}
+
+	err := b.opts.Retry.do(ctx, func(ctx context.Context) error {
+		if b.stream == nil {
+			if err := b.openStream(b.streamed[0]); err != nil {
+				return b.stats.recordRPC(err)
+			}
+		}
+
+		_, err := b.stream.CloseAndRecv()
+		b.abandonStream()
+		return b.stats.recordRPC(err)
+	})
+	if err != nil {
+		return errors.Wrap(err, "closing log lines stream")
+	}
+
+	for _, acked := range b.streamed {
+		b.stats.recordSent(len(acked.lines.Lines), acked.size)
+		if acked.last && b.spool != nil {
+			if err = b.spool.remove(acked.seq); err != nil {
+				b.logLocal(level.Error, err)
+			}
+		}
+	}
+	b.streamed = nil
+	b.streamedSize = 0
+
+	return nil
+}
+
+// streamFull returns whether the lines not yet acknowledged by the server have
+// reached the max queue size, after which the stream is closed to acknowledge
+// them.
+func (b *buildlogger) streamFull() bool {
+	return len(b.streamed) > 0 && b.opts.MaxQueueSize >= 0 && b.streamedSize >= b.opts.MaxQueueSize
+}
+
+// unstream takes back the lines of a stream that could not be acknowledged, so
+// that they are handled like the failed batch, if any: the lines of the failed
+// batch are put back in front of its remaining lines, and those of earlier
+// batches are put back at the front of the queue, in order. It must be called
+// with the flush lock held.
+func (b *buildlogger) unstream(failed *batch) {
+	if b.stream != nil {
+		b.abandonStream()
+	}
+	if len(b.streamed) == 0 {
+		return
+	}
+
+	var (
+		earlier  []*batch
+		restored []*gopb.LogLine
+	)
+	restoredFirst := uint64(0)
+	for _, s := range b.streamed {
+		if failed != nil && s.seq == failed.seq {
+			if len(restored) == 0 {
+				restoredFirst = s.first
+			}
+			restored = append(restored, s.lines.Lines...)
+			failed.size += s.size
+			continue
+		}
+		if n := len(earlier); n > 0 && earlier[n-1].seq == s.seq {
+			earlier[n-1].lines = append(earlier[n-1].lines, s.lines.Lines...)
+			earlier[n-1].size += s.size
+			continue
+		}
+		earlier = append(earlier, &batch{
+			seq:    s.seq,
+			logID:  s.lines.LogId,
+			lines:  append([]*gopb.LogLine{}, s.lines.Lines...),
+			size:   s.size,
+			writer: s.writer,
+			first:  s.first,
+		})
+	}
+	if len(restored) > 0 {
+		failed.lines = append(restored, failed.lines...)
+		failed.first = restoredFirst
+	}
+	b.streamed = nil
+	b.streamedSize = 0
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i := len(earlier) - 1; i >= 0; i-- {
+		b.requeue(earlier[i])
+	}
+}
+
+// handleFailedStream handles the lines of a stream that could not be
+// acknowledged, when no batch is in flight, like a batch that could not be
+// sent, see handleFailedBatch.
+func (b *buildlogger) handleFailedStream(ctx context.Context, err error) error {
+	b.unstream(nil)
+
+	b.mu.Lock()
+	failed := b.dequeue()
+	b.mu.Unlock()
+
+	return b.handleFailedBatch(ctx, failed, false, err)
+}
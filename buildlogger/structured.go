@@ -0,0 +1,215 @@
+package buildlogger
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// StructuredLine is a single line of a log in the JSON or BSON format. Each
+// message sent to a Buildlogger Sender with a structured format is stored as
+// one StructuredLine document, with Data holding the message's raw payload.
+// BSON documents are stored base64 encoded, since their raw bytes may contain
+// newlines, which Cedar does not store correctly.
+type StructuredLine struct {
+	Timestamp time.Time      `bson:"ts" json:"ts"`
+	Priority  level.Priority `bson:"priority" json:"priority"`
+	Prefix    string         `bson:"prefix,omitempty" json:"prefix,omitempty"`
+	Data      interface{}    `bson:"data" json:"data"`
+}
+
+func (f LogFormat) structured() bool {
+	return f == LogFormatJSON || f == LogFormatBSON
+}
+
+func (f LogFormat) marshal(v interface{}) ([]byte, error) {
+	switch f {
+	case LogFormatJSON:
+		return json.Marshal(v)
+	case LogFormatBSON:
+		doc, err := bson.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, base64.StdEncoding.EncodedLen(len(doc)))
+		base64.StdEncoding.Encode(data, doc)
+		return data, nil
+	default:
+		return nil, errors.Errorf("log format %d is not structured", f)
+	}
+}
+
+// unmarshal decodes data serialized by marshal into v. Documents decoded into
+// an interface{} are maps, in both formats.
+func (f LogFormat) unmarshal(data []byte, v interface{}) error {
+	switch f {
+	case LogFormatJSON:
+		return json.Unmarshal(data, v)
+	case LogFormatBSON:
+		doc, err := decodeBSONLine(data)
+		if err != nil {
+			return err
+		}
+		d := bson.NewDecoder(bson.NewDocumentReader(bytes.NewReader(doc)))
+		d.DefaultDocumentM()
+		return d.Decode(v)
+	default:
+		return errors.Errorf("log format %d is not structured", f)
+	}
+}
+
+// decodeBSONLine returns the BSON document encoded in a line by marshal.
+func decodeBSONLine(data []byte) ([]byte, error) {
+	doc := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(doc, data)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding base64 BSON document")
+	}
+
+	return doc[:n], nil
+}
+
+// structuredLines returns one log line per loggable message, serialized in the
+// sender's format. A message whose payload cannot be serialized is stored
+// using its string form instead.
+func (b *buildlogger) structuredLines(m message.Composer, sent time.Time) []*gopb.LogLine {
+	msgs := []message.Composer{m}
+	if group, ok := m.(*message.GroupComposer); ok {
+		msgs = group.Messages()
+	}
+
+	lines := make([]*gopb.LogLine, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg == nil || !msg.Loggable() {
+			continue
+		}
+
+		ts := b.lineTime(msg, sent)
+		line := StructuredLine{
+			Timestamp: ts,
+			Priority:  msg.Priority(),
+			Prefix:    b.opts.Prefix,
+			Data:      b.opts.Redact.redactValue(msg.Raw(), b.opts.Format),
+		}
+		data, err := b.opts.Format.marshal(line)
+		if err != nil {
+			b.logLocal(level.Warning, errors.Wrap(err, "serializing log line payload, storing as text"))
+			line.Data = b.opts.Redact.redact(msg.String())
+			if data, err = b.opts.Format.marshal(line); err != nil {
+				b.logLocal(level.Error, err)
+				continue
+			}
+		}
+
+		lines = append(lines, &gopb.LogLine{
+			Priority:  int32(msg.Priority()),
+			Timestamp: timestamppb.New(ts),
+			Data:      data,
+		})
+	}
+
+	return lines
+}
+
+// StructuredLineDecoder decodes the lines of a log in the JSON or BSON format
+// as returned by Cedar.
+type StructuredLineDecoder struct {
+	r      *bufio.Reader
+	json   *json.Decoder
+	closer io.Closer
+}
+
+// NewStructuredLineDecoder returns a decoder that reads structured log lines
+// in the given format from r. If r is an io.Closer, it is closed by the
+// decoder's Close.
+func NewStructuredLineDecoder(r io.Reader, format LogFormat) (*StructuredLineDecoder, error) {
+	if !format.structured() {
+		return nil, errors.Errorf("cannot decode log lines in format %d", format)
+	}
+
+	d := &StructuredLineDecoder{r: bufio.NewReader(r)}
+	if format == LogFormatJSON {
+		d.json = json.NewDecoder(d.r)
+	}
+	if closer, ok := r.(io.Closer); ok {
+		d.closer = closer
+	}
+
+	return d, nil
+}
+
+// Decode decodes the next log line into v, which is usually a
+// *StructuredLine or a pointer to a struct with the same fields and a
+// concrete type for Data. Decode returns io.EOF when there are no more lines.
+func (d *StructuredLineDecoder) Decode(v interface{}) error {
+	if d.json != nil {
+		return d.json.Decode(v)
+	}
+
+	var line []byte
+	for len(line) == 0 {
+		var err error
+		line, err = d.r.ReadBytes('\n')
+		line = bytes.TrimSpace(line)
+		if err == io.EOF && len(line) > 0 {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	doc, err := decodeBSONLine(line)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(bson.Unmarshal(doc, v), "unmarshalling BSON document")
+}
+
+// Close closes the underlying reader, if it is an io.Closer.
+func (d *StructuredLineDecoder) Close() error {
+	if d.closer == nil {
+		return nil
+	}
+
+	return d.closer.Close()
+}
+
+// GetStructured returns a decoder for the lines of the logs requested via HTTP
+// to a Cedar service, which must be in the given structured format. The
+// print time and print priority options are not supported, since they would
+// corrupt the stored documents; the timestamp and priority of each line are
+// part of the decoded StructuredLine instead.
+func GetStructured(ctx context.Context, opts GetOptions, format LogFormat) (*StructuredLineDecoder, error) {
+	if opts.PrintTime || opts.PrintPriority {
+		return nil, errors.New("cannot print time or priority for structured log lines")
+	}
+	if opts.Meta {
+		return nil, errors.New("cannot decode log metadata as structured log lines")
+	}
+	if opts.Follow {
+		return nil, errors.New("cannot follow structured log lines")
+	}
+	if !format.structured() {
+		return nil, errors.Errorf("cannot decode log lines in format %d", format)
+	}
+
+	r, err := Get(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewStructuredLineDecoder(r, format)
+}
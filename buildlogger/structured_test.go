@@ -0,0 +1,229 @@
+package buildlogger
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/evergreen-ci/timber"
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/mongodb/grip/send"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestStructuredLines(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, format := range []LogFormat{LogFormatJSON, LogFormatBSON} {
+		unmarshal := json.Unmarshal
+		if format == LogFormatBSON {
+			unmarshal = func(data []byte, v interface{}) error {
+				doc, err := base64.StdEncoding.DecodeString(string(data))
+				if err != nil {
+					return err
+				}
+				return bson.Unmarshal(doc, v)
+			}
+		}
+
+		t.Run(gopb.LogFormat(format).String(), func(t *testing.T) {
+			t.Run("Fields", func(t *testing.T) {
+				b := createSender(ctx, &mockClient{}, &mockSender{Base: send.NewBase("test")})
+				b.opts.Format = format
+				b.opts.Prefix = "prefix"
+				b.opts.MaxBufferSize = 4096
+
+				b.Send(message.NewFields(level.Info, message.Fields{"message": "hello\nworld", "count": 2}))
+				require.Len(t, b.buffer, 1)
+				assert.EqualValues(t, level.Info, b.buffer[0].Priority)
+				// Cedar does not store lines containing newlines
+				// correctly, even in the raw BSON document.
+				assert.NotContains(t, string(b.buffer[0].Data), "\n")
+
+				var line struct {
+					Timestamp time.Time      `bson:"ts" json:"ts"`
+					Priority  level.Priority `bson:"priority" json:"priority"`
+					Prefix    string         `bson:"prefix" json:"prefix"`
+					Data      struct {
+						Message string `bson:"message" json:"message"`
+						Count   int    `bson:"count" json:"count"`
+					} `bson:"data" json:"data"`
+				}
+				require.NoError(t, unmarshal(b.buffer[0].Data, &line))
+				assert.Equal(t, level.Info, line.Priority)
+				assert.Equal(t, "prefix", line.Prefix)
+				assert.Equal(t, "hello\nworld", line.Data.Message)
+				assert.Equal(t, 2, line.Data.Count)
+				assert.WithinDuration(t, b.buffer[0].Timestamp.AsTime(), line.Timestamp, time.Millisecond)
+			})
+			t.Run("GroupComposer", func(t *testing.T) {
+				b := createSender(ctx, &mockClient{}, &mockSender{Base: send.NewBase("test")})
+				b.opts.Format = format
+				b.opts.MaxBufferSize = 4096
+
+				b.Send(message.NewGroupComposer([]message.Composer{
+					message.NewFields(level.Info, message.Fields{"n": 1}),
+					message.NewString(""),
+					message.NewFields(level.Error, message.Fields{"n": 2}),
+				}))
+				require.Len(t, b.buffer, 2)
+				assert.EqualValues(t, level.Info, b.buffer[0].Priority)
+				assert.EqualValues(t, level.Error, b.buffer[1].Priority)
+			})
+		})
+	}
+
+	t.Run("UnserializablePayload", func(t *testing.T) {
+		ms := &mockSender{Base: send.NewBase("test")}
+		b := createSender(ctx, &mockClient{}, ms)
+		b.opts.Format = LogFormatJSON
+		b.opts.MaxBufferSize = 4096
+
+		m := message.NewFields(level.Info, message.Fields{"ch": make(chan int)})
+		b.Send(m)
+		require.Len(t, b.buffer, 1)
+		line := &StructuredLine{}
+		require.NoError(t, json.Unmarshal(b.buffer[0].Data, line))
+		assert.Equal(t, m.String(), line.Data)
+		assert.Contains(t, ms.lastMessage, "serializing log line payload")
+	})
+	t.Run("TextFormat", func(t *testing.T) {
+		b := createSender(ctx, &mockClient{}, &mockSender{Base: send.NewBase("test")})
+		b.opts.MaxBufferSize = 4096
+
+		m := message.NewFields(level.Info, message.Fields{"count": 2})
+		b.Send(m)
+		require.Len(t, b.buffer, 1)
+		assert.Equal(t, m.String(), string(b.buffer[0].Data))
+	})
+}
+
+func TestStructuredLineDecoder(t *testing.T) {
+	ts := time.Now().UTC().Truncate(time.Millisecond)
+	lines := []StructuredLine{
+		{Timestamp: ts, Priority: level.Info, Data: map[string]interface{}{"message": "one"}},
+		{Timestamp: ts, Priority: level.Warning, Data: map[string]interface{}{"message": "two\nlines"}},
+		{Timestamp: ts, Priority: level.Error, Prefix: "prefix", Data: map[string]interface{}{"message": "three"}},
+	}
+	encode := func(t *testing.T, format LogFormat) []byte {
+		var buf bytes.Buffer
+		for _, line := range lines {
+			data, err := format.marshal(line)
+			require.NoError(t, err)
+			buf.Write(data)
+			buf.WriteByte('\n')
+		}
+		return buf.Bytes()
+	}
+
+	for _, format := range []LogFormat{LogFormatJSON, LogFormatBSON} {
+		t.Run(gopb.LogFormat(format).String(), func(t *testing.T) {
+			t.Run("DecodesAllLines", func(t *testing.T) {
+				d, err := NewStructuredLineDecoder(bytes.NewReader(encode(t, format)), format)
+				require.NoError(t, err)
+
+				for _, expected := range lines {
+					var line struct {
+						Timestamp time.Time      `bson:"ts" json:"ts"`
+						Priority  level.Priority `bson:"priority" json:"priority"`
+						Prefix    string         `bson:"prefix" json:"prefix"`
+						Data      struct {
+							Message string `bson:"message" json:"message"`
+						} `bson:"data" json:"data"`
+					}
+					require.NoError(t, d.Decode(&line))
+					assert.True(t, expected.Timestamp.Equal(line.Timestamp))
+					assert.Equal(t, expected.Priority, line.Priority)
+					assert.Equal(t, expected.Prefix, line.Prefix)
+					assert.Equal(t, expected.Data.(map[string]interface{})["message"], line.Data.Message)
+				}
+				assert.Equal(t, io.EOF, d.Decode(&StructuredLine{}))
+				assert.NoError(t, d.Close())
+			})
+			t.Run("DecodesIntoStructuredLine", func(t *testing.T) {
+				d, err := NewStructuredLineDecoder(bytes.NewReader(encode(t, format)), format)
+				require.NoError(t, err)
+
+				line := &StructuredLine{}
+				require.NoError(t, d.Decode(line))
+				assert.Equal(t, level.Info, line.Priority)
+				assert.NotNil(t, line.Data)
+			})
+			t.Run("Truncated", func(t *testing.T) {
+				data := encode(t, format)
+				d, err := NewStructuredLineDecoder(bytes.NewReader(data[:len(data)-5]), format)
+				require.NoError(t, err)
+
+				for i := 0; i < len(lines)-1; i++ {
+					require.NoError(t, d.Decode(&StructuredLine{}))
+				}
+				err = d.Decode(&StructuredLine{})
+				assert.Error(t, err)
+				assert.NotEqual(t, io.EOF, err)
+			})
+		})
+	}
+	t.Run("TextFormat", func(t *testing.T) {
+		_, err := NewStructuredLineDecoder(bytes.NewReader(nil), LogFormatText)
+		assert.Error(t, err)
+	})
+}
+
+func TestGetStructured(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	line := StructuredLine{Timestamp: time.Now(), Priority: level.Info, Data: "hello"}
+	data, err := LogFormatBSON.marshal(line)
+	require.NoError(t, err)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(append(data, '\n'))
+	}))
+	defer server.Close()
+
+	opts := GetOptions{
+		Cedar: timber.GetOptions{BaseURL: server.URL},
+		ID:    "id",
+	}
+
+	t.Run("Decodes", func(t *testing.T) {
+		d, err := GetStructured(ctx, opts, LogFormatBSON)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, d.Close()) }()
+
+		decoded := &StructuredLine{}
+		require.NoError(t, d.Decode(decoded))
+		assert.Equal(t, "hello", decoded.Data)
+		assert.Equal(t, io.EOF, d.Decode(decoded))
+	})
+	t.Run("InvalidOptions", func(t *testing.T) {
+		printOpts := opts
+		printOpts.PrintTime = true
+		_, err := GetStructured(ctx, printOpts, LogFormatBSON)
+		assert.Error(t, err)
+
+		metaOpts := opts
+		metaOpts.Meta = true
+		_, err = GetStructured(ctx, metaOpts, LogFormatBSON)
+		assert.Error(t, err)
+
+		followOpts := opts
+		followOpts.Follow = true
+		_, err = GetStructured(ctx, followOpts, LogFormatBSON)
+		assert.Error(t, err)
+
+		_, err = GetStructured(ctx, opts, LogFormatText)
+		assert.Error(t, err)
+	})
+}
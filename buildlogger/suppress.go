@@ -0,0 +1,230 @@
+package buildlogger
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/evergreen-ci/juniper/gopb"
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// SuppressOptions configure the suppression of log lines by the Buildlogger
+// Sender, to keep runaway loops from flooding the log and hiding the lines
+// that matter. Suppressed lines are never buffered, and are replaced by
+// notices of how many lines were suppressed. Pending notices are sent when
+// the sender is flushed or closed, or when the flush interval elapses. By
+// default, nothing is suppressed.
+type SuppressOptions struct {
+	// Collapse consecutive identical lines with the same priority into
+	// the first one, followed by a notice of how many more times it was
+	// repeated once a different line is sent. Only supported by the text
+	// log format.
+	Repeated bool `bson:"repeated" json:"repeated" yaml:"repeated"`
+	// Collapse consecutive lines with the same priority that only differ
+	// in their numbers, such as attempt counts, durations, and
+	// timestamps, like Repeated does for identical lines. The notice
+	// includes the last of the collapsed lines. Only supported by the
+	// text log format.
+	Templated bool `bson:"templated" json:"templated" yaml:"templated"`
+	// The maximum number of lines sent per second. Once reached, lines
+	// are dropped until the second is over, after which a notice of how
+	// many lines were dropped is sent. Lines collapsed into a notice and
+	// the notices themselves do not count towards the limit.
+	MaxLinesPerSecond int `bson:"max_lines_per_second" json:"max_lines_per_second" yaml:"max_lines_per_second"`
+}
+
+func (opts *SuppressOptions) validate(format LogFormat) error {
+	if opts.MaxLinesPerSecond < 0 {
+		return errors.New("max lines per second cannot be negative")
+	}
+	if opts.collapse() && format.structured() {
+		return errors.New("collapsing repeated lines is only supported by the text log format")
+	}
+
+	return nil
+}
+
+func (opts *SuppressOptions) enabled() bool {
+	return opts.collapse() || opts.MaxLinesPerSecond > 0
+}
+
+func (opts *SuppressOptions) collapse() bool {
+	return opts.Repeated || opts.Templated
+}
+
+// suppression is the state of the suppression of a sender's log lines.
+type suppression struct {
+	// The last line let through while collapsing, the key compared to
+	// that of the next lines, and the lines collapsed into it since.
+	last       *gopb.LogLine
+	lastKey    string
+	repeats    int
+	varied     bool
+	lastRepeat *gopb.LogLine
+	// The start of the current rate limiting window, the lines let
+	// through during it, and the lines dropped since the last notice.
+	window          time.Time
+	windowLines     int
+	dropped         int
+	droppedBytes    int
+	droppedPriority int32
+	lastDropped     *timestamppb.Timestamp
+	// The totals of all suppressed lines, for the sender's statistics.
+	lines int
+	bytes int
+}
+
+// suppress returns the lines to buffer in place of the given ones: lines that
+// are collapsed or over the rate limit are left out, and notices of the lines
+// suppressed so far are added as needed. It must be called with the lock
+// held.
+func (b *buildlogger) suppress(lines []*gopb.LogLine, sent time.Time) []*gopb.LogLine {
+	opts := &b.opts.Suppress
+	s := &b.suppression
+
+	out := make([]*gopb.LogLine, 0, len(lines))
+	for _, line := range lines {
+		if opts.collapse() {
+			key := string(line.Data)
+			if opts.Templated {
+				key = lineTemplate(line.Data)
+			}
+			if s.last != nil && key == s.lastKey && line.Priority == s.last.Priority {
+				s.repeats++
+				s.varied = s.varied || !bytes.Equal(line.Data, s.last.Data)
+				s.lastRepeat = line
+				s.lines++
+				s.bytes += len(line.Data)
+				continue
+			}
+
+			out = b.appendRepeatNotice(out)
+			s.last, s.lastKey = line, key
+		}
+
+		if opts.MaxLinesPerSecond > 0 {
+			if sent.Sub(s.window) >= time.Second {
+				out = b.appendRateNotice(out)
+				s.window = sent
+				s.windowLines = 0
+			}
+			if s.windowLines >= opts.MaxLinesPerSecond {
+				s.dropped++
+				s.droppedBytes += len(line.Data)
+				s.droppedPriority = max(s.droppedPriority, line.Priority)
+				s.lastDropped = line.Timestamp
+				s.lines++
+				s.bytes += len(line.Data)
+				// Lines are not collapsed into a dropped line,
+				// which would make the repeat notice refer to a
+				// line that was never sent.
+				s.last = nil
+				continue
+			}
+			s.windowLines++
+		}
+
+		out = append(out, line)
+	}
+
+	return out
+}
+
+// suppressionNotices returns the notices of the lines suppressed since the
+// last notices, if any. A run of collapsed lines continues after its notice.
+// It must be called with the lock held.
+func (b *buildlogger) suppressionNotices() []*gopb.LogLine {
+	return b.appendRateNotice(b.appendRepeatNotice(nil))
+}
+
+func (b *buildlogger) appendRepeatNotice(lines []*gopb.LogLine) []*gopb.LogLine {
+	s := &b.suppression
+	if s.repeats == 0 {
+		return lines
+	}
+
+	text := fmt.Sprintf("last line repeated %d more times", s.repeats)
+	if s.varied {
+		text = fmt.Sprintf("%s with different numbers, most recently: %s", text, s.lastRepeat.Data)
+	}
+	notice := b.noticeLine(s.lastRepeat.Timestamp, s.last.Priority, text, message.Fields{"repeated_lines": s.repeats})
+	s.repeats = 0
+	s.varied = false
+
+	return append(lines, notice)
+}
+
+func (b *buildlogger) appendRateNotice(lines []*gopb.LogLine) []*gopb.LogLine {
+	s := &b.suppression
+	if s.dropped == 0 {
+		return lines
+	}
+
+	text := fmt.Sprintf("suppressed %d lines (%d bytes) over the limit of %d lines per second", s.dropped, s.droppedBytes, b.opts.Suppress.MaxLinesPerSecond)
+	notice := b.noticeLine(s.lastDropped, s.droppedPriority, text, message.Fields{
+		"suppressed_lines": s.dropped,
+		"suppressed_bytes": s.droppedBytes,
+	})
+	s.dropped = 0
+	s.droppedBytes = 0
+	s.droppedPriority = 0
+
+	return append(lines, notice)
+}
+
+// noticeLine returns a log line, in the sender's format, with the given text
+// or, for structured formats, the text and the given fields.
+func (b *buildlogger) noticeLine(ts *timestamppb.Timestamp, priority int32, text string, fields message.Fields) *gopb.LogLine {
+	var data []byte
+	if b.opts.Format.structured() {
+		fields[message.FieldsMsgName] = text
+		var err error
+		data, err = b.opts.Format.marshal(StructuredLine{
+			Timestamp: ts.AsTime(),
+			Priority:  level.Priority(priority),
+			Prefix:    b.opts.Prefix,
+			Data:      fields,
+		})
+		if err != nil {
+			b.logLocal(level.Error, errors.Wrap(err, "serializing suppression notice"))
+			data = []byte(text)
+		}
+	} else {
+		if b.opts.Prefix != "" {
+			text = fmt.Sprintf("[%s] %s", b.opts.Prefix, text)
+		}
+		data = []byte(text)
+	}
+
+	return &gopb.LogLine{
+		Priority:  priority,
+		Timestamp: ts,
+		Data:      data,
+	}
+}
+
+// lineTemplate returns the line with each run of digits replaced by '#'.
+func lineTemplate(data []byte) string {
+	var b strings.Builder
+	b.Grow(len(data))
+
+	digits := false
+	for _, c := range data {
+		if c >= '0' && c <= '9' {
+			if !digits {
+				b.WriteByte('#')
+			}
+			digits = true
+			continue
+		}
+		digits = false
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
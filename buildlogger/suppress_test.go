@@ -0,0 +1,196 @@
+package buildlogger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/mongodb/grip/send"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuppress(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newSuppressSender := func(t *testing.T, opts SuppressOptions) (*buildlogger, *mockClient) {
+		mc := &mockClient{}
+		b := createSender(ctx, mc, &mockSender{Base: send.NewBase("test")})
+		b.opts.MaxBufferSize = 1 << 20
+		b.opts.Suppress = opts
+		require.NoError(t, b.opts.Suppress.validate(b.opts.Format))
+		require.NoError(t, b.SetLevel(send.LevelInfo{Default: level.Info, Threshold: level.Debug}))
+		return b, mc
+	}
+	sentLines := func(mc *mockClient) []string {
+		var lines []string
+		for _, req := range mc.allLogLines {
+			for _, line := range req.Lines {
+				lines = append(lines, string(line.Data))
+			}
+		}
+		return lines
+	}
+
+	t.Run("Repeated", func(t *testing.T) {
+		b, mc := newSuppressSender(t, SuppressOptions{Repeated: true})
+		for i := 0; i < 5; i++ {
+			b.Send(message.ConvertToComposer(level.Info, "retrying"))
+		}
+		b.Send(message.ConvertToComposer(level.Error, "retrying"))
+		b.Send(message.ConvertToComposer(level.Info, "retrying 1\nretrying 2"))
+		b.Send(message.ConvertToComposer(level.Info, "done"))
+		require.NoError(t, b.Flush(ctx))
+
+		assert.Equal(t, []string{
+			"retrying",
+			"last line repeated 4 more times",
+			"retrying",
+			"retrying 1",
+			"retrying 2",
+			"done",
+		}, sentLines(mc))
+		assert.EqualValues(t, level.Info, mc.allLogLines[0].Lines[1].Priority)
+		stats := b.Stats()
+		assert.Equal(t, 4, stats.LinesSuppressed)
+		assert.Equal(t, 32, stats.BytesSuppressed)
+	})
+	t.Run("Templated", func(t *testing.T) {
+		b, mc := newSuppressSender(t, SuppressOptions{Templated: true})
+		for i := 0; i < 100; i++ {
+			b.Send(message.ConvertToComposer(level.Info, fmt.Sprintf("attempt %d failed after %dms", i, i*10)))
+		}
+		b.Send(message.ConvertToComposer(level.Info, "giving up"))
+		require.NoError(t, b.Flush(ctx))
+
+		assert.Equal(t, []string{
+			"attempt 0 failed after 0ms",
+			"last line repeated 99 more times with different numbers, most recently: attempt 99 failed after 990ms",
+			"giving up",
+		}, sentLines(mc))
+	})
+	t.Run("NoticeOnFlushAndClose", func(t *testing.T) {
+		b, mc := newSuppressSender(t, SuppressOptions{Repeated: true})
+		b.opts.Prefix = "proc"
+		b.opts.logIDs.add("id")
+		for i := 0; i < 3; i++ {
+			b.Send(message.ConvertToComposer(level.Info, "same"))
+		}
+		require.NoError(t, b.Flush(ctx))
+		// The run continues after the notice.
+		for i := 0; i < 2; i++ {
+			b.Send(message.ConvertToComposer(level.Info, "same"))
+		}
+		require.NoError(t, b.Close())
+
+		assert.Equal(t, []string{
+			"[proc] same",
+			"[proc] last line repeated 2 more times",
+			"[proc] last line repeated 2 more times",
+		}, sentLines(mc))
+	})
+	t.Run("NoticeOnFlushInterval", func(t *testing.T) {
+		b, mc := newSuppressSender(t, SuppressOptions{Repeated: true})
+		for i := 0; i < 3; i++ {
+			b.Send(message.ConvertToComposer(level.Info, "same"))
+		}
+		b.sealStale(0)
+		require.NoError(t, b.drain(ctx))
+		assert.Equal(t, []string{
+			"same",
+			"last line repeated 2 more times",
+		}, sentLines(mc))
+
+		// Nothing is pending once the notice is sent.
+		b.sealStale(0)
+		require.NoError(t, b.drain(ctx))
+		assert.Len(t, sentLines(mc), 2)
+	})
+	t.Run("RateLimit", func(t *testing.T) {
+		b, mc := newSuppressSender(t, SuppressOptions{MaxLinesPerSecond: 3})
+		b.opts.logIDs.add("id")
+		for i := 0; i < 10; i++ {
+			b.Send(message.ConvertToComposer(level.Info, fmt.Sprintf("line %d", i)))
+		}
+		b.Send(message.ConvertToComposer(level.Warning, "line 10"))
+		require.NoError(t, b.Flush(ctx))
+
+		lines := sentLines(mc)
+		require.Len(t, lines, 4)
+		assert.Equal(t, []string{"line 0", "line 1", "line 2"}, lines[:3])
+		assert.Equal(t, "suppressed 8 lines (49 bytes) over the limit of 3 lines per second", lines[3])
+		assert.EqualValues(t, level.Warning, mc.allLogLines[0].Lines[3].Priority)
+
+		// A new second starts a new window.
+		b.suppression.window = b.suppression.window.Add(-time.Second)
+		b.Send(message.ConvertToComposer(level.Info, "next"))
+		require.NoError(t, b.Close())
+		assert.Equal(t, "next", sentLines(mc)[4])
+		assert.Equal(t, 8, b.Stats().LinesSuppressed)
+	})
+	t.Run("RepeatedWithRateLimit", func(t *testing.T) {
+		b, mc := newSuppressSender(t, SuppressOptions{Repeated: true, MaxLinesPerSecond: 1})
+		b.Send(message.ConvertToComposer(level.Info, "first"))
+		b.Send(message.ConvertToComposer(level.Info, "second"))
+		b.Send(message.ConvertToComposer(level.Info, "second"))
+		b.suppression.window = b.suppression.window.Add(-time.Second)
+		b.Send(message.ConvertToComposer(level.Info, "second"))
+		b.Send(message.ConvertToComposer(level.Info, "second"))
+		require.NoError(t, b.Flush(ctx))
+
+		// Repeats of a dropped line are not collapsed into it.
+		assert.Equal(t, []string{
+			"first",
+			"suppressed 2 lines (12 bytes) over the limit of 1 lines per second",
+			"second",
+			"last line repeated 1 more times",
+		}, sentLines(mc))
+	})
+	t.Run("StructuredRateLimit", func(t *testing.T) {
+		b, mc := newSuppressSender(t, SuppressOptions{MaxLinesPerSecond: 1})
+		b.opts.Format = LogFormatJSON
+		b.Send(message.NewFields(level.Info, message.Fields{"n": 1}))
+		b.Send(message.NewFields(level.Info, message.Fields{"n": 2}))
+		require.NoError(t, b.Flush(ctx))
+
+		require.Len(t, mc.allLogLines, 1)
+		require.Len(t, mc.allLogLines[0].Lines, 2)
+		var notice struct {
+			Priority level.Priority         `json:"priority"`
+			Data     map[string]interface{} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(mc.allLogLines[0].Lines[1].Data, &notice))
+		assert.Equal(t, level.Info, notice.Priority)
+		assert.Equal(t, float64(1), notice.Data["suppressed_lines"])
+		// The size of a structured line is that of its serialized form.
+		size := b.Stats().BytesSuppressed
+		assert.Equal(t, float64(size), notice.Data["suppressed_bytes"])
+		assert.Equal(t, fmt.Sprintf("suppressed 1 lines (%d bytes) over the limit of 1 lines per second", size), notice.Data["message"])
+	})
+	t.Run("Disabled", func(t *testing.T) {
+		b, mc := newSuppressSender(t, SuppressOptions{})
+		for i := 0; i < 3; i++ {
+			b.Send(message.ConvertToComposer(level.Info, "same"))
+		}
+		require.NoError(t, b.Flush(ctx))
+		assert.Equal(t, []string{"same", "same", "same"}, sentLines(mc))
+	})
+	t.Run("InvalidOptions", func(t *testing.T) {
+		assert.Error(t, (&SuppressOptions{MaxLinesPerSecond: -1}).validate(LogFormatText))
+		assert.Error(t, (&SuppressOptions{Repeated: true}).validate(LogFormatJSON))
+		assert.Error(t, (&SuppressOptions{Templated: true}).validate(LogFormatBSON))
+		assert.NoError(t, (&SuppressOptions{MaxLinesPerSecond: 1}).validate(LogFormatJSON))
+	})
+}
+
+func TestLineTemplate(t *testing.T) {
+	assert.Equal(t, "attempt # took #.#s", lineTemplate([]byte("attempt 12 took 1.5s")))
+	assert.Equal(t, "no numbers", lineTemplate([]byte("no numbers")))
+	assert.Equal(t, "#-#-#T#:#:#Z", lineTemplate([]byte("2020-01-02T03:04:05Z")))
+	assert.Equal(t, "", lineTemplate(nil))
+}
@@ -0,0 +1,112 @@
+package buildlogger
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/mongodb/grip/message"
+)
+
+// timestampFields are the keys, in order of preference, of the message.Fields
+// entries that hold the time of the message.
+var timestampFields = []string{"ts", "time", "timestamp"}
+
+var baseType = reflect.TypeOf(message.Base{})
+
+// messageTime returns the time carried by the message, if any. This is a
+// time in one of the well known timestamp fields of a message.Fields payload,
+// or otherwise the time of the message.Base embedded in the composer.
+func messageTime(m message.Composer) (time.Time, bool) {
+	// The base time must be read before calling Raw, since some
+	// composers set it to the current time when their payload is
+	// collected.
+	baseTime := embeddedBaseTime(m)
+
+	if fields, ok := m.Raw().(message.Fields); ok {
+		for _, key := range timestampFields {
+			if ts, ok := fieldTime(fields[key]); ok {
+				return ts, true
+			}
+		}
+	}
+
+	return baseTime, !baseTime.IsZero()
+}
+
+func fieldTime(v interface{}) (time.Time, bool) {
+	switch ts := v.(type) {
+	case time.Time:
+		return ts, !ts.IsZero()
+	case *time.Time:
+		if ts == nil {
+			return time.Time{}, false
+		}
+		return *ts, !ts.IsZero()
+	case string:
+		parsed, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return parsed, !parsed.IsZero()
+	default:
+		return time.Time{}, false
+	}
+}
+
+func embeddedBaseTime(m message.Composer) time.Time {
+	rv := reflect.ValueOf(m)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return time.Time{}
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return time.Time{}
+	}
+
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		if !field.Anonymous {
+			continue
+		}
+
+		value := rv.Field(i)
+		if field.Type == reflect.PointerTo(baseType) {
+			if value.IsNil() {
+				continue
+			}
+			value = value.Elem()
+		} else if field.Type != baseType {
+			continue
+		}
+		if !value.CanInterface() {
+			continue
+		}
+
+		return value.Interface().(message.Base).Time
+	}
+
+	return time.Time{}
+}
+
+// lineTime returns the timestamp for the log lines of the message: the time
+// carried by the message, if any, or the time at which it was sent. When
+// monotonic timestamps are enabled, the timestamp is never earlier than that
+// of the previous line. It must be called with the lock held.
+func (b *buildlogger) lineTime(m message.Composer, sent time.Time) time.Time {
+	ts, ok := messageTime(m)
+	if !ok {
+		ts = sent
+	}
+
+	if b.opts.MonotonicTimestamps {
+		if ts.Before(b.lastTimestamp) {
+			ts = b.lastTimestamp
+		} else {
+			b.lastTimestamp = ts
+		}
+	}
+
+	return ts
+}
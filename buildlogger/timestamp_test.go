@@ -0,0 +1,151 @@
+package buildlogger
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/mongodb/grip/send"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type timedMessage struct {
+	message.Base
+	msg string
+}
+
+func newTimedMessage(ts time.Time, msg string) *timedMessage {
+	return &timedMessage{
+		Base: message.Base{Level: level.Info, Time: ts},
+		msg:  msg,
+	}
+}
+
+func (m *timedMessage) String() string   { return m.msg }
+func (m *timedMessage) Raw() interface{} { return m }
+func (m *timedMessage) Loggable() bool   { return m.msg != "" }
+
+func TestMessageTime(t *testing.T) {
+	ts := time.Date(2020, time.January, 2, 3, 4, 5, 6, time.UTC)
+
+	t.Run("NoTime", func(t *testing.T) {
+		_, ok := messageTime(message.NewString("hello"))
+		assert.False(t, ok)
+	})
+	t.Run("InvalidFieldUsesBase", func(t *testing.T) {
+		// Fields composers collect their creation time.
+		actual, ok := messageTime(message.NewFields(level.Info, message.Fields{"time": "yesterday"}))
+		require.True(t, ok)
+		assert.WithinDuration(t, time.Now(), actual, time.Minute)
+	})
+	t.Run("EmbeddedBase", func(t *testing.T) {
+		actual, ok := messageTime(newTimedMessage(ts, "hello"))
+		require.True(t, ok)
+		assert.True(t, ts.Equal(actual))
+	})
+	t.Run("CollectedBase", func(t *testing.T) {
+		m := message.NewString("hello")
+		_ = m.Raw()
+		actual, ok := messageTime(m)
+		require.True(t, ok)
+		assert.WithinDuration(t, time.Now(), actual, time.Minute)
+	})
+	t.Run("Fields", func(t *testing.T) {
+		for name, value := range map[string]interface{}{
+			"Time":        ts,
+			"TimePointer": &ts,
+			"String":      ts.Format(time.RFC3339Nano),
+		} {
+			t.Run(name, func(t *testing.T) {
+				actual, ok := messageTime(message.NewFields(level.Info, message.Fields{"time": value}))
+				require.True(t, ok)
+				assert.True(t, ts.Equal(actual))
+			})
+		}
+	})
+	t.Run("FieldPreference", func(t *testing.T) {
+		later := ts.Add(time.Hour)
+		actual, ok := messageTime(message.NewFields(level.Info, message.Fields{"timestamp": later, "ts": ts}))
+		require.True(t, ok)
+		assert.True(t, ts.Equal(actual))
+	})
+}
+
+func TestSendTimestamps(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ts := time.Now().Add(-time.Hour).UTC()
+
+	t.Run("UsesMessageTime", func(t *testing.T) {
+		b := createSender(ctx, &mockClient{}, &mockSender{Base: send.NewBase("test")})
+		b.opts.MaxBufferSize = 4096
+
+		b.Send(newTimedMessage(ts, "first\nsecond"))
+		b.Send(message.NewFields(level.Info, message.Fields{"ts": ts.Add(time.Minute), "msg": "third"}))
+		require.Len(t, b.buffer, 3)
+		assert.True(t, ts.Equal(b.buffer[0].Timestamp.AsTime()))
+		assert.True(t, ts.Equal(b.buffer[1].Timestamp.AsTime()))
+		assert.True(t, ts.Add(time.Minute).Equal(b.buffer[2].Timestamp.AsTime()))
+	})
+	t.Run("DefaultsToSendTime", func(t *testing.T) {
+		b := createSender(ctx, &mockClient{}, &mockSender{Base: send.NewBase("test")})
+		b.opts.MaxBufferSize = 4096
+
+		before := time.Now()
+		b.Send(message.ConvertToComposer(level.Info, "hello"))
+		require.Len(t, b.buffer, 1)
+		assert.False(t, b.buffer[0].Timestamp.AsTime().Before(before))
+		assert.False(t, b.buffer[0].Timestamp.AsTime().After(time.Now()))
+	})
+	t.Run("GroupComposer", func(t *testing.T) {
+		b := createSender(ctx, &mockClient{}, &mockSender{Base: send.NewBase("test")})
+		b.opts.MaxBufferSize = 4096
+
+		b.Send(message.NewGroupComposer([]message.Composer{
+			newTimedMessage(ts, "first"),
+			newTimedMessage(ts.Add(time.Second), "second"),
+		}))
+		require.Len(t, b.buffer, 2)
+		assert.True(t, ts.Equal(b.buffer[0].Timestamp.AsTime()))
+		assert.True(t, ts.Add(time.Second).Equal(b.buffer[1].Timestamp.AsTime()))
+	})
+	t.Run("StructuredLines", func(t *testing.T) {
+		b := createSender(ctx, &mockClient{}, &mockSender{Base: send.NewBase("test")})
+		b.opts.MaxBufferSize = 4096
+		b.opts.Format = LogFormatJSON
+
+		b.Send(message.NewFields(level.Info, message.Fields{"time": ts, "msg": "hello"}))
+		require.Len(t, b.buffer, 1)
+		line := &StructuredLine{}
+		require.NoError(t, json.Unmarshal(b.buffer[0].Data, line))
+		assert.True(t, ts.Equal(line.Timestamp))
+		assert.True(t, ts.Equal(b.buffer[0].Timestamp.AsTime()))
+	})
+	t.Run("NotMonotonic", func(t *testing.T) {
+		b := createSender(ctx, &mockClient{}, &mockSender{Base: send.NewBase("test")})
+		b.opts.MaxBufferSize = 4096
+
+		b.Send(newTimedMessage(ts, "first"))
+		b.Send(newTimedMessage(ts.Add(-time.Minute), "second"))
+		require.Len(t, b.buffer, 2)
+		assert.True(t, ts.Add(-time.Minute).Equal(b.buffer[1].Timestamp.AsTime()))
+	})
+	t.Run("Monotonic", func(t *testing.T) {
+		b := createSender(ctx, &mockClient{}, &mockSender{Base: send.NewBase("test")})
+		b.opts.MaxBufferSize = 4096
+		b.opts.MonotonicTimestamps = true
+
+		b.Send(newTimedMessage(ts, "first"))
+		b.Send(newTimedMessage(ts.Add(-time.Minute), "second"))
+		b.Send(newTimedMessage(ts.Add(time.Minute), "third"))
+		require.Len(t, b.buffer, 3)
+		assert.True(t, ts.Equal(b.buffer[0].Timestamp.AsTime()))
+		assert.True(t, ts.Equal(b.buffer[1].Timestamp.AsTime()))
+		assert.True(t, ts.Add(time.Minute).Equal(b.buffer[2].Timestamp.AsTime()))
+	})
+}
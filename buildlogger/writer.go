@@ -0,0 +1,113 @@
+package buildlogger
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/message"
+	"github.com/mongodb/grip/send"
+	"github.com/pkg/errors"
+)
+
+// defaultMaxLineLength is the maximum number of bytes of a line written to a
+// Writer. Longer lines are split into lines of at most this many bytes.
+const defaultMaxLineLength = 64 * 1024
+
+type writer struct {
+	mu            sync.Mutex
+	sender        send.Sender
+	priority      level.Priority
+	buffer        []byte
+	maxLineLength int
+	closed        bool
+}
+
+// NewWriter returns an io.WriteCloser that sends each line written to it as
+// a message with the given priority, such as to capture the stdout or stderr
+// of a subprocess. Lines may span any number of writes, a trailing carriage
+// return is stripped from each line, and a line longer than 64KB is split into
+// multiple messages. Empty lines are skipped. Closing the writer sends the
+// final, unterminated line, if any, but does not close the sender.
+func NewWriter(sender send.Sender, l level.Priority) io.WriteCloser {
+	return &writer{
+		sender:        sender,
+		priority:      l,
+		maxLineLength: defaultMaxLineLength,
+	}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, errors.New("writer is closed")
+	}
+
+	w.buffer = append(w.buffer, p...)
+	sent := false
+	for {
+		if i := bytes.IndexByte(w.buffer, '\n'); i >= 0 && i <= w.maxLineLength {
+			w.send(w.buffer[:i])
+			w.buffer = w.buffer[i+1:]
+			sent = true
+			continue
+		}
+		if len(w.buffer) > w.maxLineLength {
+			n := w.splitIndex()
+			w.send(w.buffer[:n])
+			w.buffer = w.buffer[n:]
+			sent = true
+			continue
+		}
+		break
+	}
+
+	if sent {
+		// Reclaim the space of the lines already sent.
+		w.buffer = append([]byte(nil), w.buffer...)
+	}
+
+	return len(p), nil
+}
+
+// splitIndex returns the length of the first piece of a line that is too long,
+// avoiding splitting a UTF-8 encoded character where possible.
+func (w *writer) splitIndex() int {
+	n := w.maxLineLength
+	for i := n; i > n-utf8.UTFMax && i > 0; i-- {
+		if utf8.RuneStart(w.buffer[i]) {
+			return i
+		}
+	}
+
+	return n
+}
+
+func (w *writer) send(line []byte) {
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	if len(line) == 0 {
+		return
+	}
+	w.sender.Send(message.NewDefaultMessage(w.priority, string(line)))
+}
+
+func (w *writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if len(w.buffer) > 0 {
+		w.send(w.buffer)
+		w.buffer = nil
+	}
+
+	return nil
+}
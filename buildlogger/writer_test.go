@@ -0,0 +1,115 @@
+package buildlogger
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mongodb/grip/level"
+	"github.com/mongodb/grip/send"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter(t *testing.T) {
+	newSender := func(t *testing.T) *send.InternalSender {
+		s, err := send.NewInternalLogger("test", send.LevelInfo{Default: level.Info, Threshold: level.Debug})
+		require.NoError(t, err)
+		return s
+	}
+	messages := func(s *send.InternalSender) []string {
+		var out []string
+		for s.HasMessage() {
+			out = append(out, s.GetMessage().Message.String())
+		}
+		return out
+	}
+
+	t.Run("Lines", func(t *testing.T) {
+		s := newSender(t)
+		w := NewWriter(s, level.Warning)
+
+		n, err := w.Write([]byte("first\nsecond\n"))
+		require.NoError(t, err)
+		assert.Equal(t, 13, n)
+		require.Equal(t, 2, s.Len())
+		msg := s.GetMessage()
+		assert.Equal(t, "first", msg.Message.String())
+		assert.Equal(t, level.Warning, msg.Message.Priority())
+		assert.Equal(t, []string{"second"}, messages(s))
+	})
+	t.Run("PartialLines", func(t *testing.T) {
+		s := newSender(t)
+		w := NewWriter(s, level.Info)
+
+		for _, chunk := range []string{"fir", "st\nsec", "ond", "\nthi"} {
+			_, err := w.Write([]byte(chunk))
+			require.NoError(t, err)
+		}
+		assert.Equal(t, []string{"first", "second"}, messages(s))
+		require.NoError(t, w.Close())
+		assert.Equal(t, []string{"thi"}, messages(s))
+	})
+	t.Run("CRLF", func(t *testing.T) {
+		s := newSender(t)
+		w := NewWriter(s, level.Info)
+
+		_, err := w.Write([]byte("first\r\nsecond\r"))
+		require.NoError(t, err)
+		_, err = w.Write([]byte("\nthird\r"))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		assert.Equal(t, []string{"first", "second", "third"}, messages(s))
+	})
+	t.Run("EmptyLinesSkipped", func(t *testing.T) {
+		s := newSender(t)
+		w := NewWriter(s, level.Info)
+
+		_, err := w.Write([]byte("first\n\n\r\nsecond\n"))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		assert.Equal(t, []string{"first", "second"}, messages(s))
+	})
+	t.Run("MaxLineLength", func(t *testing.T) {
+		s := newSender(t)
+		w := NewWriter(s, level.Info)
+		w.(*writer).maxLineLength = 4
+
+		_, err := w.Write([]byte("abcd\nabcdefghij"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"abcd", "abcd", "efgh"}, messages(s))
+		_, err = w.Write([]byte("k\n"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"ijk"}, messages(s))
+		assert.Empty(t, w.(*writer).buffer)
+	})
+	t.Run("MaxLineLengthRuneBoundary", func(t *testing.T) {
+		s := newSender(t)
+		w := NewWriter(s, level.Info)
+		w.(*writer).maxLineLength = 4
+
+		_, err := w.Write([]byte("abcédef\n"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"abc", "éde", "f"}, messages(s))
+	})
+	t.Run("DefaultMaxLineLength", func(t *testing.T) {
+		s := newSender(t)
+		w := NewWriter(s, level.Info)
+
+		_, err := w.Write([]byte(strings.Repeat("a", defaultMaxLineLength+10)))
+		require.NoError(t, err)
+		out := messages(s)
+		require.Len(t, out, 1)
+		assert.Len(t, out[0], defaultMaxLineLength)
+	})
+	t.Run("Close", func(t *testing.T) {
+		s := newSender(t)
+		w := NewWriter(s, level.Info)
+
+		require.NoError(t, w.Close())
+		assert.Zero(t, s.Len())
+		assert.NoError(t, w.Close())
+		_, err := w.Write([]byte("line\n"))
+		assert.Error(t, err)
+		assert.Zero(t, s.Len())
+	})
+}
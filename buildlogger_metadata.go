@@ -0,0 +1,13 @@
+package timber
+
+// The gRPC metadata keys of a Buildlogger AppendLogLines request that
+// identify its log lines: the ID of the sender that wrote them and the
+// sequence number of the first line, counting from zero across all of the
+// sender's logs. A line resent by a retry or spool replay keeps its sequence
+// number, so resent and missing lines can be detected. The keys of a
+// StreamLogLines request identify the first line of the stream, and the lines
+// of the stream are numbered consecutively from it.
+const (
+	BuildloggerWriterKey   = "buildlogger-writer"
+	BuildloggerSequenceKey = "buildlogger-sequence"
+)
@@ -0,0 +1,194 @@
+// timber-run runs a command and sends its stdout and stderr to cedar
+// buildlogger as two separate logs, whose process names are the process name
+// from the logger options, or the command's name, suffixed with ".stdout" and
+// ".stderr". The exit code of the command is recorded in both logs and is the
+// exit code of timber-run.
+//
+// Usage: timber-run -options <file> [-tee] -- <command> [args...]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/evergreen-ci/timber/buildlogger"
+	"github.com/mongodb/grip/level"
+	"github.com/pkg/errors"
+)
+
+const (
+	// exitCodeSetup is the exit code of timber-run when it fails before
+	// the command runs, such as when the logs cannot be created.
+	exitCodeSetup = 125
+	// exitCodeStart is the exit code of timber-run when the command
+	// cannot be started.
+	exitCodeStart = 127
+)
+
+// forwardedSignals are the signals sent to timber-run that are forwarded to
+// the command.
+var forwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}
+
+func main() {
+	var (
+		optsFile string
+		tee      bool
+	)
+
+	flag.StringVar(&optsFile, "options", "", "path to the buildlogger options file in json, yaml, or bson")
+	flag.BoolVar(&tee, "tee", false, "also copy the command's output to the stdout and stderr of timber-run")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s -options <file> [-tee] -- <command> [args...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if optsFile == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(exitCodeSetup)
+	}
+
+	os.Exit(run(optsFile, tee, flag.Args()))
+}
+
+// run runs the command with its output sent to buildlogger and returns the
+// exit code of timber-run.
+func run(optsFile string, tee bool, args []string) int {
+	opts, err := buildlogger.LoadLoggerOptions(optsFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, errors.Wrap(err, "loading buildlogger options"))
+		return exitCodeSetup
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	group, err := buildlogger.NewGroup(ctx, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, errors.Wrap(err, "creating buildlogger logs"))
+		return exitCodeSetup
+	}
+
+	procName := opts.ProcessName
+	if procName == "" {
+		procName = filepath.Base(args[0])
+	}
+	stdoutKey := buildlogger.GroupKey{ProcessName: procName + ".stdout", TestName: opts.TestName, Trial: opts.Trial}
+	stderrKey := buildlogger.GroupKey{ProcessName: procName + ".stderr", TestName: opts.TestName, Trial: opts.Trial}
+
+	stdout, err := newLogWriter(group, stdoutKey, level.Info)
+	if err != nil {
+		return closeGroup(group, exitCodeSetup, err)
+	}
+	stderr, err := newLogWriter(group, stderrKey, level.Error)
+	if err != nil {
+		return closeGroup(group, exitCodeSetup, err)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if tee {
+		cmd.Stdout = io.MultiWriter(stdout, os.Stdout)
+		cmd.Stderr = io.MultiWriter(stderr, os.Stderr)
+	}
+
+	// Signals are caught before the command starts so that none are
+	// missed, and forwarded so that the command can shut down cleanly
+	// and its remaining output is still logged.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, forwardedSignals...)
+	defer signal.Stop(sigs)
+
+	if err = cmd.Start(); err != nil {
+		fmt.Fprintln(stderr, errors.Wrapf(err, "starting command '%s'", args[0]))
+		_ = stdout.Close()
+		_ = stderr.Close()
+		return closeLogs(group, exitCodeStart, stdoutKey, stderrKey)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				_ = cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+	close(done)
+	_ = stdout.Close()
+	_ = stderr.Close()
+
+	return closeLogs(group, exitCode(err), stdoutKey, stderrKey)
+}
+
+func newLogWriter(group *buildlogger.Group, key buildlogger.GroupKey, l level.Priority) (io.WriteCloser, error) {
+	sender, err := group.Sender(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating log for '%s'", key.ProcessName)
+	}
+
+	return buildlogger.NewWriter(sender, l), nil
+}
+
+// exitCode returns the exit code of a command given the error returned by
+// waiting on it. Following the shell convention, the exit code of a command
+// killed by a signal is 128 plus the signal number.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		fmt.Fprintln(os.Stderr, errors.Wrap(err, "waiting for command"))
+		return exitCodeSetup
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+
+	return exitErr.ExitCode()
+}
+
+// closeLogs records the exit code in the logs and closes them, returning the
+// exit code of timber-run.
+func closeLogs(group *buildlogger.Group, code int, keys ...buildlogger.GroupKey) int {
+	for _, key := range keys {
+		if err := group.SetExitCode(key, int32(code)); err != nil {
+			fmt.Fprintln(os.Stderr, errors.Wrap(err, "setting exit code"))
+		}
+	}
+
+	return closeGroup(group, code, nil)
+}
+
+// closeGroup closes the logs, after reporting the given error, if any, and
+// returns the exit code of timber-run. When the command succeeded but its
+// logs could not be closed, timber-run fails.
+func closeGroup(group *buildlogger.Group, code int, err error) int {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if err = group.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, errors.Wrap(err, "closing buildlogger logs"))
+		if code == 0 {
+			return exitCodeSetup
+		}
+	}
+
+	return code
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		err      func() error
+		expected int
+	}{
+		{
+			name:     "Success",
+			err:      func() error { return exec.Command("sh", "-c", "exit 0").Run() },
+			expected: 0,
+		},
+		{
+			name:     "NonZeroExit",
+			err:      func() error { return exec.Command("sh", "-c", "exit 3").Run() },
+			expected: 3,
+		},
+		{
+			name:     "KilledBySignal",
+			err:      func() error { return exec.Command("sh", "-c", "kill -TERM $$").Run() },
+			expected: 128 + 15,
+		},
+		{
+			name:     "WaitError",
+			err:      func() error { return errors.New("wait failed") },
+			expected: exitCodeSetup,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, exitCode(test.err()))
+		})
+	}
+}
@@ -3,6 +3,7 @@ package testutil
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"sync"
@@ -13,6 +14,7 @@ import (
 	"github.com/mongodb/grip"
 	"github.com/pkg/errors"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 // MockCedarServer sets up a mock Cedar server for sending metrics, test
@@ -209,14 +211,23 @@ func (m *MockTestResultsServer) CloseTestResultsRecord(_ context.Context, in *go
 // MockBuildloggerServer sets up a mock Cedar server for testing buildlogger
 // logs using gRPC.
 type MockBuildloggerServer struct {
-	Mu        sync.Mutex
-	CreateErr bool
-	AppendErr bool
-	CloseErr  bool
-	Create    *gopb.LogData
-	Data      map[string][]*gopb.LogLines
-	Close     *gopb.LogEndInfo
-	DialOpts  timber.DialCedarOptions
+	Mu         sync.Mutex
+	CreateErr  bool
+	AppendErr  bool
+	StreamErr  bool
+	CloseErr   bool
+	Create     *gopb.LogData
+	Data       map[string][]*gopb.LogLines
+	StreamData map[string][]*gopb.LogLines
+	Close      *gopb.LogEndInfo
+	DialOpts   timber.DialCedarOptions
+	// Duplicates and Gaps are the ranges of log lines, numbered by the
+	// sequence metadata of AppendLogLines and StreamLogLines requests,
+	// that were received more than once or skipped, assuming each writer
+	// sends its lines in order.
+	Duplicates []LineRange
+	Gaps       []LineRange
+	sequences  map[string]uint64
 
 	// UnimplementedBuildloggerServer must be embedded for forward
 	// compatibility. See gopb.buildlogger_grpc.pb.go for more information.
@@ -297,8 +308,8 @@ func (ms *MockBuildloggerServer) CreateLog(_ context.Context, in *gopb.LogData)
 }
 
 // AppendLogLines returns an error if AppendErr is true, otherwise it adds the
-// input to Data.
-func (ms *MockBuildloggerServer) AppendLogLines(_ context.Context, in *gopb.LogLines) (*gopb.BuildloggerResponse, error) {
+// input to Data and records any duplicate or skipped log lines.
+func (ms *MockBuildloggerServer) AppendLogLines(ctx context.Context, in *gopb.LogLines) (*gopb.BuildloggerResponse, error) {
 	ms.Mu.Lock()
 	defer ms.Mu.Unlock()
 
@@ -306,6 +317,8 @@ func (ms *MockBuildloggerServer) AppendLogLines(_ context.Context, in *gopb.LogL
 		return nil, errors.New("append error")
 	}
 
+	ms.checkSequence(ctx, in)
+
 	if ms.Data == nil {
 		ms.Data = make(map[string][]*gopb.LogLines)
 	}
@@ -314,9 +327,94 @@ func (ms *MockBuildloggerServer) AppendLogLines(_ context.Context, in *gopb.LogL
 	return &gopb.BuildloggerResponse{LogId: in.LogId}, nil
 }
 
-// StreamLogLines returns a not implemented error.
-func (ms *MockBuildloggerServer) StreamLogLines(in gopb.Buildlogger_StreamLogLinesServer) error {
-	return errors.New("not implemented")
+// checkSequence compares the sequence numbers of the log lines of a request
+// to those received so far from the same writer, if the request has them.
+func (ms *MockBuildloggerServer) checkSequence(ctx context.Context, in *gopb.LogLines) {
+	writer, first, ok := requestSequence(ctx)
+	if !ok {
+		return
+	}
+
+	ms.checkLines(writer, first, in)
+}
+
+// requestSequence returns the writer and the sequence number of the first log
+// line of the request with the given context, if any.
+func requestSequence(ctx context.Context) (string, uint64, bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	writers := md.Get(timber.BuildloggerWriterKey)
+	seqs := md.Get(timber.BuildloggerSequenceKey)
+	if len(writers) != 1 || len(seqs) != 1 {
+		return "", 0, false
+	}
+	first, err := strconv.ParseUint(seqs[0], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+
+	return writers[0], first, true
+}
+
+// checkLines records the duplicates and gaps of the given log lines, the first
+// of which has the given sequence number.
+func (ms *MockBuildloggerServer) checkLines(writer string, first uint64, in *gopb.LogLines) {
+	if ms.sequences == nil {
+		ms.sequences = make(map[string]uint64)
+	}
+	next := ms.sequences[writer]
+	end := first + uint64(len(in.Lines))
+	switch {
+	case first > next:
+		ms.Gaps = append(ms.Gaps, LineRange{LogID: in.LogId, Writer: writer, Start: next, Count: first - next})
+	case first < next:
+		ms.Duplicates = append(ms.Duplicates, LineRange{LogID: in.LogId, Writer: writer, Start: first, Count: min(end, next) - first})
+	}
+	if end > next {
+		ms.sequences[writer] = end
+	}
+}
+
+// LineRange is a range of log lines sent by a Buildlogger writer, by
+// sequence number.
+type LineRange struct {
+	LogID  string
+	Writer string
+	Start  uint64
+	Count  uint64
+}
+
+// StreamLogLines adds each message received on the stream to StreamData
+// until the client closes the stream. If StreamErr is true when a message is
+// received, the stream is aborted with an error instead.
+func (ms *MockBuildloggerServer) StreamLogLines(stream gopb.Buildlogger_StreamLogLinesServer) error {
+	var logID string
+	writer, next, numbered := requestSequence(stream.Context())
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&gopb.BuildloggerResponse{LogId: logID})
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		ms.Mu.Lock()
+		if ms.StreamErr {
+			ms.Mu.Unlock()
+			return errors.New("stream error")
+		}
+		if numbered {
+			ms.checkLines(writer, next, in)
+			next += uint64(len(in.Lines))
+		}
+		if ms.StreamData == nil {
+			ms.StreamData = make(map[string][]*gopb.LogLines)
+		}
+		ms.StreamData[in.LogId] = append(ms.StreamData[in.LogId], in)
+		ms.Mu.Unlock()
+
+		logID = in.LogId
+	}
 }
 
 // CloseLog returns an error if CloseErr is true, otherwise it sets Close to